@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+type Dnode = davclient.Dnode
+type Props = davclient.Props
+
+// What the filesystem needs from the server. Paths of directories
+// may or may not end in a slash. Errors should be something the fuse
+// library can turn into an errno, anything else ends up as EIO.
+//
+// Backends can be stacked: the filesystem is usually a traceBackend
+// on top of a cryptBackend (if crypt is on) on top of a davBackend.
+type Backend interface {
+	Stat(ctx context.Context, path string) (Dnode, error)
+	// fn is called for every entry, and for the directory itself as ".".
+	Readdir(ctx context.Context, path string, fn func(Dnode)) error
+	// fn is called for everything below path, with Name set to
+	// the path relative to path. Returns davclient.ErrFiniteDepth
+	// if the whole tree cannot be had in one go.
+	ReadTree(ctx context.Context, path string, fn func(Dnode)) error
+	// An offset and length of -1 means the whole file.
+	GetRange(ctx context.Context, path string, offset int64, length int) ([]byte, error)
+	Put(ctx context.Context, path string, data []byte, create bool, excl bool) (bool, error)
+	PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error)
+	Mkcol(ctx context.Context, path string) error
+	Delete(ctx context.Context, path string) error
+	Move(ctx context.Context, oldPath, newPath string) error
+	// Write out anything that is buffered for path or below it.
+	Sync(ctx context.Context, path string) error
+	// Bytes used and available. Zero if unknown.
+	Statfs(ctx context.Context) (used, free uint64, err error)
+	Checksums(ctx context.Context, path string) (davclient.Checksums, error)
+	// Returns nil if there is no sequential upload method.
+	NewUpload(path string) davclient.Uploader
+	Caps() Caps
+}
+
+// What a backend can do.
+type Caps struct {
+	PutRange	bool	// partial updates
+	Upload		bool	// sequential uploads
+}
+
+// A DavError that the fuse library can turn into an errno.
+type fuseError struct {
+	*davclient.DavError
+}
+
+func (e fuseError) Errno() fuse.Errno {
+	return fuse.Errno(e.Errnum)
+}
+
+func toFuse(err error) error {
+	switch e := err.(type) {
+	case *davclient.DavError:
+		return fuseError{ e }
+	case syscall.Errno:
+		return fuse.Errno(e)
+	}
+	return err
+}
+
+// The Backend for a davclient.Client. The PropFind and Search
+// methods are for the Nextcloud virtual directories.
+type davBackend struct {
+	c		*davclient.Client
+}
+
+func newDavBackend(c *davclient.Client) *davBackend {
+	return &davBackend{ c }
+}
+
+func (b *davBackend) Stat(ctx context.Context, path string) (Dnode, error) {
+	dnode, err := b.c.Stat(ctx, path)
+	return dnode, toFuse(err)
+}
+
+func (b *davBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) error {
+	return toFuse(b.c.ReaddirFunc(ctx, path, true, fn))
+}
+
+func (b *davBackend) ReadTree(ctx context.Context, path string, fn func(Dnode)) error {
+	err := b.c.PropFindTree(ctx, path, func(p *Props) {
+		name := stripLastSlash(p.Name)
+		if name == "" {
+			return
+		}
+		d := p.Dnode()
+		d.Name = name
+		fn(d)
+	})
+	if err == davclient.ErrFiniteDepth {
+		return err
+	}
+	return toFuse(err)
+}
+
+func (b *davBackend) GetRange(ctx context.Context, path string, offset int64, length int) ([]byte, error) {
+	data, err := b.c.GetRange(ctx, path, offset, length)
+	return data, toFuse(err)
+}
+
+func (b *davBackend) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (bool, error) {
+	created, err := b.c.Put(ctx, path, data, create, excl)
+	return created, toFuse(err)
+}
+
+func (b *davBackend) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error) {
+	created, err := b.c.PutRange(ctx, path, data, offset, create, excl)
+	return created, toFuse(err)
+}
+
+func (b *davBackend) Mkcol(ctx context.Context, path string) error {
+	return toFuse(b.c.Mkcol(ctx, path))
+}
+
+func (b *davBackend) Delete(ctx context.Context, path string) error {
+	return toFuse(b.c.Delete(ctx, path))
+}
+
+func (b *davBackend) Move(ctx context.Context, oldPath, newPath string) error {
+	return toFuse(b.c.Move(ctx, oldPath, newPath))
+}
+
+func (b *davBackend) Sync(ctx context.Context, path string) error {
+	return nil
+}
+
+func (b *davBackend) Statfs(ctx context.Context) (used, free uint64, err error) {
+	wanted := []string{ "quota-available-bytes", "quota-used-bytes" }
+	props, err := b.c.PropFind(ctx, "/", 0, wanted)
+	if err != nil {
+		err = toFuse(err)
+		return
+	}
+	if len(props) == 1 {
+		used, _ = strconv.ParseUint(props[0].SpaceUsed, 10, 64)
+		free, _ = strconv.ParseUint(props[0].SpaceFree, 10, 64)
+	}
+	return
+}
+
+func (b *davBackend) Checksums(ctx context.Context, path string) (davclient.Checksums, error) {
+	sums, err := b.c.Checksums(ctx, path)
+	return sums, toFuse(err)
+}
+
+func (b *davBackend) NewUpload(path string) davclient.Uploader {
+	u := b.c.NewUpload(path)
+	if u == nil {
+		return nil
+	}
+	return &fuseUploader{ u }
+}
+
+func (b *davBackend) Caps() Caps {
+	return Caps{ PutRange: b.c.CanPutRange(), Upload: b.c.CanUpload() }
+}
+
+func (b *davBackend) PropFind(ctx context.Context, path string, depth int, props []string) ([]*Props, error) {
+	ret, err := b.c.PropFind(ctx, path, depth, props)
+	return ret, toFuse(err)
+}
+
+func (b *davBackend) Search(ctx context.Context, dir string, where map[string]string) ([]Dnode, error) {
+	ret, err := b.c.Search(ctx, dir, where)
+	return ret, toFuse(err)
+}
+
+type fuseUploader struct {
+	u		davclient.Uploader
+}
+
+func (f *fuseUploader) Write(ctx context.Context, data []byte) error {
+	return toFuse(f.u.Write(ctx, data))
+}
+
+func (f *fuseUploader) Close(ctx context.Context) error {
+	return toFuse(f.u.Close(ctx))
+}
+
+func (f *fuseUploader) Abort() {
+	f.u.Abort()
+}
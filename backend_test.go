@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestToFuse(t *testing.T) {
+	if toFuse(nil) != nil {
+		t.Errorf("nil error not passed through")
+	}
+	err := toFuse(&davclient.DavError{ Code: 404, Errnum: syscall.ENOENT })
+	if e, ok := err.(fuse.ErrorNumber); !ok || e.Errno() != fuse.ENOENT {
+		t.Errorf("DavError: got %#v", err)
+	}
+	if e, ok := err.(fuseError); !ok || e.Code != 404 {
+		t.Errorf("DavError: status code lost")
+	}
+	err = toFuse(syscall.ENOSYS)
+	if e, ok := err.(fuse.ErrorNumber); !ok || e.Errno() != fuse.ENOSYS {
+		t.Errorf("Errno: got %#v", err)
+	}
+	other := errors.New("other")
+	if toFuse(other) != other {
+		t.Errorf("other error changed")
+	}
+}
@@ -4,12 +4,35 @@ import (
 	"time"
 )
 
+// Attributes from a PROPFIND on the node itself are fresh for
+// statCacheTime, attributes from a directory listing for dirCacheTime.
+// That way the Lookup and Getattr calls that follow a readdir do not
+// need a request of their own.
 func (nd *Node) statInfoFresh() bool {
 	now := time.Now()
-	return nd.LastStat.Add(statCacheTime).After(now)
+	return nd.LastStat.Add(loadDuration(&nd.fs.statCacheTime)).After(now) ||
+		nd.ListTime.Add(loadDuration(&nd.fs.dirCacheTime)).After(now)
 }
 
 func (nd* Node) statInfoTouch() {
 	nd.LastStat = time.Now()
 }
 
+func (nd *Node) listInfoTouch() {
+	nd.ListTime = time.Now()
+}
+
+
+// Directory listings from a prefetch.
+func (nd *Node) dirCacheFresh() bool {
+	return nd.DirCache != nil &&
+		nd.DirCacheTime.Add(loadDuration(&nd.fs.dirCacheTime)).After(time.Now())
+}
+
+// Something changed in this directory, or to this file.
+func (nd *Node) dirCacheInvalidate() {
+	nd.DirCache = nil
+	if nd.Parent != nil {
+		nd.Parent.DirCache = nil
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+	"golang.org/x/net/context"
+)
+
+func TestListingPrimesAttributes(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(207)
+		w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">
+ <d:response><d:href>/dav/</d:href><d:propstat><d:prop>
+  <d:resourcetype><d:collection/></d:resourcetype></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+ <d:response><d:href>/dav/a.txt</d:href><d:propstat><d:prop><d:resourcetype/>
+  <d:getcontentlength>42</d:getcontentlength></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+ <d:response><d:href>/dav/sub/</d:href><d:propstat><d:prop>
+  <d:resourcetype><d:collection/></d:resourcetype></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+</d:multistatus>`))
+	}))
+	defer srv.Close()
+
+	d := &davclient.Client{ Url: srv.URL + "/dav", Transport: srv.Client().Transport }
+	root := NewFS(newDavBackend(d), WebdavFS{}).root
+	ctx := context.Background()
+	dd, err := root.ReadDirAll(ctx)
+	if err != nil || len(dd) != 3 {
+		t.Fatalf("ReadDirAll: %v, %v", dd, err)
+	}
+	for _, name := range []string{ "a.txt", "sub" } {
+		n, err := root.Lookup(ctx, &fuse.LookupRequest{ Name: name }, &fuse.LookupResponse{})
+		if err != nil {
+			t.Fatalf("Lookup(%s): %v", name, err)
+		}
+		resp := &fuse.GetattrResponse{}
+		if err := n.(*Node).Getattr(ctx, &fuse.GetattrRequest{}, resp); err != nil {
+			t.Fatalf("Getattr(%s): %v", name, err)
+		}
+		if name == "a.txt" && resp.Attr.Size != 42 {
+			t.Errorf("a.txt: size %d", resp.Attr.Size)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
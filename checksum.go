@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// Written data that is read back to check it is read in chunks of this size.
+const verifyChunkSize = 1024 * 1024
+
+// Running hash of sequential reads or writes, starting at offset 0.
+type verifier struct {
+	md5		hash.Hash
+	sha1		hash.Hash
+	sha256		hash.Hash
+	off		int64
+	broken		bool
+}
+
+func newVerifier() *verifier {
+	return &verifier{
+		md5: md5.New(),
+		sha1: sha1.New(),
+		sha256: sha256.New(),
+	}
+}
+
+func (v *verifier) add(off int64, data []byte) {
+	if v.broken || off != v.off {
+		v.broken = true
+		return
+	}
+	v.md5.Write(data)
+	v.sha1.Write(data)
+	v.sha256.Write(data)
+	v.off += int64(len(data))
+}
+
+func (v *verifier) sums() davclient.Checksums {
+	return davclient.Checksums{
+		"MD5": hex.EncodeToString(v.md5.Sum(nil)),
+		"SHA1": hex.EncodeToString(v.sha1.Sum(nil)),
+		"SHA256": hex.EncodeToString(v.sha256.Sum(nil)),
+	}
+}
+
+// Called after a successful read or write. A read or write at
+// offset 0 starts a new verifier.
+func (nf *Node) verifyAdd(write bool, off int64, data []byte) {
+	if !nf.fs.Verify {
+		return
+	}
+	nf.Lock()
+	v := &nf.verifyRead
+	if write {
+		v = &nf.verifyWrite
+	}
+	if off == 0 {
+		*v = newVerifier()
+	}
+	if *v != nil {
+		(*v).add(off, data)
+	}
+	nf.Unlock()
+}
+
+// Called on close. If the whole file was read or written in order,
+// compare our checksum with the one the server has. If the server
+// has none, written data is read back to check it.
+func (nf *Node) verifyClose(ctx context.Context) (err error) {
+	if !nf.fs.Verify {
+		return
+	}
+	nf.Lock()
+	rv, wv := nf.verifyRead, nf.verifyWrite
+	nf.verifyRead, nf.verifyWrite = nil, nil
+	size := int64(nf.Size)
+	nf.Unlock()
+	complete := func(v *verifier) bool {
+		return v != nil && !v.broken && v.off == size
+	}
+	if !complete(rv) && !complete(wv) {
+		return
+	}
+	path := nf.getPath()
+
+	remote, err := nf.fs.dav.Checksums(ctx, path)
+	if err != nil {
+		return
+	}
+	if complete(wv) && len(remote) == 0 {
+		rb := newVerifier()
+		for rb.off < size {
+			n := size - rb.off
+			if n > verifyChunkSize {
+				n = verifyChunkSize
+			}
+			var data []byte
+			data, err = nf.fs.dav.GetRange(ctx, path, rb.off, int(n))
+			if err != nil {
+				return
+			}
+			if len(data) == 0 {
+				break
+			}
+			rb.add(rb.off, data)
+		}
+		remote = rb.sums()
+	}
+	for _, v := range []*verifier{ wv, rv } {
+		if !complete(v) {
+			continue
+		}
+		local := v.sums()
+		if algo, ok := local.Compare(remote); !ok {
+			what := "read"
+			if v == wv {
+				what = "written"
+			}
+			logErrorf("%s: checksum mismatch on data %s: %s local %s, server %s",
+				path, what, algo, local[algo], remote[algo])
+			return fuse.Errno(syscall.EIO)
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestVerifier(t *testing.T) {
+	sums := davclient.Checksums{
+		"SHA1": "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"MD5": "5d41402abc4b2a76b9719d911017c592",
+	}
+	v := newVerifier()
+	v.add(0, []byte("hel"))
+	v.add(3, []byte("lo"))
+	if algo, ok := v.sums().Compare(sums); !ok || algo != "SHA1" {
+		t.Errorf("compare: %s %v", algo, ok)
+	}
+	v.add(10, []byte("x"))
+	if !v.broken {
+		t.Error("non-sequential add did not break the verifier")
+	}
+}
+
+func TestVerifyOnClose(t *testing.T) {
+	// A server that claims partial PUT support, but ignores Content-Range.
+	var mu sync.Mutex
+	var file []byte
+	var maxGet int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			file, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(204)
+		case "GET", "HEAD":
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+				end, start = len(file) - 1, 0
+			}
+			if r.Method == "GET" && end - start + 1 > maxGet {
+				maxGet = end - start + 1
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(file))
+		}
+	}))
+	defer srv.Close()
+	d := &davclient.Client{ Url: srv.URL, Transport: srv.Client().Transport, IsApache: true }
+	f := NewFS(newDavBackend(d), WebdavFS{ Verify: true })
+	ctx := context.Background()
+
+	nf := &Node{ Dnode: Dnode{ Name: "file" }, Parent: f.root, fs: f }
+	write := func(off int64, data string) {
+		if _, err := d.PutRange(ctx, "/file", []byte(data), off, true, false); err != nil {
+			t.Fatal(err)
+		}
+		nf.verifyAdd(true, off, []byte(data))
+		nf.Size = uint64(off) + uint64(len(data))
+	}
+
+	// The server ignores Content-Range, so the second write
+	// truncates the file.
+	write(0, "0123456789")
+	write(10, "abcdef")
+	if err := nf.verifyClose(ctx); err == nil {
+		t.Error("corruption not detected")
+	}
+
+	write(0, "0123456789")
+	if err := nf.verifyClose(ctx); err != nil {
+		t.Errorf("verifyClose: %v", err)
+	}
+
+	// A big file is read back in chunks.
+	write(0, strings.Repeat("x", 2 * verifyChunkSize + 10))
+	maxGet = 0
+	if err := nf.verifyClose(ctx); err != nil {
+		t.Errorf("verifyClose: %v", err)
+	}
+	if maxGet > verifyChunkSize {
+		t.Errorf("read back %d bytes at once", maxGet)
+	}
+	nf.Size = 10
+
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("OC-Checksum", "MD5:781e5e245d69b566979b86e28d23f2c7")
+	}))
+	defer srv2.Close()
+	f.dav = newDavBackend(&davclient.Client{ Url: srv2.URL, Transport: srv2.Client().Transport })
+	nf.verifyAdd(false, 0, []byte("0123456789"))
+	if err := nf.verifyClose(ctx); err != nil {
+		t.Errorf("verifyClose after read: %v", err)
+	}
+	nf.verifyAdd(false, 0, []byte("0123456788"))
+	if err := nf.verifyClose(ctx); err == nil {
+		t.Error("read mismatch not detected")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Every mount listens on a unix socket for commands from
+// "webdavfs ctl". A command is a line with the arguments separated
+// by NUL bytes. The reply is the output of the command followed by
+// a last line that is either "OK" or "ERR <message>".
+
+const ctlHelp = `status                    connection state and server information
+trace                     show trace options
+trace OPTS|none [FILE]    set trace options, and trace to FILE
+drop-caches               forget all cached attributes and listings
+revalidate PATH           forget cached attributes and listings of PATH
+nodes [PATH]              dump the node tree with reference counts
+goroutines                dump the stacks of all goroutines
+har FILE [MAXBODY]        write requests to FILE in HAR format
+har off                   stop writing the HAR file
+record FILE|off           record requests and responses for replay
+reauth                    reload the credentials file or run the helper
+reload                    reload the configuration, as on SIGHUP
+help                      this text
+`
+
+func ctlSocketDir() string {
+	if os.Getuid() == 0 {
+		return "/run/webdavfs"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "webdavfs")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("webdavfs-%d", os.Getuid()))
+}
+
+// In a place like /tmp someone else could have made the directory
+// first, so it has to be a real directory, ours, and private.
+func checkCtlSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() || fi.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s: must be a directory owned by uid %d with mode 0700", dir, os.Getuid())
+	}
+	return nil
+}
+
+// /mnt/dav/home -> $XDG_RUNTIME_DIR/webdavfs/mnt-dav-home.sock
+// Like systemd-escape --path, a "-" in a name becomes \x2d (and a
+// backslash \x5c), so that /mnt/a-b and /mnt/a/b do not collide.
+func ctlSocketName(mountpoint string) string {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		abs = mountpoint
+	}
+	name := strings.Trim(abs, "/")
+	name = strings.Replace(name, `\`, `\x5c`, -1)
+	name = strings.Replace(name, "-", `\x2d`, -1)
+	name = strings.Replace(name, "/", "-", -1)
+	if name == "" {
+		name = "-"
+	}
+	return name + ".sock"
+}
+
+// Paths are relative to the root of the mount.
+func cleanPath(p string) string {
+	return filepath.Clean("/" + p)
+}
+
+func (m *mount) startControl(path string) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return errors.New(path + ": in use by another mount")
+	}
+	os.Remove(path)
+	// the directory is private already, the socket is made so too.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return
+	}
+	m.ctl = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.ctlServe(conn)
+		}
+	}()
+	return
+}
+
+func (m *mount) stopControl() {
+	if m.ctl != nil {
+		m.ctl.Close()
+	}
+}
+
+func (m *mount) ctlServe(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	args := strings.Split(strings.TrimSuffix(line, "\n"), "\x00")
+
+	var out bytes.Buffer
+	err = m.ctlCommand(&out, args)
+	if err != nil {
+		fmt.Fprintf(&out, "ERR %s\n", err)
+	} else {
+		fmt.Fprintf(&out, "OK\n")
+	}
+	conn.Write(out.Bytes())
+}
+
+func (m *mount) ctlCommand(w io.Writer, args []string) (err error) {
+	if trace(T_FUSE) {
+		tPrintf("ctl %s", strings.Join(args, " "))
+	}
+	nargs := func(min, max int) error {
+		if len(args) - 1 < min || len(args) - 1 > max {
+			return errors.New(args[0] + ": wrong number of arguments")
+		}
+		return nil
+	}
+	switch args[0] {
+	case "status":
+		if err = nargs(0, 0); err == nil {
+			m.ctlStatus(w)
+		}
+	case "trace":
+		if err = nargs(0, 2); err != nil {
+			return
+		}
+		if len(args) > 1 {
+			fn := ""
+			if len(args) > 2 {
+				fn = args[2]
+			}
+			err = setTrace(args[1], fn)
+		}
+		fmt.Fprintf(w, "trace: %s\n", traceOptString(atomic.LoadUint32(&traceOptions)))
+	case "drop-caches":
+		if err = nargs(0, 0); err == nil {
+			err = m.revalidate("/")
+		}
+	case "revalidate":
+		if err = nargs(1, 1); err == nil {
+			err = m.revalidate(args[1])
+		}
+	case "nodes":
+		if err = nargs(0, 1); err != nil {
+			return
+		}
+		path := "/"
+		if len(args) > 1 {
+			path = args[1]
+		}
+		err = m.dumpNodes(w, path)
+	case "goroutines":
+		if err = nargs(0, 0); err == nil {
+			err = pprof.Lookup("goroutine").WriteTo(w, 1)
+		}
+	case "reauth":
+		if err = nargs(0, 0); err != nil {
+			return
+		}
+		var changed bool
+		changed, err = m.reloadCredentials()
+		if err == nil && !changed {
+			fmt.Fprintf(w, "credentials did not change\n")
+		}
+	case "har":
+		if err = nargs(1, 2); err != nil {
+			return
+		}
+		if args[1] == "off" {
+			stopHar()
+			return
+		}
+		maxBody := 0
+		if len(args) > 2 {
+			maxBody, err = strconv.Atoi(args[2])
+			if err != nil {
+				return
+			}
+		}
+		err = startHar(args[1], maxBody)
+	case "record":
+		if err = nargs(1, 1); err != nil {
+			return
+		}
+		if args[1] == "off" {
+			stopRecording()
+			return
+		}
+		err = startRecording(args[1])
+	case "reload":
+		if err = nargs(0, 0); err == nil {
+			err = reloadConfig()
+		}
+	case "help":
+		io.WriteString(w, ctlHelp)
+	default:
+		err = errors.New(args[0] + ": unknown command")
+	}
+	return
+}
+
+func (m *mount) ctlStatus(w io.Writer) {
+	client := m.client
+	kind := []string{}
+	for _, k := range []struct { is bool; name string }{
+		{ client.IsApache, "apache" },
+		{ client.IsSabre, "sabredav" },
+		{ client.IsNextcloud, "nextcloud" },
+		{ client.IsTus, "tus" },
+	} {
+		if k.is {
+			kind = append(kind, k.name)
+		}
+	}
+	fmt.Fprintf(w, "url: %s\n", client.Url)
+	if len(mounts) > 1 {
+		fmt.Fprintf(w, "mounts in this process: %d\n", len(mounts))
+	}
+	fmt.Fprintf(w, "server: %s\n", strings.Join(kind, ","))
+	fmt.Fprintf(w, "connection: %s\n", client.HealthState())
+	fmt.Fprintf(w, "partial writes: %v\n", client.CanPutRange())
+	inFlight, waiting := client.Load()
+	fmt.Fprintf(w, "requests in flight: %d\n", inFlight)
+	if client.MaxConns > 0 {
+		fmt.Fprintf(w, "connections: %d/%d, %d waiting\n", client.Busy(),
+			client.MaxConns, waiting)
+	}
+	fmt.Fprintf(w, "trace: %s\n", traceOptString(atomic.LoadUint32(&traceOptions)))
+	if file, helper := m.credSource(); helper != "" {
+		fmt.Fprintf(w, "credentials: helper %s\n", helper)
+	} else if file != "" {
+		fmt.Fprintf(w, "credentials: %s\n", file)
+	}
+}
+
+// Forget what we know about path and everything below it, here and
+// in the kernel.
+func (m *mount) revalidate(path string) (err error) {
+	root := m.fs.root
+	root.Lock()
+	nd := m.fs.lookupNode(cleanPath(path))
+	if nd == nil {
+		root.Unlock()
+		return errors.New(path + ": not in cache")
+	}
+	nd.markStale()
+	type entry struct {
+		parent	*Node
+		name	string
+	}
+	var nodes []*Node
+	var entries []entry
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		n.DirCache = nil
+		nodes = append(nodes, n)
+		for name, c := range n.Child {
+			entries = append(entries, entry{ n, name })
+			walk(c)
+		}
+	}
+	walk(nd)
+	nd.dirCacheInvalidate()
+	root.Unlock()
+
+	m.client.DropCaches()
+
+	// Not while holding the lock, the kernel might be waiting for
+	// a request of ours that needs it.
+	if m.server != nil {
+		for _, n := range nodes {
+			m.server.InvalidateNodeData(n)
+		}
+		for _, e := range entries {
+			m.server.InvalidateEntry(e.parent, e.name)
+		}
+	}
+	return
+}
+
+func (m *mount) dumpNodes(w io.Writer, path string) (err error) {
+	var b bytes.Buffer
+	now := time.Now()
+	age := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return now.Sub(t).Round(time.Millisecond).String()
+	}
+	var dump func(n *Node, indent string)
+	dump = func(n *Node, indent string) {
+		name := n.Name
+		if n.Parent == nil {
+			name = "/"
+		} else if n.IsDir {
+			name += "/"
+		}
+		flags := ""
+		if n.InUse {
+			flags += " inuse"
+		}
+		if n.Deleted {
+			flags += " deleted"
+		}
+		if n.upload != nil {
+			flags += " uploading"
+		}
+		fmt.Fprintf(&b, "%s%s inode=%d io=%d meta=%d stat=%s list=%s",
+			indent, name, n.Inode, n.RefCount[RefIO],
+			n.RefCount[RefMeta], age(n.LastStat), age(n.ListTime))
+		if n.DirCache != nil {
+			fmt.Fprintf(&b, " dircache=%d/%s", len(n.DirCache), age(n.DirCacheTime))
+		}
+		fmt.Fprintf(&b, "%s\n", flags)
+		names := []string{}
+		for name := range n.Child {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dump(n.Child[name], indent + "  ")
+		}
+	}
+
+	root := m.fs.root
+	root.Lock()
+	nd := m.fs.lookupNode(cleanPath(path))
+	if nd != nil {
+		dump(nd, "")
+	}
+	root.Unlock()
+	if nd == nil {
+		return errors.New(path + ": not in cache")
+	}
+	_, err = w.Write(b.Bytes())
+	return
+}
+
+// webdavfs ctl MOUNTPOINT|SOCKET COMMAND [ARGS...]
+func ctlMain(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl mountpoint|socket command [args...]\n", progname)
+		fmt.Fprintf(os.Stderr, "Commands:\n%s", ctlHelp)
+		return 1
+	}
+	for _, a := range args[1:] {
+		if strings.ContainsAny(a, "\x00\n") {
+			fmt.Fprintf(os.Stderr, "%s: ctl: invalid argument %q\n", progname, a)
+			return 1
+		}
+	}
+
+	paths := []string{ args[0] }
+	if fi, err := os.Stat(args[0]); err != nil || fi.Mode() & os.ModeSocket == 0 {
+		name := ctlSocketName(args[0])
+		paths = []string{ filepath.Join(ctlSocketDir(), name) }
+		if os.Getuid() != 0 {
+			paths = append(paths, filepath.Join("/run/webdavfs", name))
+		}
+	}
+	var conn net.Conn
+	var err error
+	for _, p := range paths {
+		conn, err = net.Dial("unix", p)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: ctl: %s\n", progname, err)
+		return 1
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, strings.Join(args[1:], "\x00") + "\n")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: ctl: %s\n", progname, err)
+		return 1
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: ctl: %s\n", progname, err)
+		return 1
+	}
+	out := strings.TrimSuffix(string(reply), "\n")
+	status := out
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		status = out[i+1:]
+		os.Stdout.WriteString(out[:i+1])
+	}
+	if status != "OK" {
+		fmt.Fprintf(os.Stderr, "%s: ctl: %s\n", progname, strings.TrimPrefix(status, "ERR "))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func testTree() *WebdavFS {
+	f := NewFS(newMemBackend(), WebdavFS{})
+	root := f.root
+	sub := root.addNode(Dnode{ Name: "sub", IsDir: true }, true)
+	sub.addNode(Dnode{ Name: "a.txt", Size: 3 }, true)
+	sub.DirCache = map[string]Dnode{ "a.txt": { Name: "a.txt" } }
+	sub.DirCacheTime = time.Now()
+	sub.RefCount[RefIO] = 1
+	return f
+}
+
+func TestCtlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "ctl.sock")
+	m := &mount{}
+	if err := m.startControl(sock); err != nil {
+		t.Fatal(err)
+	}
+	defer m.stopControl()
+	if err := (&mount{}).startControl(sock); err == nil {
+		t.Errorf("second listener on the same socket")
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() & 0077 != 0 {
+		t.Errorf("socket mode: %v, %v", fi.Mode(), err)
+	}
+
+	for _, tc := range []struct { cmd, reply string }{
+		{ "trace", "trace: none\nOK\n" },
+		{ "trace\x00bogus", "ERR unknown trace option: bogus\n" },
+		{ "frobnicate", "ERR frobnicate: unknown command\n" },
+	} {
+		c, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(tc.cmd + "\n"))
+		reply, _ := ioutil.ReadAll(c)
+		c.Close()
+		if !strings.HasSuffix(string(reply), tc.reply) {
+			t.Errorf("%q: got %q, want %q", tc.cmd, reply, tc.reply)
+		}
+	}
+}
+
+func TestCtlSocketDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := checkCtlSocketDir(dir); err != nil {
+		t.Errorf("private directory: %v", err)
+	}
+	os.Chmod(dir, 0755)
+	if err := checkCtlSocketDir(dir); err == nil {
+		t.Error("mode 0755 accepted")
+	}
+	link := dir + ".link"
+	os.Symlink(dir, link)
+	defer os.Remove(link)
+	os.Chmod(dir, 0700)
+	if err := checkCtlSocketDir(link); err == nil {
+		t.Error("symlink accepted")
+	}
+}
+
+func TestCtlSocketName(t *testing.T) {
+	for _, tc := range [][2]string{
+		{ "/", "-.sock" },
+		{ "/mnt/dav/home/", "mnt-dav-home.sock" },
+		{ "/mnt/a-b", `mnt-a\x2db.sock` },
+		{ "/mnt/a/b", "mnt-a-b.sock" },
+		{ `/mnt/a\x2db`, `mnt-a\x5cx2db.sock` },
+	} {
+		if n := ctlSocketName(tc[0]); n != tc[1] {
+			t.Errorf("%s: %s, want %s", tc[0], n, tc[1])
+		}
+	}
+}
+
+func TestCtlNodes(t *testing.T) {
+	m := &mount{ fs: testTree(), client: &davclient.Client{} }
+
+	var b bytes.Buffer
+	if err := m.ctlCommand(&b, []string{ "nodes" }); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "  sub/ ") ||
+	    !strings.Contains(lines[1], "io=1") || !strings.Contains(lines[1], "dircache=1/") ||
+	    !strings.HasPrefix(lines[2], "    a.txt ") {
+		t.Errorf("nodes:\n%s", b.String())
+	}
+
+	if err := m.ctlCommand(&b, []string{ "revalidate", "/sub/" }); err != nil {
+		t.Fatal(err)
+	}
+	sub := m.fs.root.Child["sub"]
+	if sub.DirCache != nil || !sub.Child["a.txt"].LastStat.IsZero() {
+		t.Errorf("revalidate did not clear caches")
+	}
+	if err := m.ctlCommand(&b, []string{ "revalidate", "/nothere" }); err == nil {
+		t.Errorf("revalidate of unknown path succeeded")
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fh.WriteString("# test\nusername = joe\npassword=se=cret\n")
+	fh.Close()
+
+	d := &davclient.Client{}
+	d.SetCredentials("joe", "old", "")
+	m := &mount{ client: d, credFile: fh.Name() }
+	changed, err := m.reloadCredentials()
+	if err != nil || !changed {
+		t.Fatalf("reloadCredentials: %v, %v", changed, err)
+	}
+	if u, p, _ := d.Credentials(); u != "joe" || p != "se=cret" {
+		t.Errorf("credentials %q %q", u, p)
+	}
+	if changed, _ = m.reloadCredentials(); changed {
+		t.Errorf("unchanged file reported as changed")
+	}
+}
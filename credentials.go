@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var credentialKeys = map[string]string{
+	"username":		"username",
+	"password":		"password",
+	"cookie":		"cookie",
+	"WEBDAV_USERNAME":	"username",
+	"WEBDAV_PASSWORD":	"password",
+	"WEBDAV_COOKIE":	"cookie",
+}
+
+// Credentials are username=, password= and cookie= lines. Empty lines
+// and lines starting with '#' are ignored. Environment files, with
+// WEBDAV_USERNAME= etc, optionally quoted and prefixed with "export",
+// work as well.
+func parseCredentials(r io.Reader, name string) (username, password, cookie string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			err = errors.New(name + ": syntax error")
+			return
+		}
+		v := strings.TrimSpace(kv[1])
+		if len(v) > 1 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1:len(v)-1]
+		}
+		switch credentialKeys[strings.TrimSpace(kv[0])] {
+		case "username":
+			username = v
+		case "password":
+			password = v
+		case "cookie":
+			cookie = v
+		default:
+			err = errors.New(name + ": unknown keyword " + kv[0])
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func readCredentials(file string) (username, password, cookie string, err error) {
+	fh, err := unprivOpenFile(file, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	return parseCredentials(fh, file)
+}
+
+// Run a helper command that prints credentials in the same format.
+func runCredHelper(cmd string) (username, password, cookie string, err error) {
+	if isSetUidGid() {
+		err = errors.New("credhelper: not allowed when running setuid")
+		return
+	}
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		err = errors.New("credhelper: " + err.Error())
+		return
+	}
+	return parseCredentials(bytes.NewReader(out), "credhelper")
+}
+
+// The secret comes from a key file, or from $WEBDAV_CRYPT_PASSWORD.
+func readCryptSecret(keyFile string) (secret []byte, err error) {
+	if keyFile != "" {
+		secret, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return
+		}
+		secret = bytes.TrimRight(secret, "\r\n")
+	} else {
+		secret = []byte(os.Getenv("WEBDAV_CRYPT_PASSWORD"))
+	}
+	if len(secret) == 0 {
+		err = errors.New("crypt: no key (use cryptkeyfile or set WEBDAV_CRYPT_PASSWORD)")
+	}
+	return
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Client side encryption of file contents and names.
+//
+// A file starts with a header: an 8 byte magic and a 16 byte random
+// file id. After that come the blocks. A block of up to 64 KiB of data
+// is stored as a 12 byte random nonce, the AES-256-GCM ciphertext and a
+// 16 byte tag. The file id and block number are authenticated as well,
+// so blocks cannot be moved around. Every time a block is rewritten
+// it gets a new nonce. An empty file has no header.
+//
+// Names are encrypted per path component, deterministically, so that
+// a lookup does not need a directory listing. The first 16 bytes of
+// HMAC-SHA256(name) are used as the IV for AES-CTR, and stored in front
+// of the ciphertext (like SIV). The result is base32 encoded. That
+// makes names longer, so a name can be at most 143 bytes.
+//
+// The keys are derived from the secret with PBKDF2, with a random salt
+// that is stored in the file .webdavfs-crypt at the root of the share.
+// It is created the first time the share is mounted.
+const (
+	cryptMagic = "WDFSC\x00\x00\x01"
+	cryptVolumeMagic = "WDFSK\x00\x00\x01"
+	cryptVolumeFile = ".webdavfs-crypt"
+	cryptSaltSize = 32
+	cryptHeaderSize = 24
+	cryptBlockSize = 64 * 1024
+	cryptNonceSize = 12
+	cryptTagSize = 16
+	cryptOverhead = cryptNonceSize + cryptTagSize
+	cryptCBlockSize = cryptBlockSize + cryptOverhead
+	cryptIvSize = 16
+	cryptMaxName = 255 * 5 / 8 - cryptIvSize
+	cryptKdfIter = 100000
+	maxFileIdCache = 10000
+)
+
+var cryptNameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+var errCryptCorrupt = errors.New("crypt: corrupt data")
+
+type Crypt struct {
+	aead		cipher.AEAD
+	nameBlock	cipher.Block
+	nameMac		[]byte
+	idMutex		sync.Mutex
+	ids		map[string][]byte
+	fileMutex	sync.Mutex
+	files		map[string]*cryptFile
+}
+
+// Writes to a file are serialized, and a partial block at the end
+// of the file is kept here until it is full, or until something
+// else needs the file.
+type cryptFile struct {
+	sync.Mutex
+	refs		int
+	block		int64
+	buf		[]byte
+}
+
+// The secret is a passphrase or the contents of a key file, the salt
+// comes from loadCryptSalt.
+func NewCrypt(secret []byte, salt []byte) (c *Crypt, err error) {
+	if len(secret) == 0 {
+		err = errors.New("crypt: empty key")
+		return
+	}
+	keys := pbkdf2.Key(secret, salt, cryptKdfIter, 96, sha256.New)
+	block, err := aes.NewCipher(keys[0:32])
+	if err != nil {
+		return
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	nameBlock, err := aes.NewCipher(keys[32:64])
+	if err != nil {
+		return
+	}
+	c = &Crypt{
+		aead: aead,
+		nameBlock: nameBlock,
+		nameMac: keys[64:96],
+		ids: map[string][]byte{},
+		files: map[string]*cryptFile{},
+	}
+	return
+}
+
+// Read the salt from the root of the share, or create it if
+// the share does not have one yet.
+func loadCryptSalt(ctx context.Context, b Backend) (salt []byte, err error) {
+	path := "/" + cryptVolumeFile
+	data, err := b.GetRange(ctx, path, -1, -1)
+	if isNotExist(err) {
+		salt = make([]byte, cryptSaltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		_, err = b.Put(ctx, path, append([]byte(cryptVolumeMagic), salt...), true, true)
+		if err == nil {
+			return
+		}
+		// perhaps someone else was first.
+		var err2 error
+		if data, err2 = b.GetRange(ctx, path, -1, -1); err2 != nil {
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	if len(data) != len(cryptVolumeMagic) + cryptSaltSize ||
+	   !bytes.Equal(data[:len(cryptVolumeMagic)], []byte(cryptVolumeMagic)) {
+		err = errors.New("crypt: " + cryptVolumeFile + ": bad header")
+		return
+	}
+	salt = data[len(cryptVolumeMagic):]
+	return
+}
+
+func (c *Crypt) nameIv(name string) []byte {
+	mac := hmac.New(sha256.New, c.nameMac)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:cryptIvSize]
+}
+
+func (c *Crypt) encryptName(name string) (string, error) {
+	if len(name) > cryptMaxName {
+		return "", fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	iv := c.nameIv(name)
+	buf := make([]byte, cryptIvSize + len(name))
+	copy(buf, iv)
+	cipher.NewCTR(c.nameBlock, iv).XORKeyStream(buf[cryptIvSize:], []byte(name))
+	return cryptNameEncoding.EncodeToString(buf), nil
+}
+
+func (c *Crypt) decryptName(ename string) (name string, err error) {
+	buf, err := cryptNameEncoding.DecodeString(ename)
+	if err != nil || len(buf) <= cryptIvSize {
+		err = errCryptCorrupt
+		return
+	}
+	iv := buf[:cryptIvSize]
+	plain := make([]byte, len(buf) - cryptIvSize)
+	cipher.NewCTR(c.nameBlock, iv).XORKeyStream(plain, buf[cryptIvSize:])
+	name = string(plain)
+	if !hmac.Equal(iv, c.nameIv(name)) {
+		err = errCryptCorrupt
+	}
+	return
+}
+
+// Encrypt all components of a path, keeping the slashes.
+func (c *Crypt) encryptPath(path string) (string, error) {
+	elems := strings.Split(path, "/")
+	for i, e := range elems {
+		if e != "" {
+			var err error
+			if elems[i], err = c.encryptName(e); err != nil {
+				return "", err
+			}
+		}
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+func (c *Crypt) decryptPath(path string) (string, error) {
+	elems := strings.Split(path, "/")
+	for i, e := range elems {
+		if e != "" {
+			d, err := c.decryptName(e)
+			if err != nil {
+				return "", err
+			}
+			elems[i] = d
+		}
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// Size of the plaintext from the size on the server, and vice versa.
+func cryptPlainSize(size uint64) uint64 {
+	if size <= cryptHeaderSize {
+		return 0
+	}
+	size -= cryptHeaderSize
+	n := size / cryptCBlockSize
+	rem := size % cryptCBlockSize
+	size = n * cryptBlockSize
+	if rem > cryptOverhead {
+		size += rem - cryptOverhead
+	}
+	return size
+}
+
+func cryptCipherSize(size uint64) uint64 {
+	if size == 0 {
+		return 0
+	}
+	n := size / cryptBlockSize
+	rem := size % cryptBlockSize
+	size = cryptHeaderSize + n * cryptCBlockSize
+	if rem > 0 {
+		size += rem + cryptOverhead
+	}
+	return size
+}
+
+func cryptAd(id []byte, block int64) []byte {
+	ad := make([]byte, len(id) + 8)
+	copy(ad, id)
+	for i := 0; i < 8; i++ {
+		ad[len(id) + i] = byte(block >> uint(56 - 8 * i))
+	}
+	return ad
+}
+
+func (c *Crypt) sealBlock(id []byte, block int64, plain []byte) []byte {
+	out := make([]byte, cryptNonceSize, cryptNonceSize + len(plain) + cryptTagSize)
+	rand.Read(out)
+	return c.aead.Seal(out, out[:cryptNonceSize], plain, cryptAd(id, block))
+}
+
+func (c *Crypt) openBlock(id []byte, block int64, data []byte) ([]byte, error) {
+	if len(data) <= cryptOverhead {
+		return nil, errCryptCorrupt
+	}
+	plain, err := c.aead.Open(nil, data[:cryptNonceSize], data[cryptNonceSize:], cryptAd(id, block))
+	if err != nil {
+		return nil, errCryptCorrupt
+	}
+	return plain, nil
+}
+
+// Decrypt consecutive blocks, starting at block number "first".
+func (c *Crypt) openBlocks(id []byte, first int64, data []byte) (plain []byte, err error) {
+	for n := first; len(data) > 0; n++ {
+		l := len(data)
+		if l > cryptCBlockSize {
+			l = cryptCBlockSize
+		}
+		var p []byte
+		p, err = c.openBlock(id, n, data[:l])
+		if err != nil {
+			return
+		}
+		plain = append(plain, p...)
+		data = data[l:]
+	}
+	return
+}
+
+func (c *Crypt) sealBlocks(id []byte, first int64, plain []byte) (data []byte) {
+	for n := first; len(plain) > 0; n++ {
+		l := len(plain)
+		if l > cryptBlockSize {
+			l = cryptBlockSize
+		}
+		data = append(data, c.sealBlock(id, n, plain[:l])...)
+		plain = plain[l:]
+	}
+	return
+}
+
+func newCryptHeader() (hdr []byte, id []byte) {
+	hdr = make([]byte, cryptHeaderSize)
+	copy(hdr, cryptMagic)
+	rand.Read(hdr[len(cryptMagic):])
+	id = hdr[len(cryptMagic):]
+	return
+}
+
+func parseCryptHeader(hdr []byte) (id []byte, err error) {
+	if len(hdr) < cryptHeaderSize || !bytes.Equal(hdr[:len(cryptMagic)], []byte(cryptMagic)) {
+		err = errCryptCorrupt
+		return
+	}
+	id = hdr[len(cryptMagic):cryptHeaderSize]
+	return
+}
+
+// Encrypt a whole file.
+func (c *Crypt) sealFile(plain []byte) []byte {
+	if len(plain) == 0 {
+		return []byte{}
+	}
+	hdr, id := newCryptHeader()
+	return append(hdr, c.sealBlocks(id, 0, plain)...)
+}
+
+// The file id of every file is cached, so that reading a range
+// does not need an extra request for the header.
+func (c *Crypt) getId(path string) []byte {
+	c.idMutex.Lock()
+	defer c.idMutex.Unlock()
+	return c.ids[path]
+}
+
+func (c *Crypt) setId(path string, id []byte) {
+	c.idMutex.Lock()
+	defer c.idMutex.Unlock()
+	if len(c.ids) >= maxFileIdCache {
+		c.ids = map[string][]byte{}
+	}
+	c.ids[path] = id
+}
+
+// Forget the id of a path, and everything below it.
+func (c *Crypt) forget(path string) {
+	c.idMutex.Lock()
+	defer c.idMutex.Unlock()
+	dir := addSlash(path)
+	for p := range c.ids {
+		if p == path || strings.HasPrefix(p, dir) {
+			delete(c.ids, p)
+		}
+	}
+}
+
+// Lock a file for writing.
+func (c *Crypt) lockFile(path string) *cryptFile {
+	c.fileMutex.Lock()
+	f := c.files[path]
+	if f == nil {
+		f = &cryptFile{}
+		c.files[path] = f
+	}
+	f.refs++
+	c.fileMutex.Unlock()
+	f.Lock()
+	return f
+}
+
+func (c *Crypt) unlockFile(path string, f *cryptFile) {
+	f.Unlock()
+	c.fileMutex.Lock()
+	f.refs--
+	if f.refs == 0 && f.buf == nil {
+		delete(c.files, path)
+	}
+	c.fileMutex.Unlock()
+}
+
+// The files at path or below it that have a buffered block.
+func (c *Crypt) pending(path string) (paths []string) {
+	c.fileMutex.Lock()
+	defer c.fileMutex.Unlock()
+	dir := addSlash(path)
+	for p := range c.files {
+		if p == path || strings.HasPrefix(p, dir) {
+			paths = append(paths, p)
+		}
+	}
+	return
+}
+
+// A Backend that encrypts everything on its way to the backend below.
+// Search and sequential uploads are not possible, and the server's
+// checksums are of the encrypted data, so they are not passed on.
+type cryptBackend struct {
+	Backend
+	c		*Crypt
+}
+
+func newCryptBackend(b Backend, c *Crypt) Backend {
+	return &cryptBackend{ Backend: b, c: c }
+}
+
+func cryptError(err error) error {
+	if err == errCryptCorrupt {
+		return fuse.EIO
+	}
+	return err
+}
+
+// Decrypt the name and fix up the size. Returns false if the name
+// cannot be decrypted.
+func (b *cryptBackend) plain(d Dnode) (Dnode, bool) {
+	if strings.TrimPrefix(d.Name, "/") == cryptVolumeFile {
+		return d, false
+	}
+	if d.Name != "" && d.Name != "." && d.Name != "/" {
+		name, err := b.c.decryptPath(d.Name)
+		if err != nil {
+			if trace(T_WEBDAV) {
+				tPrintf("crypt: skipping %s: cannot decrypt name", d.Name)
+			}
+			return d, false
+		}
+		d.Name = name
+	}
+	if !d.IsDir && !d.IsLink {
+		d.Size = cryptPlainSize(d.Size)
+	}
+	return d, true
+}
+
+// Write out the buffered block of a file. It is gone afterwards,
+// even if writing it failed.
+func (b *cryptBackend) flush(ctx context.Context, path string, f *cryptFile) (err error) {
+	if f.buf == nil {
+		return
+	}
+	buf := f.buf
+	f.buf = nil
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return
+	}
+	id, err := b.fileId(ctx, path)
+	if err != nil {
+		return
+	}
+	_, err = b.Backend.PutRange(ctx, epath, b.c.sealBlock(id, f.block, buf),
+		cryptHeaderSize + f.block * cryptCBlockSize, false, false)
+	return cryptError(err)
+}
+
+// Flush the buffered blocks of path and everything below it.
+func (b *cryptBackend) flushAll(ctx context.Context, path string) (err error) {
+	for _, p := range b.c.pending(path) {
+		f := b.c.lockFile(p)
+		if e := b.flush(ctx, p, f); e != nil && err == nil {
+			err = e
+		}
+		b.c.unlockFile(p, f)
+	}
+	return
+}
+
+// Throw away the buffered blocks of path and everything below it.
+func (b *cryptBackend) discard(path string) {
+	for _, p := range b.c.pending(path) {
+		f := b.c.lockFile(p)
+		f.buf = nil
+		b.c.unlockFile(p, f)
+	}
+}
+
+func (b *cryptBackend) Sync(ctx context.Context, path string) error {
+	return b.flushAll(ctx, path)
+}
+
+func (b *cryptBackend) stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return
+	}
+	dnode, err = b.Backend.Stat(ctx, epath)
+	if err == nil {
+		var ok bool
+		if dnode, ok = b.plain(dnode); !ok {
+			err = fuse.EIO
+		}
+	}
+	return
+}
+
+func (b *cryptBackend) Stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	if err = b.flushAll(ctx, path); err != nil {
+		return
+	}
+	return b.stat(ctx, path)
+}
+
+func (b *cryptBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) error {
+	epath, err := b.c.encryptPath(path)
+	if err == nil {
+		err = b.flushAll(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Backend.Readdir(ctx, epath, func(d Dnode) {
+		if d, ok := b.plain(d); ok {
+			fn(d)
+		}
+	})
+}
+
+func (b *cryptBackend) ReadTree(ctx context.Context, path string, fn func(Dnode)) error {
+	epath, err := b.c.encryptPath(path)
+	if err == nil {
+		err = b.flushAll(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Backend.ReadTree(ctx, epath, func(d Dnode) {
+		if d, ok := b.plain(d); ok {
+			fn(d)
+		}
+	})
+}
+
+func (b *cryptBackend) fileId(ctx context.Context, path string) (id []byte, err error) {
+	id = b.c.getId(path)
+	if id != nil {
+		return
+	}
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return
+	}
+	hdr, err := b.Backend.GetRange(ctx, epath, 0, cryptHeaderSize)
+	if err != nil {
+		return
+	}
+	id, err = parseCryptHeader(hdr)
+	if err != nil {
+		return
+	}
+	b.c.setId(path, id)
+	return
+}
+
+func (b *cryptBackend) GetRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	if err = b.flushAll(ctx, path); err != nil {
+		return
+	}
+	return b.getRange(ctx, path, offset, length)
+}
+
+func (b *cryptBackend) getRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	defer func() {
+		err = cryptError(err)
+	}()
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return
+	}
+	if offset < 0 || length < 0 {
+		data, err = b.Backend.GetRange(ctx, epath, -1, -1)
+		if err != nil || len(data) == 0 {
+			return
+		}
+		var id []byte
+		id, err = parseCryptHeader(data)
+		if err != nil {
+			return
+		}
+		b.c.setId(path, id)
+		return b.c.openBlocks(id, 0, data[cryptHeaderSize:])
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	id, err := b.fileId(ctx, path)
+	if err != nil {
+		return
+	}
+	first := offset / cryptBlockSize
+	last := (offset + int64(length) - 1) / cryptBlockSize
+	cdata, err := b.Backend.GetRange(ctx, epath, cryptHeaderSize + first * cryptCBlockSize,
+		int(last - first + 1) * cryptCBlockSize)
+	if err != nil {
+		return
+	}
+	plain, err := b.c.openBlocks(id, first, cdata)
+	if err != nil {
+		return
+	}
+	start := int(offset - first * cryptBlockSize)
+	if start >= len(plain) {
+		return []byte{}, nil
+	}
+	plain = plain[start:]
+	if len(plain) > length {
+		plain = plain[:length]
+	}
+	return plain, nil
+}
+
+func (b *cryptBackend) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (bool, error) {
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return false, err
+	}
+	f := b.c.lockFile(path)
+	defer b.c.unlockFile(path, f)
+	f.buf = nil
+	b.c.forget(path)
+	return b.Backend.Put(ctx, epath, b.c.sealFile(data), create, excl)
+}
+
+// Add data to the buffered block, if it fits there without a gap.
+func (f *cryptFile) buffer(data []byte, offset int64) bool {
+	start := f.block * cryptBlockSize
+	end := offset + int64(len(data))
+	if f.buf == nil || offset < start || offset > start + int64(len(f.buf)) ||
+	   end > start + cryptBlockSize {
+		return false
+	}
+	if n := int(end - start); n > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, n - len(f.buf))...)
+	}
+	copy(f.buf[offset - start:], data)
+	return true
+}
+
+// Partial blocks at the start and the end of the range are read,
+// merged with the new data, and written back with a new nonce.
+// If the write is beyond the end of the file the gap is filled
+// with zeroes. If the last block is not full it is kept, so that
+// the writes after it do not have to do all this again.
+func (b *cryptBackend) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (created bool, err error) {
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return
+	}
+	f := b.c.lockFile(path)
+	defer b.c.unlockFile(path, f)
+
+	if len(data) > 0 && !excl && f.buffer(data, offset) {
+		if len(f.buf) == cryptBlockSize {
+			err = b.flush(ctx, path, f)
+		}
+		return
+	}
+	if err = b.flush(ctx, path, f); err != nil {
+		return
+	}
+	defer func() {
+		err = cryptError(err)
+	}()
+
+	var size int64
+	dnode, err := b.stat(ctx, path)
+	if err == nil {
+		size = int64(dnode.Size)
+	} else if !create || !isNotExist(err) {
+		return
+	}
+	err = nil
+
+	if offset > size {
+		data = append(make([]byte, offset - size), data...)
+		offset = size
+	}
+	first := offset / cryptBlockSize
+	end := offset + int64(len(data))
+
+	var id, hdr []byte
+	if size == 0 {
+		hdr, id = newCryptHeader()
+	} else {
+		id, err = b.fileId(ctx, path)
+		if err != nil {
+			return
+		}
+	}
+
+	// Old contents of the blocks we touch.
+	blockStart := first * cryptBlockSize
+	blockEnd := (end + cryptBlockSize - 1) / cryptBlockSize * cryptBlockSize
+	if blockEnd > size {
+		blockEnd = size
+	}
+	var plain []byte
+	if blockEnd > blockStart {
+		plain, err = b.getRange(ctx, path, blockStart, int(blockEnd - blockStart))
+		if err != nil {
+			return
+		}
+	}
+	if int64(len(plain)) < end - blockStart {
+		plain = append(plain, make([]byte, end - blockStart - int64(len(plain)))...)
+	}
+	copy(plain[offset - blockStart:], data)
+
+	// Keep a partial last block, if the file already exists.
+	var keep []byte
+	n := len(plain) % cryptBlockSize
+	if size > 0 && len(data) > 0 && !excl && n > 0 {
+		keep = append([]byte{}, plain[len(plain) - n:]...)
+		plain = plain[:len(plain) - n]
+	}
+
+	if len(plain) > 0 || hdr != nil {
+		cdata := append(hdr, b.c.sealBlocks(id, first, plain)...)
+		coff := int64(0)
+		if size > 0 {
+			coff = cryptHeaderSize + first * cryptCBlockSize
+		}
+		created, err = b.Backend.PutRange(ctx, epath, cdata, coff, create, excl)
+		if err != nil {
+			return
+		}
+	}
+	b.c.setId(path, id)
+	if keep != nil {
+		f.block = first + int64(len(plain) / cryptBlockSize)
+		f.buf = keep
+	}
+	return
+}
+
+func (b *cryptBackend) Mkcol(ctx context.Context, path string) error {
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return err
+	}
+	return b.Backend.Mkcol(ctx, epath)
+}
+
+func (b *cryptBackend) Delete(ctx context.Context, path string) error {
+	epath, err := b.c.encryptPath(path)
+	if err != nil {
+		return err
+	}
+	b.discard(path)
+	b.c.forget(path)
+	return b.Backend.Delete(ctx, epath)
+}
+
+func (b *cryptBackend) Move(ctx context.Context, oldPath, newPath string) error {
+	eold, err := b.c.encryptPath(oldPath)
+	if err != nil {
+		return err
+	}
+	enew, err := b.c.encryptPath(newPath)
+	if err != nil {
+		return err
+	}
+	if err = b.flushAll(ctx, oldPath); err != nil {
+		return err
+	}
+	b.discard(newPath)
+	b.c.forget(oldPath)
+	b.c.forget(newPath)
+	return b.Backend.Move(ctx, eold, enew)
+}
+
+func (b *cryptBackend) Checksums(ctx context.Context, path string) (davclient.Checksums, error) {
+	return davclient.Checksums{}, nil
+}
+
+func (b *cryptBackend) NewUpload(path string) davclient.Uploader {
+	return nil
+}
+
+func (b *cryptBackend) Caps() Caps {
+	return Caps{ PutRange: b.Backend.Caps().PutRange }
+}
+
+func isNotExist(err error) bool {
+	e, ok := err.(fuse.ErrorNumber)
+	return ok && e.Errno() == fuse.ENOENT
+}
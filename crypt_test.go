@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func testCrypt(t *testing.T) *Crypt {
+	c, err := NewCrypt([]byte("secret"), []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func encName(c *Crypt, name string) string {
+	e, err := c.encryptName(name)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func TestCryptNames(t *testing.T) {
+	c := testCrypt(t)
+	for _, name := range []string{ "a", "file.txt", "Ünïcödé name", ".hidden" } {
+		e := encName(c, name)
+		if e != encName(c, name) {
+			t.Errorf("%s: not deterministic", name)
+		}
+		d, err := c.decryptName(e)
+		if err != nil || d != name {
+			t.Errorf("%s: decrypted to %q, %v", name, d, err)
+		}
+	}
+	if _, err := c.decryptName("plaintext.txt"); err == nil {
+		t.Error("decrypting a plain name succeeded")
+	}
+	e := []byte(encName(c, "file.txt"))
+	e[len(e)/2] ^= 1
+	if _, err := c.decryptName(string(e)); err == nil {
+		t.Error("decrypting a corrupted name succeeded")
+	}
+	if p, _ := c.encryptPath("/a/b/"); p != "/" + encName(c, "a") + "/" + encName(c, "b") + "/" {
+		t.Errorf("encryptPath: %s", p)
+	}
+
+	// the encrypted name must fit in 255 bytes.
+	long := strings.Repeat("x", cryptMaxName)
+	if e := encName(c, long); len(e) > 255 {
+		t.Errorf("name of %d bytes encrypts to %d bytes", len(long), len(e))
+	}
+	if _, err := c.encryptName(long + "x"); errnoOf(err) != syscall.ENAMETOOLONG {
+		t.Errorf("name of %d bytes: %v, want ENAMETOOLONG", len(long) + 1, err)
+	}
+	if _, err := c.encryptPath("/a/" + long + "x/b"); errnoOf(err) != syscall.ENAMETOOLONG {
+		t.Errorf("path with a long name: %v, want ENAMETOOLONG", err)
+	}
+}
+
+func TestCryptSalt(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemBackend()
+	salt, err := loadCryptSalt(ctx, mem)
+	if err != nil || len(salt) != cryptSaltSize {
+		t.Fatalf("new salt: %d bytes, %v", len(salt), err)
+	}
+	salt2, err := loadCryptSalt(ctx, mem)
+	if err != nil || !bytes.Equal(salt, salt2) {
+		t.Fatalf("salt changed: %v", err)
+	}
+	if salt3, _ := loadCryptSalt(ctx, newMemBackend()); bytes.Equal(salt, salt3) {
+		t.Error("two shares got the same salt")
+	}
+
+	// the salt file is not visible.
+	c, _ := NewCrypt([]byte("secret"), salt)
+	b := newCryptBackend(mem, c)
+	var names []string
+	b.Readdir(ctx, "/", func(d Dnode) {
+		names = append(names, d.Name)
+	})
+	if !hasNames(names, ".") {
+		t.Errorf("Readdir: %v", names)
+	}
+
+	mem.Put(ctx, "/" + cryptVolumeFile, []byte("garbage"), false, false)
+	if _, err := loadCryptSalt(ctx, mem); err == nil {
+		t.Error("loaded a bad salt file")
+	}
+}
+
+func TestCryptSizes(t *testing.T) {
+	for _, n := range []uint64{ 0, 1, cryptBlockSize - 1, cryptBlockSize, cryptBlockSize + 1, 10 * cryptBlockSize + 7 } {
+		if p := cryptPlainSize(cryptCipherSize(n)); p != n {
+			t.Errorf("size %d -> %d -> %d", n, cryptCipherSize(n), p)
+		}
+	}
+}
+
+func TestCryptReadWrite(t *testing.T) {
+	ctx := context.Background()
+	c := testCrypt(t)
+	mem := newMemBackend()
+	b := newCryptBackend(mem, c)
+
+	var want []byte
+	write := func(off int, data []byte) {
+		if _, err := b.PutRange(ctx, "/file", data, int64(off), true, false); err != nil {
+			t.Fatal(err)
+		}
+		for len(want) < off + len(data) {
+			want = append(want, 0)
+		}
+		copy(want[off:], data)
+	}
+	pattern := func(n int, b byte) []byte {
+		return bytes.Repeat([]byte{ b }, n)
+	}
+	write(0, pattern(100, 'a'))
+	write(50, pattern(cryptBlockSize, 'b'))
+	write(3 * cryptBlockSize + 10, pattern(20, 'c'))
+	write(cryptBlockSize - 5, pattern(10, 'd'))
+
+	dnode, err := b.Stat(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dnode.Size != uint64(len(want)) || dnode.Name != "file" {
+		t.Errorf("Stat: %s size %d, want file size %d", dnode.Name, dnode.Size, len(want))
+	}
+	data, err := b.GetRange(ctx, "/file", -1, -1)
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("GetRange(-1, -1): %d bytes, %v", len(data), err)
+	}
+	for _, r := range [][2]int{ { 0, 10 }, { cryptBlockSize - 8, 16 }, { 3 * cryptBlockSize, 30 } } {
+		data, err := b.GetRange(ctx, "/file", int64(r[0]), r[1])
+		if err != nil || !bytes.Equal(data, want[r[0]:r[0]+r[1]]) {
+			t.Errorf("GetRange(%d, %d): %q, %v", r[0], r[1], data, err)
+		}
+	}
+
+	// And the backend below must not see any of it.
+	if _, err := mem.Stat(ctx, "/file"); err == nil {
+		t.Error("plain name on the server")
+	}
+	raw, _ := mem.GetRange(ctx, "/" + encName(c, "file"), -1, -1)
+	if len(raw) == 0 || bytes.Contains(raw, []byte("aaaa")) {
+		t.Error("plaintext on the server")
+	}
+
+	if err := b.Mkcol(ctx, "/dir/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Move(ctx, "/file", "/dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	b.Readdir(ctx, "/dir", func(d Dnode) {
+		names = append(names, d.Name)
+		if d.Name == "moved" && d.Size != uint64(len(want)) {
+			t.Errorf("Readdir: size %d, want %d", d.Size, len(want))
+		}
+	})
+	if !hasNames(names, ".", "moved") {
+		t.Errorf("Readdir: %v", names)
+	}
+	if data, err := b.GetRange(ctx, "/dir/moved", 0, 10); err != nil || !bytes.Equal(data, want[:10]) {
+		t.Errorf("read after move: %q, %v", data, err)
+	}
+}
+
+// Counts the writes that reach the backend below.
+type putCounter struct {
+	Backend
+	puts		int
+}
+
+func (b *putCounter) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error) {
+	b.puts++
+	return b.Backend.PutRange(ctx, path, data, offset, create, excl)
+}
+
+func TestCryptBuffered(t *testing.T) {
+	ctx := context.Background()
+	mem := &putCounter{ Backend: newMemBackend() }
+	b := newCryptBackend(mem, testCrypt(t))
+
+	// small sequential writes are collected per block.
+	var want []byte
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	for i := 0; i < 40; i++ {
+		if _, err := b.PutRange(ctx, "/file", chunk, int64(len(want)), true, false); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, chunk...)
+	}
+	if mem.puts > 5 {
+		t.Errorf("%d writes of %d bytes took %d writes to the server", 40, len(chunk), mem.puts)
+	}
+	if err := b.Sync(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if dnode, err := mem.Backend.Stat(ctx, "/" + encName(b.(*cryptBackend).c, "file")); err != nil ||
+	   cryptPlainSize(dnode.Size) != uint64(len(want)) {
+		t.Errorf("after Sync: size %d on the server, want %d", cryptPlainSize(dnode.Size), len(want))
+	}
+
+	// anything that looks at the file sees the buffered data.
+	b.PutRange(ctx, "/file", []byte("xyz"), int64(len(want)), false, false)
+	want = append(want, "xyz"...)
+	if dnode, err := b.Stat(ctx, "/file"); err != nil || dnode.Size != uint64(len(want)) {
+		t.Errorf("Stat: size %d, %v, want %d", dnode.Size, err, len(want))
+	}
+	b.PutRange(ctx, "/file", []byte("uvw"), int64(len(want)), false, false)
+	want = append(want, "uvw"...)
+	if data, err := b.GetRange(ctx, "/file", -1, -1); err != nil || !bytes.Equal(data, want) {
+		t.Errorf("GetRange: %d bytes, %v, want %d", len(data), err, len(want))
+	}
+	b.PutRange(ctx, "/file", []byte("rst"), int64(len(want)), false, false)
+	want = append(want, "rst"...)
+	if err := b.Move(ctx, "/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.GetRange(ctx, "/moved", -1, -1); err != nil || !bytes.Equal(data, want) {
+		t.Errorf("after Move: %d bytes, %v, want %d", len(data), err, len(want))
+	}
+
+	// nothing is left behind.
+	b.PutRange(ctx, "/moved", []byte("abc"), 0, false, false)
+	if err := b.Delete(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.(*cryptBackend).c.files); n != 0 {
+		t.Errorf("%d files still buffered", n)
+	}
+}
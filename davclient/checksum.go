@@ -0,0 +1,119 @@
+package davclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Whole-file checksums, used to verify sequential reads and writes
+// with the verify=onclose mount option. Servers provide them in
+// different ways:
+//
+//	oc:checksums	<oc:checksum>SHA1:<hex> MD5:<hex> ADLER32:<hex></oc:checksum>
+//	OC-Checksum	SHA1:<hex>
+//	Digest		md5=<base64>,sha-256=<base64> (RFC 3230)
+//	Content-MD5	<base64>
+//
+// They are kept as algorithm (MD5, SHA1, SHA256) -> lowercase hex.
+type Checksums map[string]string
+
+var digestAlgos = map[string]string{
+	"md5":		"MD5",
+	"sha":		"SHA1",
+	"sha-1":	"SHA1",
+	"sha1":		"SHA1",
+	"sha-256":	"SHA256",
+	"sha256":	"SHA256",
+}
+
+func (c Checksums) addHex(algo string, sum string) {
+	algo = digestAlgos[strings.ToLower(algo)]
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	if algo != "" && sum != "" {
+		c[algo] = sum
+	}
+}
+
+func (c Checksums) addBase64(algo string, sum string) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sum))
+	if err == nil {
+		c.addHex(algo, hex.EncodeToString(b))
+	}
+}
+
+// "SHA1:abc MD5:def", as in oc:checksums and OC-Checksum.
+func (c Checksums) addOc(s string) {
+	for _, f := range strings.Fields(s) {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) == 2 {
+			c.addHex(kv[0], kv[1])
+		}
+	}
+}
+
+func (c Checksums) addHeaders(h http.Header) {
+	c.addOc(h.Get("OC-Checksum"))
+	for _, d := range strings.Split(getHeader(h, "Digest"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) == 2 {
+			c.addBase64(kv[0], kv[1])
+		}
+	}
+	if md := h.Get("Content-MD5"); md != "" {
+		c.addBase64("md5", md)
+	}
+}
+
+// Compare on the first algorithm both sides have.
+func (c Checksums) Compare(o Checksums) (algo string, ok bool) {
+	for _, a := range []string{ "SHA256", "SHA1", "MD5" } {
+		if c[a] != "" && o[a] != "" {
+			return a, c[a] == o[a]
+		}
+	}
+	return "", true
+}
+
+// Get the checksums the server has for a file. Nextcloud has them
+// as a property, other servers might send them with HEAD.
+func (d *Client) Checksums(ctx context.Context, path string) (sums Checksums, err error) {
+	if trace(T_WEBDAV) {
+		tPrintf("Checksums(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("Checksums: %v", err)
+				return
+			}
+			tPrintf("Checksums: returns %v", sums)
+		}()
+	}
+	sums = Checksums{}
+	if d.IsNextcloud {
+		var props []*Props
+		props, err = d.PropFind(ctx, path, 0, []string{ "resourcetype", "oc:checksums" })
+		if err != nil {
+			return
+		}
+		for _, p := range props {
+			sums.addOc(p.Checksums)
+		}
+	}
+
+	d.semAcquire()
+	defer d.semRelease()
+	req, err := d.buildRequest(ctx, "HEAD", path)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Want-Digest", "sha-256, sha, md5")
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	sums.addHeaders(resp.Header)
+	return
+}
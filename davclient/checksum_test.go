@@ -0,0 +1,26 @@
+package davclient
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestChecksumHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("OC-Checksum", "SHA1:AAF4C61DDCC5E8A2DABEDE0F3B482CD9AEA9434D")
+	h.Set("Digest", "md5=XUFAKrxLKna5cZ2REBfFkg==, unixsum=1234")
+	sums := Checksums{}
+	sums.addHeaders(h)
+	if sums["SHA1"] != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+		t.Errorf("SHA1: %q", sums["SHA1"])
+	}
+	if sums["MD5"] != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("MD5: %q", sums["MD5"])
+	}
+	if len(sums) != 2 {
+		t.Errorf("got %v", sums)
+	}
+	if algo, ok := sums.Compare(Checksums{ "MD5": sums["MD5"] }); !ok || algo != "MD5" {
+		t.Errorf("Compare: %s %v", algo, ok)
+	}
+}
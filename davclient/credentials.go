@@ -0,0 +1,39 @@
+package davclient
+
+import (
+	"sync"
+)
+
+// Credentials can be changed while mounted. Sub clients (for the
+// trash bin and versions) share them with the main client.
+type davAuth struct {
+	sync.Mutex
+	username	string
+	password	string
+	cookie		string
+}
+
+// The credentials in use right now.
+func (d *Client) Credentials() (username, password, cookie string) {
+	if d.auth == nil {
+		return d.Username, d.Password, d.Cookie
+	}
+	d.auth.Lock()
+	defer d.auth.Unlock()
+	return d.auth.username, d.auth.password, d.auth.cookie
+}
+
+// Returns true if anything changed.
+func (d *Client) SetCredentials(username, password, cookie string) bool {
+	if d.auth == nil {
+		d.auth = &davAuth{}
+	}
+	a := d.auth
+	a.Lock()
+	defer a.Unlock()
+	if a.username == username && a.password == password && a.cookie == cookie {
+		return false
+	}
+	a.username, a.password, a.cookie = username, password, cookie
+	return true
+}
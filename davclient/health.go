@@ -0,0 +1,183 @@
+package davclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	connUp = iota
+	connDown
+)
+
+const defaultProbeInterval = 5 * time.Second
+
+// Connection health. When a request fails because the server cannot
+// be reached, the state goes to connDown and a background goroutine
+// starts probing the server with OPTIONS. While the server is down
+// requests either fail right away (soft) or wait until it is back (hard).
+type connHealth struct {
+	sync.Mutex
+	state		int
+	since		time.Time
+	reason		string
+	upChan		chan struct{}
+}
+
+// Does this error mean that the server cannot be reached, or that it
+// dropped the connection? A request that ran into its own deadline or
+// was canceled does not: the server might just be slow with this one.
+func isConnError(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) ||
+	    errors.Is(err, context.Canceled) {
+		return false
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// The error for a request that failed without a response, but not
+// because the server is down.
+func requestError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return &DavError{ Message: "request canceled", Errnum: syscall.EINTR }
+	case errors.Is(err, context.DeadlineExceeded):
+		return &DavError{ Message: "request timed out", Errnum: syscall.ETIMEDOUT }
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &DavError{ Message: "request timed out", Errnum: syscall.ETIMEDOUT }
+	}
+	return err
+}
+
+func (d *Client) downError(msg string) error {
+	errno := d.DownErrno
+	if errno == 0 {
+		errno = syscall.EIO
+	}
+	return &DavError{
+		Code: 503,
+		Message: "server unreachable: " + msg,
+		Errnum: errno,
+	}
+}
+
+// Called before every request. Returns an error right away in
+// soft mode if the server is down, blocks in hard mode until it is
+// back or ctx is done.
+func (d *Client) waitHealthy(ctx context.Context) error {
+	h := &d.health
+	h.Lock()
+	if h.state == connUp {
+		h.Unlock()
+		return nil
+	}
+	reason := h.reason
+	upChan := h.upChan
+	h.Unlock()
+	if !d.Hard {
+		return d.downError(reason)
+	}
+	select {
+	case <-upChan:
+		return nil
+	case <-ctx.Done():
+		return requestError(ctx.Err())
+	}
+}
+
+func (d *Client) markDown(reason string) {
+	h := &d.health
+	h.Lock()
+	defer h.Unlock()
+	if h.state == connDown {
+		return
+	}
+	h.state = connDown
+	h.since = time.Now()
+	h.reason = reason
+	h.upChan = make(chan struct{})
+	d.logf("warn", "%s: server not responding (%s), %s", d.Url, reason, d.hardSoft())
+	go d.probe()
+}
+
+func (d *Client) markUp() {
+	h := &d.health
+	h.Lock()
+	defer h.Unlock()
+	if h.state == connUp {
+		return
+	}
+	d.logf("info", "%s: server OK after %v", d.Url,
+		time.Since(h.since).Round(time.Second))
+	h.state = connUp
+	h.reason = ""
+	close(h.upChan)
+}
+
+func (d *Client) hardSoft() string {
+	if d.Hard {
+		return "still trying"
+	}
+	return "failing requests"
+}
+
+// Probe the server until it responds again. We bypass d.do() because
+// that would block or fail on the connection state.
+func (d *Client) probe() {
+	interval := d.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	for {
+		time.Sleep(interval)
+		req, err := d.buildRequest(context.Background(), "OPTIONS", "/")
+		if err != nil {
+			return
+		}
+		req.Header.Set("User-Agent", UserAgent)
+		if trace(T_HTTP_REQUEST) {
+			tPrintf("OPTIONS %s HTTP/1.1 (probe)", req.URL.String())
+		}
+		var resp *http.Response
+		resp, err = d.cc.Do(req)
+		if err == nil {
+			drainBody(resp)
+			if resp.StatusCode < 500 {
+				d.markUp()
+				return
+			}
+		}
+		if trace(T_HTTP_REQUEST) {
+			if err != nil {
+				tPrintf("OPTIONS probe error: %v", err)
+			} else {
+				tPrintf("OPTIONS probe: %s", resp.Status)
+			}
+		}
+	}
+}
+
+// Connection state, for humans.
+func (d *Client) HealthState() string {
+	h := &d.health
+	h.Lock()
+	defer h.Unlock()
+	if h.state == connUp {
+		return "up"
+	}
+	return "down since " + h.since.Format("2006-01-02 15:04:05") + ": " + h.reason
+}
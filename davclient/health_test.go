@@ -0,0 +1,121 @@
+package davclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHealthSoft(t *testing.T) {
+	ctx := context.Background()
+	var down int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(503)
+			return
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("Dav", "1")
+		case "PROPFIND":
+			w.WriteHeader(207)
+			w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		}
+	}))
+	defer srv.Close()
+
+	d := &Client{
+		Url: srv.URL,
+		DownErrno: syscall.ETIMEDOUT,
+		ProbeInterval: 10 * time.Millisecond,
+	}
+	if err := d.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	_, err := d.Stat(ctx, "/")
+	if err == nil {
+		t.Fatal("Stat succeeded while server is down")
+	}
+	// now we should fail fast with the configured errno.
+	_, err = d.Stat(ctx, "/")
+	if daverr, ok := err.(*DavError); !ok || daverr.Errnum != syscall.ETIMEDOUT {
+		t.Fatalf("got %v, want ETIMEDOUT", err)
+	}
+	if d.HealthState() == "up" {
+		t.Fatal("state is up while server is down")
+	}
+
+	atomic.StoreInt32(&down, 0)
+	for i := 0; i < 100 && d.HealthState() != "up"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = d.Stat(ctx, "/"); err != nil {
+		t.Fatalf("server is back, but Stat failed: %v", err)
+	}
+}
+
+func TestHealthSlowRequest(t *testing.T) {
+	ctx := context.Background()
+	var slow int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) != 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("Dav", "1")
+		case "PROPFIND":
+			w.WriteHeader(207)
+			w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		}
+	}))
+	defer srv.Close()
+
+	d := &Client{
+		Url: srv.URL,
+		Timeout: 50 * time.Millisecond,
+	}
+	if err := d.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// one slow request times out, but the server is not down.
+	atomic.StoreInt32(&slow, 1)
+	_, err := d.Stat(ctx, "/")
+	if daverr, ok := err.(*DavError); !ok || daverr.Errnum != syscall.ETIMEDOUT {
+		t.Fatalf("got %v, want ETIMEDOUT", err)
+	}
+	if d.HealthState() != "up" {
+		t.Fatalf("state is %s after a slow request", d.HealthState())
+	}
+}
+
+func TestHealthHardCancel(t *testing.T) {
+	d := &Client{
+		Url: "http://127.0.0.1:1/",
+		Hard: true,
+		ProbeInterval: time.Hour,
+	}
+	d.markDown("test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- d.waitHealthy(ctx)
+	}()
+	select {
+	case err := <-done:
+		if daverr, ok := err.(*DavError); !ok || daverr.Errnum != syscall.ETIMEDOUT {
+			t.Fatalf("got %v, want ETIMEDOUT", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitHealthy did not return when the context expired")
+	}
+}
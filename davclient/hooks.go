@@ -0,0 +1,55 @@
+package davclient
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Callbacks for logging and metrics. All of them are optional, and
+// they can be called from many goroutines at once.
+type Hooks struct {
+	// Changes in the state of the connection. level is "warn" or "info".
+	Log		func(level string, msg string)
+	// Called once per request that was sent, after any retries.
+	Request		func(req *http.Request, resp *http.Response, err error, latency time.Duration)
+	// Called for every try. status is 0 if there was no response.
+	Try		func(method string, status int, latency time.Duration)
+	// Bytes of file data written to or read from the server.
+	Bytes		func(written bool, n int)
+}
+
+// Counters, shared with sub clients.
+type clientStats struct {
+	inFlight	int64
+	waiting		int64
+}
+
+func (d *Client) logf(level string, format string, args ...interface{}) {
+	if d.Hooks.Log != nil {
+		d.Hooks.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *Client) hookBytes(written bool, n int) {
+	if d.Hooks.Bytes != nil {
+		d.Hooks.Bytes(written, n)
+	}
+}
+
+// Requests being sent right now, and requests waiting for one of the
+// MaxConns connections.
+func (d *Client) Load() (inFlight int, waiting int) {
+	if d.stats == nil {
+		return
+	}
+	inFlight = int(atomic.LoadInt64(&d.stats.inFlight))
+	waiting = int(atomic.LoadInt64(&d.stats.waiting))
+	return
+}
+
+// Connections in use, when MaxConns is set.
+func (d *Client) Busy() int {
+	return len(d.davSem)
+}
@@ -0,0 +1,225 @@
+package davclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultChunkSize = 10 * 1024 * 1024
+	minChunkSize = 5 * 1024 * 1024
+	maxChunks = 10000
+)
+
+// Find out if this is Nextcloud / ownCloud, and if so, what the
+// root of the dav endpoints is and which user we are.
+// The url is either .../remote.php/dav/files/<user>/... or the
+// legacy .../remote.php/webdav/...
+func (d *Client) detectNextcloud() {
+	i := strings.Index(d.base, "/remote.php/")
+	if i < 0 {
+		return
+	}
+	root := d.base[:i] + "/remote.php/dav"
+	user := ""
+	rest := d.base[i + len("/remote.php/"):]
+	if strings.HasPrefix(rest, "dav/files/") {
+		user = strings.SplitN(rest[len("dav/files/"):], "/", 2)[0]
+	} else if rest == "webdav" || strings.HasPrefix(rest, "webdav/") {
+		user = d.Username
+	}
+	if user == "" {
+		return
+	}
+	d.IsNextcloud = true
+	d.ncRoot = root
+	d.ncUser = user
+	if trace(T_WEBDAV) {
+		tPrintf("Connect: Nextcloud detected, dav root %s, user %s", root, user)
+	}
+}
+
+// The server path of the files root of the user, and where the
+// mount is relative to that.
+func (d *Client) ncFilesRoot() (root string, rel string) {
+	root = d.ncRoot + "/files/" + d.ncUser
+	i := strings.Index(d.base, "/remote.php/")
+	rest := d.base[i + len("/remote.php/"):]
+	if strings.HasPrefix(rest, "webdav") {
+		rel = rest[len("webdav"):]
+	} else {
+		rel = rest[len("dav/files/") + len(d.ncUser):]
+	}
+	return
+}
+
+// A client for another dav endpoint on the same server.
+func (d *Client) subClient(base string) *Client {
+	return &Client{
+		Url: d.serverUrl(base),
+		Username: d.Username,
+		Password: d.Password,
+		Cookie: d.Cookie,
+		auth: d.auth,
+		Methods: d.Methods,
+		DavSupport: d.DavSupport,
+		Dasl: d.Dasl,
+		MaxConns: d.MaxConns,
+		Retries: d.tunables().Retries,
+		Reauth: d.Reauth,
+		Hard: d.Hard,
+		DownErrno: d.DownErrno,
+		ErrnoMap: d.ErrnoMap,
+		ProbeInterval: d.ProbeInterval,
+		Hooks: d.Hooks,
+		base: base,
+		cc: d.cc,
+		transport: d.transport,
+		davSem: d.davSem,
+		stats: d.stats,
+	}
+}
+
+// Clients for the Nextcloud trash bin and versions endpoints of the
+// user. They share credentials and connections with d.
+func (d *Client) Trashbin() *Client {
+	return d.subClient(d.ncRoot + "/trashbin/" + d.ncUser)
+}
+
+func (d *Client) Versions() *Client {
+	return d.subClient(d.ncRoot + "/versions/" + d.ncUser)
+}
+
+// A client for the files root of the user, and the path of the
+// mount relative to that.
+func (d *Client) FilesRoot() (files *Client, rel string) {
+	root, rel := d.ncFilesRoot()
+	files = d.subClient(root)
+	return
+}
+
+// Nextcloud chunked upload v2, see
+// https://docs.nextcloud.com/server/latest/developer_manual/client_apis/WebDAV/chunking.html
+type chunkedUpload struct {
+	d		*Client
+	path		string
+	dir		string
+	dest		string
+	buf		[]byte
+	chunkSize	int
+	chunk		int
+	total		int64
+	started		bool
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (d *Client) newChunkedUpload(path string) *chunkedUpload {
+	cs := d.ChunkSize
+	if cs <= 0 {
+		cs = defaultChunkSize
+	}
+	if cs < minChunkSize {
+		cs = minChunkSize
+	}
+	return &chunkedUpload{
+		d: d,
+		path: path,
+		dir: d.ncRoot + "/uploads/" + d.ncUser + "/webdavfs-" + randomId(),
+		dest: d.fullUrl(path),
+		chunkSize: cs,
+	}
+}
+
+func (c *chunkedUpload) request(ctx context.Context, method string, path string, data []byte) (err error) {
+	d := c.d
+	d.semAcquire()
+	defer d.semRelease()
+
+	req, err := d.buildRequestUrl(ctx, method, d.serverUrl(path), data)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Destination", c.dest)
+	if method == "MOVE" {
+		req.Header.Set("OC-Total-Length", strconv.FormatInt(c.total, 10))
+		req.Header.Set("Overwrite", "T")
+	}
+	resp, err := d.do(req)
+	drainBody(resp)
+	return
+}
+
+func (c *chunkedUpload) putChunk(ctx context.Context) (err error) {
+	if !c.started {
+		err = c.request(ctx, "MKCOL", c.dir, nil)
+		if err != nil {
+			return
+		}
+		c.started = true
+	}
+	if c.chunk >= maxChunks {
+		return c.d.davToErrno(&DavError{
+			Message: "413 too many chunks",
+			Code: 413,
+		})
+	}
+	c.chunk++
+	err = c.request(ctx, "PUT", fmt.Sprintf("%s/%05d", c.dir, c.chunk), c.buf)
+	c.buf = c.buf[:0]
+	return
+}
+
+func (c *chunkedUpload) Write(ctx context.Context, data []byte) (err error) {
+	c.buf = append(c.buf, data...)
+	c.total += int64(len(data))
+	if len(c.buf) >= c.chunkSize {
+		if trace(T_WEBDAV) {
+			tPrintf("chunkedUpload(%s): chunk %d, %d bytes", c.path, c.chunk + 1, len(c.buf))
+		}
+		err = c.putChunk(ctx)
+	}
+	return
+}
+
+func (c *chunkedUpload) Close(ctx context.Context) (err error) {
+	if trace(T_WEBDAV) {
+		tPrintf("chunkedUpload(%s): finish, %d bytes", c.path, c.total)
+		defer func() {
+			if err != nil {
+				tPrintf("chunkedUpload(%s): %v", c.path, err)
+			}
+		}()
+	}
+	if !c.started {
+		// small file, a single PUT will do.
+		_, err = c.d.Put(ctx, c.path, c.buf, true, false)
+		return
+	}
+	if len(c.buf) > 0 {
+		err = c.putChunk(ctx)
+	}
+	if err == nil {
+		err = c.request(ctx, "MOVE", c.dir + "/.file", nil)
+	}
+	if err != nil {
+		c.Abort()
+	}
+	return
+}
+
+func (c *chunkedUpload) Abort() {
+	if c.started {
+		c.request(context.Background(), "DELETE", c.dir, nil)
+		c.started = false
+	}
+	c.buf = nil
+}
@@ -0,0 +1,71 @@
+package davclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var log []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		line := r.Method + " " + r.URL.Path
+		if r.Method == "PUT" {
+			line += " " + string(body)
+		}
+		if r.Method == "MOVE" {
+			line += " " + r.Header.Get("OC-Total-Length")
+		}
+		log = append(log, line)
+		mu.Unlock()
+		if !strings.HasSuffix(r.Header.Get("Destination"), "/remote.php/dav/files/alice/docs/file.txt") {
+			t.Errorf("%s: wrong destination %q", r.Method, r.Header.Get("Destination"))
+		}
+		w.WriteHeader(201)
+	}))
+	defer srv.Close()
+
+	d := &Client{
+		Url: srv.URL + "/remote.php/dav/files/alice",
+		base: "/remote.php/dav/files/alice",
+		cc: srv.Client(),
+	}
+	d.detectNextcloud()
+	if !d.CanUpload() || d.ncUser != "alice" || d.ncRoot != "/remote.php/dav" {
+		t.Fatalf("Nextcloud not detected: %v %q %q", d.IsNextcloud, d.ncUser, d.ncRoot)
+	}
+
+	up := d.newChunkedUpload("/docs/file.txt")
+	up.chunkSize = 4
+	for _, s := range []string{ "ab", "cd", "efgh", "ij" } {
+		if err := up.Write(ctx, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := up.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := up.dir
+	if !strings.HasPrefix(dir, "/remote.php/dav/uploads/alice/") {
+		t.Errorf("upload dir %s", dir)
+	}
+	want := []string{
+		"MKCOL " + dir,
+		"PUT " + dir + "/00001 abcd",
+		"PUT " + dir + "/00002 efgh",
+		"PUT " + dir + "/00003 ij",
+		"MOVE " + dir + "/.file 10",
+	}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests:\n%s\nwant:\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+}
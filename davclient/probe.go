@@ -0,0 +1,133 @@
+package davclient
+
+import (
+	"context"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Result of probing a server for partial PUT support.
+type probeResult struct {
+	Method	string		`json:"method"`
+	Time	time.Time	`json:"time"`
+}
+
+const (
+	probeNone = "none"
+	probeApache = "apache"
+	probeSabre = "sabre"
+	probeCacheTime = 7 * 24 * time.Hour
+)
+
+func probeCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "webdavfs", "probe.json")
+}
+
+func readProbeCache(fn string) (cache map[string]probeResult) {
+	cache = map[string]probeResult{}
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return
+}
+
+func writeProbeCache(fn string, cache map[string]probeResult) {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(fn), 0700)
+	tmp := fn + ".tmp"
+	if ioutil.WriteFile(tmp, data, 0600) == nil {
+		os.Rename(tmp, fn)
+	}
+}
+
+// See if the server can do partial updates even though it does not
+// say so (or a proxy hides the Server: header). The answer is cached
+// on disk per server URL.
+func (d *Client) probePutRange(ctx context.Context) {
+	fn := probeCacheFile()
+	var cache map[string]probeResult
+	if fn != "" {
+		cache = readProbeCache(fn)
+		if r, ok := cache[d.Url]; ok && time.Since(r.Time) < probeCacheTime {
+			if trace(T_WEBDAV) {
+				tPrintf("Connect: cached probe result for %s: %s", d.Url, r.Method)
+			}
+			d.setProbeResult(r.Method)
+			return
+		}
+	}
+
+	method := probeNone
+	if d.probeScratch(ctx, d.apachePutRange) {
+		method = probeApache
+	} else if d.Methods["PATCH"] && d.probeScratch(ctx, d.sabrePutRange) {
+		method = probeSabre
+	}
+	if trace(T_WEBDAV) {
+		tPrintf("Connect: probe result for %s: %s", d.Url, method)
+	}
+	d.setProbeResult(method)
+
+	if fn != "" {
+		cache[d.Url] = probeResult{ Method: method, Time: time.Now() }
+		writeProbeCache(fn, cache)
+	}
+}
+
+func (d *Client) setProbeResult(method string) {
+	switch method {
+	case probeApache:
+		d.IsApache = true
+	case probeSabre:
+		d.IsSabre = true
+	}
+}
+
+type putRangeFunc func(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error)
+
+// Create a scratch file, overwrite a part in the middle, and
+// check that the result is exactly what we expect.
+func (d *Client) probeScratch(ctx context.Context, putRange putRangeFunc) (ok bool) {
+	path := "/.webdavfs-probe-" + randomId()
+	orig := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ+/")
+	want := append([]byte{}, orig...)
+	copy(want[20:], "XXXXXXXX")
+
+	req, err := d.buildRequest(ctx, "PUT", path, orig)
+	if err != nil {
+		return
+	}
+	req.Header.Set("If-None-Match", "*")
+	d.semAcquire()
+	resp, err := d.do(req)
+	d.semRelease()
+	drainBody(resp)
+	if err != nil {
+		return
+	}
+	defer d.Delete(ctx, path)
+
+	d.semAcquire()
+	_, err = putRange(ctx, path, []byte("XXXXXXXX"), 20, false, false)
+	d.semRelease()
+	if err != nil {
+		return
+	}
+	data, err := d.GetRange(ctx, path, 0, len(want) + 16)
+	if err != nil {
+		return
+	}
+	return bytes.Equal(data, want)
+}
@@ -0,0 +1,85 @@
+package davclient
+
+import (
+	"context"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A tiny server that stores files in memory. If honorRange is false it
+// behaves like a proxy that strips Content-Range: a partial PUT
+// replaces the whole file.
+func putRangeServer(honorRange bool) *httptest.Server {
+	var mu sync.Mutex
+	files := map[string][]byte{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			var start, end int64
+			cr := r.Header.Get("Content-Range")
+			if cr != "" && honorRange {
+				fmt.Sscanf(cr, "bytes %d-%d/*", &start, &end)
+				data := files[r.URL.Path]
+				for int64(len(data)) < start + int64(len(body)) {
+					data = append(data, 0)
+				}
+				copy(data[start:], body)
+				files[r.URL.Path] = data
+			} else {
+				files[r.URL.Path] = body
+			}
+			w.WriteHeader(204)
+		case "GET":
+			data, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		case "DELETE":
+			delete(files, r.URL.Path)
+			w.WriteHeader(204)
+		case "PROPFIND":
+			data, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(207)
+			fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response>` +
+				`<d:href>%s</d:href><d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength>` +
+				`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`,
+				r.URL.EscapedPath(), len(data))
+		}
+	}))
+}
+
+func TestProbePutRange(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	for _, honor := range []bool{ true, false } {
+		srv := putRangeServer(honor)
+		d := &Client{ Url: srv.URL, cc: srv.Client() }
+		d.probePutRange(ctx)
+		if d.IsApache != honor {
+			t.Errorf("server honors Content-Range: %v, probe says %v", honor, d.IsApache)
+		}
+
+		// second time it must come from the cache.
+		srv.Close()
+		d = &Client{ Url: srv.URL, cc: srv.Client() }
+		d.probePutRange(ctx)
+		if d.IsApache != honor {
+			t.Errorf("cached result %v, want %v", d.IsApache, honor)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package davclient
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const maxSearchResults = 1000
+
+// Does the server support basicsearch (RFC 5323) ?
+func (d *Client) CanSearch() bool {
+	return d.Methods["SEARCH"] && d.Dasl["<DAV:basicsearch>"]
+}
+
+// Translate a shell glob to a basicsearch "like" pattern.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Search everything below path. "where" maps property names to glob
+// patterns, which all have to match. Returns the matching entries with
+// Name set to their path relative to the root of the mount.
+func (d *Client) Search(ctx context.Context, dir string, where map[string]string) (ret []Dnode, err error) {
+
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) {
+		tPrintf("Search(%s, %v)", dir, where)
+		defer func() {
+			if err != nil {
+				tPrintf("Search: %v", err)
+				return
+			}
+			tPrintf("Search: returns %d entries", len(ret))
+		}()
+	}
+
+	if !d.CanSearch() {
+		err = syscall.ENOSYS
+		return
+	}
+	if len(where) == 0 {
+		err = errors.New("empty search")
+		return
+	}
+
+	// Nextcloud wants the SEARCH on the dav root, with the scope
+	// relative to that. Others search on the collection itself.
+	reqUrl := d.fullUrl(addSlash(dir))
+	scope := reqUrl
+	prefix := d.base
+	if d.IsNextcloud {
+		var rel string
+		prefix, rel = d.ncFilesRoot()
+		prefix += rel
+		reqUrl = d.serverUrl(d.ncRoot + "/")
+		scope = "/files/" + d.ncUser + rel + dir
+	}
+
+	a := append([]string{}, `<?xml version="1.0" encoding="utf-8" ?><D:searchrequest xmlns:D="DAV:"><D:basicsearch>`)
+	a = append(a, "<D:select><D:prop>", mostProps, "</D:prop></D:select>")
+	a = append(a, "<D:from><D:scope><D:href>", xmlEscape(scope), "</D:href><D:depth>infinity</D:depth></D:scope></D:from>")
+	a = append(a, "<D:where>")
+	if len(where) > 1 {
+		a = append(a, "<D:and>")
+	}
+	for prop, glob := range where {
+		a = append(a, "<D:like><D:prop><D:", prop, "/></D:prop><D:literal>", xmlEscape(globToLike(glob)), "</D:literal></D:like>")
+	}
+	if len(where) > 1 {
+		a = append(a, "</D:and>")
+	}
+	a = append(a, "</D:where>")
+	a = append(a, "<D:orderby/>")
+	a = append(a, "<D:limit><D:nresults>", strconv.Itoa(maxSearchResults), "</D:nresults></D:limit>")
+	a = append(a, "</D:basicsearch></D:searchrequest>")
+	x := strings.Join(a, "")
+
+	req, err := d.buildRequestUrl(ctx, "SEARCH", reqUrl, x)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	resp, err := d.do(req)
+	if err != nil {
+		return
+	}
+	defer drainBody(resp)
+
+	if !statusIsValid(resp) {
+		err = errors.New(resp.Status)
+		return
+	}
+
+	_, err = decodeMultiStatus(resp.Body, func(respTag *Response) {
+		props := respTag.cookedProps()
+		if props == nil {
+			return
+		}
+		u, _ := url.ParseRequestURI(respTag.Href)
+		if u == nil || !strings.HasPrefix(u.Path, prefix + "/") {
+			return
+		}
+		props.Name = stripLastSlash(u.Path[len(prefix):])
+		if props.Name == stripLastSlash(dir) {
+			return
+		}
+		ret = append(ret, props.Dnode())
+		ret[len(ret)-1].Name = props.Name
+	})
+	return
+}
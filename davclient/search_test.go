@@ -0,0 +1,82 @@
+package davclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGlobToLike(t *testing.T) {
+	for glob, like := range map[string]string{
+		"*.pdf":	"%.pdf",
+		"a?c":		"a_c",
+		"100%_*":	`100\%\_%`,
+	} {
+		if got := globToLike(glob); got != like {
+			t.Errorf("globToLike(%q) = %q, want %q", glob, got, like)
+		}
+	}
+}
+
+func TestSearchNextcloud(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "SEARCH" || r.URL.Path != "/remote.php/dav/" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, s := range []string{
+			"<D:href>/files/joe/docs/</D:href>",
+			"<D:displayname/></D:prop><D:literal>%.pdf</D:literal>",
+		} {
+			if !strings.Contains(string(body), s) {
+				t.Errorf("request does not contain %s", s)
+			}
+		}
+		w.WriteHeader(207)
+		w.Write([]byte(`<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+ <d:response>
+  <d:href>/remote.php/dav/files/joe/docs/a/report.pdf</d:href>
+  <d:propstat><d:prop><d:getcontentlength>42</d:getcontentlength></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/files/joe/docs/b/report.pdf</d:href>
+  <d:propstat><d:prop><d:getcontentlength>7</d:getcontentlength></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/files/joe/other.pdf</d:href>
+  <d:propstat><d:prop><d:getcontentlength>1</d:getcontentlength></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+</d:multistatus>`))
+	}))
+	defer srv.Close()
+
+	d := &Client{
+		Url: srv.URL + "/remote.php/dav/files/joe/docs",
+		Transport: srv.Client().Transport,
+		Methods: map[string]bool{ "SEARCH": true },
+		Dasl: map[string]bool{ "<DAV:basicsearch>": true },
+	}
+	d.init()
+	d.detectNextcloud()
+
+	res, err := d.Search(context.Background(), "/", map[string]string{ "displayname": "*.pdf" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("got %d results, want 2", len(res))
+	}
+	if res[0].Name != "/a/report.pdf" || res[0].Size != 42 {
+		t.Errorf("result 0: %s %d", res[0].Name, res[0].Size)
+	}
+	if res[1].Name != "/b/report.pdf" || res[1].Size != 7 {
+		t.Errorf("result 1: %s %d", res[1].Name, res[1].Size)
+	}
+}
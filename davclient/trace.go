@@ -0,0 +1,58 @@
+package davclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Kinds of trace output, see SetTrace.
+const (
+	T_WEBDAV	= 1 << iota
+	T_HTTP_REQUEST
+	T_HTTP_HEADERS
+)
+
+var traceEnabled func(flags uint32) bool
+var tracePrintf func(format string, args ...interface{})
+
+// SetTrace makes the package write trace output with printf, for the
+// kinds of tracing that enabled returns true for. Call it before
+// using any client; both functions are called from many goroutines.
+func SetTrace(enabled func(flags uint32) bool, printf func(format string, args ...interface{})) {
+	traceEnabled = enabled
+	tracePrintf = printf
+}
+
+func trace(flags uint32) bool {
+	return traceEnabled != nil && traceEnabled(flags)
+}
+
+func tPrintf(format string, args ...interface{}) {
+	if tracePrintf != nil {
+		tracePrintf(format, args...)
+	}
+}
+
+func tJson(obj interface{}) string {
+	r, err := json.Marshal(obj)
+	if err == nil {
+		return string(r)
+	}
+	return fmt.Sprintf("%+v", obj)
+}
+
+func tHeaders(hdrs http.Header, prefix string) string {
+	h := []string{}
+	r := []string{}
+	for n := range hdrs {
+		h = append(h, n)
+	}
+	sort.Strings(h)
+	for _, m := range h {
+		r = append(r, prefix + m + ": " + strings.Join(hdrs[m], "\n") + "\n")
+	}
+	return strings.Join(r, "")
+}
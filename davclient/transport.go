@@ -0,0 +1,229 @@
+package davclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultTimeout = 60 * time.Second
+
+// The http.Transport can be replaced while mounted, to pick up new
+// TLS certificates or settings. Requests that are in flight finish on
+// the transport they started on. The timeout covers the whole request
+// including reading the body, like http.Client.Timeout does, but can
+// be changed on the fly.
+type davTransport struct {
+	sync.Mutex
+	tr		http.RoundTripper
+	timeout		time.Duration
+	hook		func(rt http.RoundTripper, req *http.Request) (*http.Response, error)
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel		context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (t *davTransport) set(tr http.RoundTripper, timeout time.Duration) {
+	t.Lock()
+	old := t.tr
+	t.tr = tr
+	t.timeout = timeout
+	t.Unlock()
+	if old == tr {
+		return
+	}
+	if c, ok := old.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t *davTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	t.Lock()
+	tr, timeout := t.tr, t.timeout
+	t.Unlock()
+	if timeout <= 0 {
+		return t.roundTrip(tr, req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err = t.roundTrip(tr, req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return
+	}
+	resp.Body = &cancelBody{ resp.Body, cancel }
+	return
+}
+
+func (t *davTransport) roundTrip(tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if t.hook != nil {
+		return t.hook(tr, req)
+	}
+	return tr.RoundTrip(req)
+}
+
+// The options that can be changed with Reload while the client is in
+// use. A Tunables is never changed once it is stored in a client, so
+// requests can use it without a lock.
+type Tunables struct {
+	Retries		int
+	Timeout		time.Duration
+	MaxIdleConns	int
+	CACert		string
+	ClientCert	string
+	ClientKey	string
+}
+
+// What Reload set last, or the fields of the client if it was not
+// called yet.
+func (d *Client) tunables() *Tunables {
+	if t, ok := d.live.Load().(*Tunables); ok {
+		return t
+	}
+	return &Tunables{
+		Retries: d.Retries,
+		Timeout: d.Timeout,
+		MaxIdleConns: d.MaxIdleConns,
+		CACert: d.CACert,
+		ClientCert: d.ClientCert,
+		ClientKey: d.ClientKey,
+	}
+}
+
+// Change the tunables. This builds a new http.Transport, reading
+// the TLS certificates again.
+func (d *Client) Reload(t Tunables) (err error) {
+	d.reloadMutex.Lock()
+	defer d.reloadMutex.Unlock()
+	err = d.reloadTransport(&t)
+	if err == nil {
+		d.live.Store(&t)
+	}
+	return
+}
+
+func tlsConfig(t *Tunables) (cfg *tls.Config, err error) {
+	if t.CACert == "" && t.ClientCert == "" {
+		return
+	}
+	cfg = &tls.Config{}
+	if t.CACert != "" {
+		var pem []byte
+		pem, err = ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return
+		}
+		cfg.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+		err = nil
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			err = errors.New(t.CACert + ": no certificates found")
+			return
+		}
+	}
+	if t.ClientCert != "" {
+		key := t.ClientKey
+		if key == "" {
+			key = t.ClientCert
+		}
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(t.ClientCert, key)
+		if err != nil {
+			return
+		}
+		cfg.Certificates = []tls.Certificate{ cert }
+	}
+	return
+}
+
+// Clients with ShareTransport set use the same http.Transport, and so
+// the same pool of idle connections, if they talk to the same server
+// with the same TLS and connection options.
+var shared = struct {
+	sync.Mutex
+	tr		map[string]*http.Transport
+}{ tr: map[string]*http.Transport{} }
+
+func (d *Client) sharedKey(t *Tunables) string {
+	u, err := url.Parse(d.Url)
+	if err != nil {
+		return d.Url
+	}
+	return fmt.Sprintf("%s://%s\x00%s\x00%s\x00%s\x00%d", u.Scheme, u.Host,
+		t.CACert, t.ClientCert, t.ClientKey, t.MaxIdleConns)
+}
+
+// Forget the shared transports, so that the next Reload of
+// every client builds a new one. Clients that are not reloaded keep
+// the one they have.
+func ResetSharedTransports() {
+	shared.Lock()
+	shared.tr = map[string]*http.Transport{}
+	shared.Unlock()
+}
+
+// Build a new http.Transport from t, reading the TLS certificates
+// again. Does nothing if Transport was set.
+func (d *Client) reloadTransport(t *Tunables) (err error) {
+	if d.transport == nil || d.Transport != nil {
+		return
+	}
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if !d.ShareTransport {
+		tr, err := newTransport(t)
+		if err == nil {
+			d.transport.set(tr, timeout)
+		}
+		return err
+	}
+	key := d.sharedKey(t)
+	shared.Lock()
+	tr := shared.tr[key]
+	if tr == nil {
+		tr, err = newTransport(t)
+		if err == nil {
+			shared.tr[key] = tr
+		}
+	}
+	shared.Unlock()
+	if err != nil {
+		return
+	}
+	d.transport.set(tr, timeout)
+	return
+}
+
+func newTransport(t *Tunables) (tr *http.Transport, err error) {
+	tlsConfig, err := tlsConfig(t)
+	if err != nil {
+		return
+	}
+	// Override some values from DefaultTransport.
+	tr = http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = t.MaxIdleConns
+	tr.DisableCompression = true
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+	return
+}
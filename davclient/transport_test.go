@@ -0,0 +1,67 @@
+package davclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransportTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	d := &Client{ Url: srv.URL, Timeout: 100 * time.Millisecond }
+	if _, err := d.request(ctx, "GET", "/"); err == nil {
+		t.Errorf("request did not time out")
+	}
+	d.markUp()
+
+	if err := d.Reload(Tunables{ Timeout: 2 * time.Second }); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.request(ctx, "GET", "/")
+	if err != nil {
+		t.Fatalf("after reload: %v", err)
+	}
+	drainBody(resp)
+}
+
+func TestShareTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	defer ResetSharedTransports()
+
+	ctx := context.Background()
+	a := &Client{ Url: srv.URL + "/a", ShareTransport: true }
+	b := &Client{ Url: srv.URL + "/b", ShareTransport: true }
+	c := &Client{ Url: srv.URL + "/c", ShareTransport: true, MaxIdleConns: 2 }
+	u := &Client{ Url: srv.URL + "/u" }
+	for _, d := range []*Client{ a, b, c, u } {
+		resp, err := d.request(ctx, "GET", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainBody(resp)
+	}
+	if a.transport.tr != b.transport.tr {
+		t.Errorf("same server, different transports")
+	}
+	if a.transport.tr == c.transport.tr || a.transport.tr == u.transport.tr {
+		t.Errorf("transport shared with different options")
+	}
+
+	old := a.transport.tr
+	ResetSharedTransports()
+	a.Reload(*a.tunables())
+	b.Reload(*b.tunables())
+	if a.transport.tr == old || a.transport.tr != b.transport.tr {
+		t.Errorf("not shared after reset and reload")
+	}
+}
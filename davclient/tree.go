@@ -0,0 +1,105 @@
+package davclient
+
+import (
+	"context"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrFiniteDepth = errors.New("server does not allow Depth: infinity")
+
+// Can we still try a PROPFIND with Depth: infinity? Not if it was
+// turned off, or if the server said it does not allow it.
+func (d *Client) DepthInfinity() bool {
+	return !d.NoDepthInfinity && atomic.LoadInt32(&d.finiteDepth) == 0
+}
+
+// PROPFIND with Depth: infinity. The response is parsed while it
+// comes in, and fn is called for every entry, with Name set to the
+// path relative to "path".
+func (d *Client) PropFindTree(ctx context.Context, path string, fn func(*Props)) (err error) {
+	if !d.DepthInfinity() {
+		return ErrFiniteDepth
+	}
+
+	d.semAcquire()
+	defer d.semRelease()
+
+	count := 0
+	if trace(T_WEBDAV) {
+		tPrintf("PropfindTree(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("PropfindTree: %v", err)
+				return
+			}
+			tPrintf("PropfindTree: %d entries", count)
+		}()
+	}
+
+	path = addSlash(path)
+	req, err := d.buildRequest(ctx, "PROPFIND", path, d.propFindBody(nil))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Depth", "infinity")
+	resp, err := d.do(req)
+	if err != nil {
+		// RFC 4918 9.1: 403 with a propfind-finite-depth precondition.
+		if daverr, ok := err.(*DavError); ok && daverr.Code == 403 && resp != nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			if bytes.Contains(body, []byte("propfind-finite-depth")) {
+				atomic.StoreInt32(&d.finiteDepth, 1)
+				err = ErrFiniteDepth
+			}
+		}
+		drainBody(resp)
+		return
+	}
+	defer drainBody(resp)
+
+	prefix := d.base + path
+	_, err = decodeMultiStatus(resp.Body, func(respTag *Response) {
+		props := respTag.cookedProps()
+		if props == nil {
+			return
+		}
+		u, _ := url.ParseRequestURI(respTag.Href)
+		if u == nil || !strings.HasPrefix(u.Path, prefix) {
+			return
+		}
+		props.Name = u.Path[len(prefix):]
+		count++
+		fn(props)
+	})
+	return
+}
+
+// The Dnode for a PROPFIND result.
+func (p *Props) Dnode() Dnode {
+	name := stripLastSlash(p.Name)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	n := Dnode{
+		Name: name,
+		IsDir: p.ResourceType == "collection",
+		IsLink: p.ResourceType == "redirectref",
+		Target: p.RefTarget,
+		Mtime: parseTime(p.LastModified),
+		Ctime: parseTime(p.CreationDate),
+	}
+	if n.IsLink {
+		n.Size = uint64(len(n.Target))
+	} else {
+		n.Size, _ = strconv.ParseUint(p.ContentLength, 10, 64)
+	}
+	return n
+}
@@ -0,0 +1,216 @@
+package davclient
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+// See if the server speaks TUS, https://tus.io/protocols/resumable-upload.
+// We need the creation and creation-defer-length extensions, because
+// we do not know the length of a file when we start uploading it.
+func (d *Client) detectTus(h http.Header) {
+	versions := mapLine(getHeader(h, "Tus-Version"))
+	if !versions[tusVersion] {
+		return
+	}
+	d.tusExtensions = mapLine(getHeader(h, "Tus-Extension"))
+	if !d.tusExtensions["creation"] || !d.tusExtensions["creation-defer-length"] {
+		if trace(T_WEBDAV) {
+			tPrintf("Connect: TUS without creation-defer-length, not using it")
+		}
+		return
+	}
+	d.tusMaxSize, _ = strconv.ParseInt(h.Get("Tus-Max-Size"), 10, 64)
+	d.IsTus = true
+	if trace(T_WEBDAV) {
+		tPrintf("Connect: TUS detected, extensions %s", getHeader(h, "Tus-Extension"))
+	}
+}
+
+type tusUpload struct {
+	d		*Client
+	path		string
+	location	string
+	buf		[]byte
+	chunkSize	int
+	offset		int64
+	total		int64
+}
+
+func (d *Client) newTusUpload(path string) *tusUpload {
+	cs := d.ChunkSize
+	if cs <= 0 {
+		cs = defaultChunkSize
+	}
+	return &tusUpload{
+		d: d,
+		path: path,
+		chunkSize: cs,
+	}
+}
+
+func (t *tusUpload) request(ctx context.Context, method string, rawurl string, data []byte) (resp *http.Response, err error) {
+	d := t.d
+	d.semAcquire()
+	defer d.semRelease()
+
+	req, err := d.buildRequestUrl(ctx, method, rawurl, data)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if method == "POST" {
+		name := base64.StdEncoding.EncodeToString([]byte(baseName(t.path)))
+		req.Header.Set("Upload-Metadata", "filename " + name)
+		req.Header.Set("Upload-Defer-Length", "1")
+	}
+	resp, err = d.do(req)
+	drainBody(resp)
+	return
+}
+
+// Create the upload resource in the parent collection.
+func (t *tusUpload) create(ctx context.Context) (err error) {
+	d := t.d
+	resp, err := t.request(ctx, "POST", d.fullUrl(addSlash(dirName(t.path))), nil)
+	if err != nil {
+		return
+	}
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err == nil && (resp.Header.Get("Location") == "" || !sameOrigin(loc, resp.Request.URL)) {
+		err = t.d.davToErrno(&DavError{
+			Message: "502 TUS: invalid upload location " + loc.String(),
+			Code: 502,
+		})
+	}
+	if err != nil {
+		return
+	}
+	t.location = loc.String()
+	if trace(T_WEBDAV) {
+		tPrintf("tusUpload(%s): created %s", t.path, t.location)
+	}
+	return
+}
+
+// Send the buffer. If that fails, ask the server how much it
+// got and continue from there.
+func (t *tusUpload) patch(ctx context.Context, final bool) (err error) {
+	tries := t.d.tunables().Retries
+	if tries < 3 {
+		tries = 3
+	}
+	start := t.offset
+	for try := 0; ; try++ {
+		data := t.buf[t.offset - start:]
+		var req *http.Request
+		req, err = t.d.buildRequestUrl(ctx, "PATCH", t.location, data)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(t.offset, 10))
+		if final {
+			req.Header.Set("Upload-Length", strconv.FormatInt(t.total, 10))
+		}
+		t.d.semAcquire()
+		var resp *http.Response
+		resp, err = t.d.do(req)
+		t.d.semRelease()
+		drainBody(resp)
+		if err == nil {
+			t.offset = start + int64(len(t.buf))
+			t.buf = t.buf[:0]
+			return
+		}
+		if try >= tries {
+			return
+		}
+		time.Sleep(time.Duration(1 << uint(try)) * time.Second)
+
+		// resume from whatever the server has acknowledged.
+		off, err2 := t.head(ctx)
+		if err2 != nil {
+			continue
+		}
+		if off < start || off > start + int64(len(t.buf)) {
+			return
+		}
+		if trace(T_WEBDAV) {
+			tPrintf("tusUpload(%s): resuming at offset %d", t.path, off)
+		}
+		t.offset = off
+	}
+}
+
+func (t *tusUpload) head(ctx context.Context) (offset int64, err error) {
+	resp, err := t.request(ctx, "HEAD", t.location, nil)
+	if err != nil {
+		return
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (t *tusUpload) Write(ctx context.Context, data []byte) (err error) {
+	t.buf = append(t.buf, data...)
+	t.total += int64(len(data))
+	if t.d.tusMaxSize > 0 && t.total > t.d.tusMaxSize {
+		return t.d.davToErrno(&DavError{
+			Message: "413 file too large for TUS upload",
+			Code: 413,
+		})
+	}
+	if len(t.buf) >= t.chunkSize {
+		if t.location == "" {
+			err = t.create(ctx)
+		}
+		if err == nil {
+			err = t.patch(ctx, false)
+		}
+	}
+	return
+}
+
+func (t *tusUpload) Close(ctx context.Context) (err error) {
+	if trace(T_WEBDAV) {
+		tPrintf("tusUpload(%s): finish, %d bytes", t.path, t.total)
+		defer func() {
+			if err != nil {
+				tPrintf("tusUpload(%s): %v", t.path, err)
+			}
+		}()
+	}
+	if t.location == "" {
+		// small file, a single PUT will do.
+		_, err = t.d.Put(ctx, t.path, t.buf, true, false)
+		return
+	}
+	err = t.patch(ctx, true)
+	if err != nil {
+		t.Abort()
+	}
+	return
+}
+
+func (t *tusUpload) Abort() {
+	if t.location != "" && t.d.tusExtensions["termination"] {
+		t.request(context.Background(), "DELETE", t.location, nil)
+	}
+	t.location = ""
+	t.buf = nil
+}
+
+func baseName(path string) string {
+	path = stripLastSlash(path)
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
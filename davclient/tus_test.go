@@ -0,0 +1,90 @@
+package davclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTusUploadResume(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var data []byte
+	failed := false
+	length := int64(-1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			t.Errorf("%s without Tus-Resumable", r.Method)
+		}
+		switch r.Method {
+		case "POST":
+			if r.URL.Path != "/dav/dir/" || r.Header.Get("Upload-Metadata") != "filename ZmlsZS5iaW4=" {
+				t.Errorf("POST %s metadata %q", r.URL.Path, r.Header.Get("Upload-Metadata"))
+			}
+			w.Header().Set("Location", "/uploads/42")
+			w.WriteHeader(201)
+		case "HEAD":
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+		case "PATCH":
+			off, _ := strconv.Atoi(r.Header.Get("Upload-Offset"))
+			if off != len(data) {
+				w.WriteHeader(409)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if !failed {
+				// take half of it, then fail.
+				failed = true
+				data = append(data, body[:len(body)/2]...)
+				w.WriteHeader(500)
+				return
+			}
+			data = append(data, body...)
+			if l := r.Header.Get("Upload-Length"); l != "" {
+				length, _ = strconv.ParseInt(l, 10, 64)
+			}
+			w.WriteHeader(204)
+		default:
+			t.Errorf("unexpected %s", r.Method)
+		}
+	}))
+	defer srv.Close()
+
+	d := &Client{
+		Url: srv.URL + "/dav",
+		base: "/dav",
+		cc: srv.Client(),
+		Retries: 0,
+	}
+	h := http.Header{}
+	h.Set("Tus-Version", "1.0.0")
+	h.Set("Tus-Extension", "creation,creation-defer-length,termination")
+	d.detectTus(h)
+	if !d.IsTus || !d.CanUpload() {
+		t.Fatal("TUS not detected")
+	}
+
+	up := d.newTusUpload("/dir/file.bin")
+	up.chunkSize = 8
+	want := "0123456789abcdefghij"
+	for i := 0; i < len(want); i += 5 {
+		if err := up.Write(ctx, []byte(want[i:i+5])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := up.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("server has %q, want %q", data, want)
+	}
+	if length != int64(len(want)) {
+		t.Errorf("Upload-Length %d, want %d", length, len(want))
+	}
+}
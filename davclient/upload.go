@@ -0,0 +1,36 @@
+package davclient
+
+import (
+	"context"
+)
+
+// An upload of a whole file, written sequentially from start to end.
+// Some servers have better ways to do that than partial PUTs.
+type Uploader interface {
+	// Write the next part of the file.
+	Write(ctx context.Context, data []byte) error
+	// Finish the upload and put the file in place.
+	Close(ctx context.Context) error
+	// Throw away whatever was uploaded.
+	Abort()
+}
+
+// Is there a sequential upload method available?
+func (d *Client) CanUpload() bool {
+	if d.PutDisabled {
+		return false
+	}
+	return (d.IsTus && !d.NoTus) || (d.IsNextcloud && !d.NoChunking)
+}
+
+// Start a sequential upload to path. Returns nil if there is
+// no special upload method for this server.
+func (d *Client) NewUpload(path string) Uploader {
+	if !d.CanUpload() {
+		return nil
+	}
+	if d.IsTus && !d.NoTus {
+		return d.newTusUpload(path)
+	}
+	return d.newChunkedUpload(path)
+}
@@ -0,0 +1,1557 @@
+// Package davclient is a WebDAV client. Besides the usual methods it
+// can update part of a file on servers that support it (Apache
+// mod_dav, SabreDAV), and do chunked uploads (Nextcloud, tus).
+//
+// All methods take a context; errors from the server are returned
+// as a *DavError, which has the HTTP status and the errno it maps to.
+package davclient
+
+import (
+	"context"
+	"fmt"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type davEmpty struct {}
+type davSem chan davEmpty
+
+// A client for one WebDAV share. Set Url and the options, then call
+// Connect. The exported fields that Connect sets describe the server.
+// Paths passed to the methods are relative to Url and start with "/".
+type Client struct {
+	Url		string
+	Username	string
+	Password	string
+	Cookie		string
+	// Set by Connect.
+	Methods		map[string]bool
+	DavSupport	map[string]bool
+	Dasl		map[string]bool
+	IsSabre		bool
+	IsApache	bool
+	IsNextcloud	bool
+	IsTus		bool
+	// Options.
+	NoChunking	bool
+	NoTus		bool
+	ProbePutRange	bool
+	NoDepthInfinity	bool
+	ChunkSize	int
+	PutDisabled	bool
+	MaxConns	int
+	MaxIdleConns	int
+	Retries		int
+	Reauth		func() bool
+	TrustRedirects	bool
+	Hard		bool
+	DownErrno	syscall.Errno
+	// Overrides the default mapping of HTTP status to errno.
+	ErrnoMap	map[int]syscall.Errno
+	ProbeInterval	time.Duration
+	// These, Retries and MaxIdleConns are the starting values. To
+	// change them on a client that is in use, call Reload.
+	Timeout		time.Duration
+	CACert		string
+	ClientCert	string
+	ClientKey	string
+	// If set, requests are sent with this instead of a transport
+	// built from the TLS and connection options. It is not replaced
+	// by Reload.
+	Transport	http.RoundTripper
+	// Share the connection pool with other clients of the same server.
+	ShareTransport	bool
+	// Called for every request with the transport it is sent on,
+	// so that the application can record or inspect it.
+	RoundTrip	func(rt http.RoundTripper, req *http.Request) (*http.Response, error)
+	Hooks		Hooks
+	base		string
+	cc		*http.Client
+	transport	*davTransport
+	davSem		davSem
+	stats		*clientStats
+	initOnce	sync.Once
+	initErr		error
+	slashCache	map[string]bool
+	slashMutex	sync.Mutex
+	health		connHealth
+	auth		*davAuth
+	ncRoot		string
+	ncUser		string
+	tusExtensions	map[string]bool
+	tusMaxSize	int64
+	finiteDepth	int32
+	live		atomic.Value
+	reloadMutex	sync.Mutex
+}
+
+// The error for a failed request. Code is the HTTP status, or 503
+// if the server could not be reached. Errnum is the matching errno,
+// see StatusErrno. Failed lists the paths that a DELETE, MOVE or COPY
+// of a collection could not handle.
+type DavError struct {
+	Code		int
+	Message		string
+	Location	string
+	Errnum		syscall.Errno
+	Failed		[]string
+}
+
+type Dnode struct {
+	Name		string
+	Target		string
+	IsDir		bool
+	IsLink		bool
+	Mtime		time.Time
+	Ctime		time.Time
+	Size		uint64
+}
+
+type Props struct {
+	Name		string		`xml:"-"`
+	ResourceType_	ResourceType	`xml:"resourcetype"`
+	RefTarget_	RefTarget	`xml:"reftarget"`
+	IsCollection	string		`xml:"iscollection"`
+	ResourceType	string		`xml:"-"`
+	RefTarget	string		`xml:"-"`
+	CreationDate	string		`xml:"creationdate"`
+	LastModified	string		`xml:"getlastmodified"`
+	Etag		string		`xml:"getetag"`
+	ContentLength	string		`xml:"getcontentlength"`
+	SpaceUsed	string		`xml:"quota-used-bytes"`
+	SpaceFree	string		`xml:"quota-available-bytes"`
+	FileId		string		`xml:"fileid"`
+	TrashLocation	string		`xml:"trashbin-original-location"`
+	Checksums	string		`xml:"checksums>checksum"`
+}
+
+type ResourceType struct {
+	Collection	*struct{}	`xml:"collection"`
+	RedirectRef	*struct{}	`xml:"redirectref"`
+}
+
+type RefTarget struct {
+	Href		*string		`xml:"href"`
+}
+
+type Propstat struct {
+	Props		*Props		`xml:"prop"`
+	Status		string		`xml:"status"`
+}
+
+type Response struct {
+	Href		string		`xml:"href"`
+	Status		string		`xml:"status"`
+	Propstats	[]Propstat	`xml:"propstat"`
+}
+
+type MultiStatus struct {
+	Responses	[]Response	`xml:"response"`
+}
+
+var mostProps = "<D:resourcetype/><D:creationdate/><D:getlastmodified/><D:getetag/><D:getcontentlength/>"
+
+var davTimeFormat = "2006-01-02T15:04:05Z"
+
+var davToErrnoMap = map[int]syscall.Errno{
+	400:	syscall.EINVAL,
+	401:	syscall.EACCES,
+	403:	syscall.EACCES,
+	404:	syscall.ENOENT,
+	405:	syscall.EACCES,
+	408:	syscall.ETIMEDOUT,
+	409:	syscall.ENOENT,
+	410:	syscall.ENOENT,
+	411:	syscall.EINVAL,
+	412:	syscall.ESTALE,
+	413:	syscall.EFBIG,
+	414:	syscall.ENAMETOOLONG,
+	415:	syscall.EINVAL,
+	416:	syscall.ERANGE,
+	422:	syscall.EINVAL,
+	423:	syscall.EAGAIN,
+	424:	syscall.EIO,
+	429:	syscall.EAGAIN,
+	500:	syscall.EIO,
+	501:	syscall.ENOTSUP,
+	502:	syscall.EIO,
+	503:	syscall.EIO,
+	504:	syscall.ETIMEDOUT,
+	507:	syscall.ENOSPC,
+	508:	syscall.ELOOP,
+}
+
+// Status codes that are worth retrying after a short wait.
+var davRetryStatus = map[int]bool{
+	429:	true,
+	502:	true,
+	503:	true,
+}
+
+const maxRetryWait = 30 * time.Second
+
+const (
+	maxRedirects	= 10
+	maxSlashCache	= 10000
+)
+
+var UserAgent string
+
+func init() {
+	UserAgent = fmt.Sprintf("fuse-webdavfs/0.1 (Go) %s (%s)", runtime.GOOS, runtime.GOARCH)
+}
+
+// The errno a HTTP status code maps to by default. EIO if it is
+// not known.
+func StatusErrno(code int) syscall.Errno {
+	if e, ok := davToErrnoMap[code]; ok {
+		return e
+	}
+	return syscall.EIO
+}
+
+// The errno a HTTP status code maps to for this client: ErrnoMap,
+// then the default.
+func (d *Client) StatusErrno(code int) syscall.Errno {
+	if e, ok := d.ErrnoMap[code]; ok {
+		return e
+	}
+	return StatusErrno(code)
+}
+
+func (d *Client) davToErrno(err *DavError) (*DavError) {
+	err.Errnum = d.StatusErrno(err.Code)
+	if trace(T_WEBDAV) {
+		tPrintf("status %q mapped to %v", err.Message, err.Errnum)
+	}
+	return err
+}
+
+func statusIsValid(resp *http.Response) bool {
+	return resp.StatusCode / 100 == 2
+}
+
+func statusIsRedirect(resp *http.Response) bool {
+	return resp.StatusCode / 100 == 3
+}
+
+func stripQuotes(s string) string {
+	l := len(s)
+	if l > 1 && s[0] == '"' && s [l-1] == '"' {
+		return s[1:l-1]
+	}
+	return s
+}
+
+func stripLastSlash(s string) string {
+	l := len(s)
+	for l > 0 {
+		if s[l-1] != '/' {
+			return s[:l]
+		}
+		l--
+	}
+	return s
+}
+
+func addSlash(s string) string {
+	if len(s) > 0 && s[len(s)-1] != '/' {
+		s += "/"
+	}
+	return s
+}
+
+func dirName(s string) string {
+	s = stripLastSlash(s)
+	i := strings.LastIndex(s, "/")
+	if i > 0 {
+		return s[:i]
+	}
+	return "/"
+}
+
+func parseTime (s string) (t time.Time) {
+	s = strings.TrimSpace(s)
+	var err error
+	if len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		// RFC3339 with or without fractional seconds / offset.
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t, _ = time.Parse(davTimeFormat, s)
+		}
+	} else {
+		t, err = http.ParseTime(s)
+		if err != nil {
+			t, _ = time.Parse(time.RFC1123Z, s)
+		}
+	}
+	return
+}
+
+// parse the status code out of "HTTP/1.1 200 OK".
+func parseStatus(s string) int {
+	f := strings.Fields(s)
+	if len(f) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(f[1])
+	return code
+}
+
+func joinPath(s1, s2 string) string {
+	if (len(s1) > 0 && s1[len(s1)-1] == '/') ||
+	   (len(s2) > 0 && s2[0] == '/') {
+		return s1 + s2
+	}
+	return s1 + "/" + s2
+}
+
+func stripHrefPrefix(href string, prefix string) (string, bool) {
+	u, _ := url.ParseRequestURI(href)
+	if u == nil {
+		return "", false
+	}
+	name := u.Path
+	if strings.HasPrefix(name, prefix) {
+		name = name[len(prefix):]
+		// not all servers redirect "dir" to "dir/".
+		if !strings.HasSuffix(prefix, "/") {
+			name = strings.TrimPrefix(name, "/")
+		}
+	}
+	i := strings.Index(name, "/")
+	if i >= 0 && i < len(name) - 1 {
+		return "", false
+	}
+	return name, true
+}
+
+func mapLine(s string) (m map[string]bool) {
+	m = make(map[string]bool)
+	elems := strings.Split(s, ",")
+	for _, e := range elems {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			m[e] = true
+		}
+	}
+	return
+}
+
+func getHeader(h http.Header, key string) string {
+	key = http.CanonicalHeaderKey(key)
+	return strings.Join(h[key], ",")
+}
+
+func drainBody(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	b := make([]byte, 256)
+	var err error
+	for err != io.EOF {
+		_, err = resp.Body.Read(b)
+	}
+	resp.Body.Close()
+	resp.Body = nil
+}
+
+func (d *DavError) Error() string {
+	return d.Message
+}
+
+func (d *Client) semAcquire() {
+	d.init()
+	if d.MaxConns > 0 {
+		atomic.AddInt64(&d.stats.waiting, 1)
+		d.davSem <- davEmpty{}
+		atomic.AddInt64(&d.stats.waiting, -1)
+	}
+}
+
+func (d *Client) semRelease() {
+	if d.MaxConns > 0 {
+		<-d.davSem
+	}
+	return
+}
+
+func (d *Client) buildRequest(ctx context.Context, method string, path string, b ...interface{}) (req *http.Request, err error) {
+	if len(path) == 0 || path[0] != '/' {
+		err = errors.New("path does not start with /")
+		return
+	}
+	return d.buildRequestUrl(ctx, method, d.fullUrl(path), b...)
+}
+
+// Full URL of a path on the share.
+func (d *Client) fullUrl(path string) string {
+	u := url.URL{ Path: path }
+	return d.Url + u.EscapedPath()
+}
+
+// Full URL of a path on the server, outside of the share.
+func (d *Client) serverUrl(path string) string {
+	u, _ := url.Parse(d.Url)
+	u.Path = path
+	u.RawPath = ""
+	return u.String()
+}
+
+func (d *Client) buildRequestUrl(ctx context.Context, method string, rawurl string, b ...interface{}) (req *http.Request, err error) {
+	var body io.Reader
+	blen := 0
+	if len(b) > 0 && b[0] != nil {
+		switch v := b[0].(type) {
+		case string:
+			body = strings.NewReader(v)
+			blen = len(v)
+		case []byte:
+			body = bytes.NewReader(v)
+			blen = len(v)
+		default:
+			body = v.(io.Reader)
+			blen = -1
+		}
+	}
+	err = d.init()
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if (blen >= 0) {
+		if blen == 0 {
+			// Need this to FORCE the http client to send a
+			// Content-Length header for size 0.
+			req.TransferEncoding = []string{"identity"}
+		}
+		req.ContentLength = int64(blen)
+	}
+	d.setAuth(req)
+	return
+}
+
+func (d *Client) setAuth(req *http.Request) {
+	username, password, cookie := d.Credentials()
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+}
+
+func (d *Client) request(ctx context.Context, method string, path string, b ...interface{}) (*http.Response, error) {
+	req, err := d.buildRequest(ctx, method, path, b...)
+	if err != nil {
+		return nil, err
+	}
+	return d.do(req)
+}
+
+func (d *Client) do(req *http.Request) (resp *http.Response, err error) {
+	req.Header.Set("User-Agent", UserAgent)
+
+	if trace(T_HTTP_REQUEST) {
+		tPrintf("%s %s HTTP/1.1", req.Method, req.URL.String())
+		if trace(T_HTTP_HEADERS) {
+			tPrintf("%s", tHeaders(req.Header, " "))
+		}
+		defer func() {
+			if err != nil {
+				tPrintf("%s request error: %v", req.Method, err)
+			} else {
+				tPrintf("%s %s", resp.Proto, resp.Status)
+				if trace(T_HTTP_HEADERS) {
+					tPrintf("%s", tHeaders(resp.Header, " "))
+				}
+			}
+		}()
+	}
+
+	// Failed requests are always logged, but not when we do not
+	// even try because the server is down.
+	began := time.Now()
+	tried := false
+	defer func() {
+		if tried && d.Hooks.Request != nil {
+			d.Hooks.Request(req, resp, err, time.Since(began))
+		}
+	}()
+
+	reauthed := false
+	for try := 0; ; try++ {
+		err = d.waitHealthy(req.Context())
+		if err != nil {
+			return
+		}
+		tried = true
+		start := time.Now()
+		atomic.AddInt64(&d.stats.inFlight, 1)
+		resp, err = d.cc.Do(req)
+		atomic.AddInt64(&d.stats.inFlight, -1)
+		if d.Hooks.Try != nil {
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
+			}
+			d.Hooks.Try(req.Method, status, time.Since(start))
+		}
+		if err == nil && statusIsValid(resp) {
+			if req.Method == "PUT" || req.Method == "PATCH" {
+				d.hookBytes(true, int(req.ContentLength))
+			}
+			break
+		}
+		retry := false
+		if err != nil {
+			if isConnError(err) {
+				d.markDown(err.Error())
+				retry = d.Hard
+			}
+		} else if resp.StatusCode == 401 && !reauthed && d.Reauth != nil {
+			// credentials might have changed, reload once.
+			reauthed = true
+			retry = d.Reauth()
+			if retry {
+				d.setAuth(req)
+			}
+		} else if davRetryStatus[resp.StatusCode] && try < d.tunables().Retries {
+			retry = true
+			wait := retryAfter(resp, try)
+			if trace(T_HTTP_REQUEST) {
+				tPrintf("%s %s: %s, retry in %v", req.Method,
+					req.URL.String(), resp.Status, wait)
+			}
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				retry = false
+			}
+		} else if resp.StatusCode == 502 || resp.StatusCode == 503 {
+			// a proxy in front of a server that is down.
+			d.markDown(resp.Status)
+			retry = d.Hard
+		}
+		if !retry || !rewindBody(req) {
+			break
+		}
+		drainBody(resp)
+	}
+	if isConnError(err) {
+		err = d.downError(err.Error())
+		return
+	}
+	if err != nil {
+		err = requestError(err)
+		return
+	}
+	if err == nil && !statusIsValid(resp) {
+		err = d.davToErrno(&DavError{
+			Message: resp.Status,
+			Code: resp.StatusCode,
+			Location: resp.Header.Get("Location"),
+		})
+	}
+	return
+}
+
+// Exponential backoff, unless the server tells us how long to wait.
+func retryAfter(resp *http.Response, try int) time.Duration {
+	wait := time.Duration(1 << uint(try)) * time.Second
+	ra := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(ra); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(ra); err == nil {
+		wait = time.Until(t)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// Make it possible to send a request once more.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// Set up the http client on first use. Sub clients and tests come
+// with their own.
+func (d *Client) init() error {
+	d.initOnce.Do(func() {
+		d.initErr = d.setup()
+	})
+	return d.initErr
+}
+
+func (d *Client) setup() (err error) {
+	if d.stats == nil {
+		d.stats = &clientStats{}
+	}
+	if d.MaxConns > 0 && d.davSem == nil {
+		d.davSem = make(davSem, d.MaxConns)
+	}
+	if d.cc != nil {
+		return
+	}
+	d.Url = stripLastSlash(d.Url)
+	u, err := url.ParseRequestURI(d.Url)
+	if err != nil {
+		return
+	}
+	d.base = u.Path
+
+	if d.auth == nil {
+		d.auth = &davAuth{
+			username: d.Username,
+			password: d.Password,
+			cookie: d.Cookie,
+		}
+	}
+	d.transport = &davTransport{ hook: d.RoundTrip }
+	if d.Transport != nil {
+		d.transport.set(d.Transport, d.Timeout)
+	} else {
+		err = d.reloadTransport(d.tunables())
+		if err != nil {
+			return
+		}
+	}
+	d.cc = &http.Client{
+		Transport: d.transport,
+		CheckRedirect: checkRedirect,
+	}
+	return
+}
+
+// Connect to the server, find out what it supports, and check that
+// Url is a collection.
+func (d *Client) Connect(ctx context.Context) (err error) {
+	err = d.init()
+	if err != nil {
+		return
+	}
+
+	// The share itself might have moved, or redirect to https or
+	// to a specific node behind a loadbalancer. If so, re-base.
+	var resp *http.Response
+	for redirects := 0; ; redirects++ {
+		var req *http.Request
+		req, err = d.buildRequest(ctx, "OPTIONS", "/")
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "*/*")
+		resp, err = d.do(req)
+		daverr, ok := err.(*DavError)
+		if !ok || daverr.Code / 100 != 3 || daverr.Location == "" {
+			break
+		}
+		drainBody(resp)
+		if redirects >= maxRedirects {
+			err = errors.New(d.Url + ": too many redirects")
+			return
+		}
+		err = d.rebase(req.URL, daverr.Location)
+		if err != nil {
+			return
+		}
+	}
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	if !statusIsValid(resp) {
+		err = errors.New(resp.Status)
+		return
+	}
+
+	// Parse headers.
+	d.Methods = mapLine(getHeader(resp.Header, "Allow"))
+	d.DavSupport = mapLine(getHeader(resp.Header, "Dav"))
+	d.Dasl = mapLine(getHeader(resp.Header, "Dasl"))
+
+	// Is this apache with mod_dav?
+	isApache := strings.Index(resp.Header.Get("Server"), "Apache") >= 0
+	if isApache && d.DavSupport["<http://apache.org/dav/propset/fs/1>"] {
+		d.IsApache = true
+	}
+
+	// Does this server supoort sabredav-partialupdate ?
+	if d.DavSupport["sabredav-partialupdate"] {
+		d.IsSabre = true
+	}
+
+	// Nextcloud or ownCloud?
+	d.detectNextcloud()
+
+	// Resumable uploads?
+	d.detectTus(resp.Header)
+
+	if !d.DavSupport["1"] {
+		err = errors.New("not a webdav server")
+	}
+
+	// Try partial PUT if we do not know how to do partial updates.
+	if err == nil && d.ProbePutRange && !d.IsApache && !d.IsSabre {
+		d.probePutRange(ctx)
+	}
+
+	// check if it exists and is a directory.
+	if err == nil {
+		var dnode Dnode
+		dnode, err = d.Stat(ctx, "/")
+		if err == nil && !dnode.IsDir {
+			err = errors.New(d.Url + " is not a directory")
+		}
+	}
+
+	return
+}
+
+// Follow a redirect of the mount URL itself.
+func (d *Client) rebase(reqUrl *url.URL, location string) (err error) {
+	loc, err := reqUrl.Parse(location)
+	if err != nil {
+		return
+	}
+	if reqUrl.Scheme == "https" && loc.Scheme != "https" {
+		return fmt.Errorf("%s: refusing redirect to insecure %s", d.Url, loc)
+	}
+	// Credentials may follow a redirect to the same host, or an
+	// upgrade from http to https. Other hosts must be trusted.
+	sameHost := loc.Host == reqUrl.Host ||
+		(loc.Hostname() == reqUrl.Hostname() && loc.Scheme == "https" &&
+		 reqUrl.Port() == "" && loc.Port() == "")
+	if !sameHost && !d.TrustRedirects {
+		return fmt.Errorf("%s: redirected to %s on another host (see the trust_redirects option)", d.Url, loc)
+	}
+	loc.RawQuery = ""
+	loc.Fragment = ""
+	newUrl := stripLastSlash(loc.String())
+	if trace(T_WEBDAV) {
+		tPrintf("Connect: %s redirected to %s", d.Url, newUrl)
+	}
+	d.Url = newUrl
+	d.base = stripLastSlash(loc.Path)
+	return
+}
+
+func sameOrigin(u1, u2 *url.URL) bool {
+	return u1.Scheme == u2.Scheme && u1.Host == u2.Host
+}
+
+// Redirects are only followed automatically if they stay on the same
+// origin, and the method does not change (the Go client turns a
+// PROPFIND into a GET on a 301 or 302). In all other cases the
+// redirect response is returned to the caller.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("400 Too many redirects")
+	}
+	orig := via[0]
+	if req.Method != orig.Method || !sameOrigin(req.URL, orig.URL) {
+		return http.ErrUseLastResponse
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return nil
+	}
+	return http.ErrUseLastResponse
+}
+
+// The request body for a PROPFIND. No props means the usual ones.
+func (d *Client) propFindBody(props []string) string {
+	a := append([]string{}, `<?xml version="1.0" encoding="utf-8" ?><D:propfind xmlns:D='DAV:' xmlns:oc='http://owncloud.org/ns' xmlns:nc='http://nextcloud.org/ns'>`)
+	if len(props) == 0 {
+		a = append(a, "<D:prop>")
+		a = append(a, mostProps)
+		if d.DavSupport["redirectrefs"] {
+			a = append(a, "<D:reftarget/>")
+		}
+		a = append(a, "</D:prop>")
+	} else if len(props) == 1 && props[0] == "allprop" {
+		a = append(a, "<D:allprop/>")
+	} else {
+		a = append(a, "<D:prop>")
+		for _, s := range props {
+			if strings.Contains(s, ":") {
+				// oc:fileid, nc:trashbin-filename, etc.
+				a = append(a, "<" + s + "/>")
+			} else {
+				a = append(a, "<D:" + s + "/>")
+			}
+		}
+		a = append(a, "</D:prop>")
+	}
+	a = append(a, `</D:propfind>`)
+	return strings.Join(a, "")
+}
+
+func (d *Client) PropFind(ctx context.Context, path string, depth int, props []string) (ret []*Props, err error) {
+
+	if trace(T_WEBDAV) {
+		tPrintf("Propfind(%s, %d, %v)", path, depth, props)
+		defer func() {
+			if err != nil {
+				tPrintf("Propfind: %v", err)
+				return
+			}
+			tPrintf("Propfind: returns %v", tJson(ret))
+		}()
+	}
+
+	err = d.propFindFunc(ctx, path, depth, props, func(p *Props) {
+		ret = append(ret, p)
+	})
+	return
+}
+
+// Like PropFind, but fn is called for every entry while the
+// response comes in, so that nothing big has to be kept in memory.
+func (d *Client) propFindFunc(ctx context.Context, path string, depth int, props []string, fn func(*Props)) (err error) {
+
+	d.semAcquire()
+	defer d.semRelease()
+
+	x := d.propFindBody(props)
+
+	req, err := d.buildRequest(ctx, "PROPFIND", path, x)
+	if err != nil {
+		return
+	}
+	dp := "0"
+	if depth > 0 {
+		dp = "1"
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Depth", dp)
+	if d.DavSupport["redirectrefs"] {
+		req.Header.Set("Apply-To-Redirect-Ref", "T")
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return
+	}
+	defer drainBody(resp)
+
+	if !statusIsValid(resp) {
+		err = errors.New(resp.Status)
+		return
+	}
+
+	prefix := d.base + path
+	if depth == 0 {
+		prefix = dirName(prefix)
+		if prefix != "/" {
+			prefix += "/"
+		}
+	}
+	n, err := decodeMultiStatus(resp.Body, func(respTag *Response) {
+		props := respTag.hrefProps(prefix)
+		if props == nil {
+			return
+		}
+		fn(props)
+	})
+	if err == nil && n == 0 {
+		err = errors.New("XML decode error")
+	}
+	return
+}
+
+// Decode a multistatus body while it comes in, one response at a
+// time. Returns the number of responses.
+func decodeMultiStatus(r io.Reader, fn func(*Response)) (n int, err error) {
+	dec := xml.NewDecoder(r)
+	for {
+		var tok xml.Token
+		tok, err = dec.Token()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "response" {
+			continue
+		}
+		var respTag Response
+		err = dec.DecodeElement(&respTag, &se)
+		if err != nil {
+			return
+		}
+		n++
+		fn(&respTag)
+	}
+}
+
+func parseMultiStatus(contents []byte) (obj *MultiStatus, err error) {
+	obj = &MultiStatus{}
+	err = xml.Unmarshal(contents, obj)
+	if err != nil {
+		return
+	}
+	if len(obj.Responses) == 0 {
+		err = errors.New("XML decode error")
+	}
+	return
+}
+
+// Merge the properties from all propstat blocks with a 2xx status.
+// Servers put missing properties in a separate 404 propstat, so we
+// cannot just take the first one.
+func (r *Response) props() (props *Props, reason string) {
+	if r.Status != "" {
+		code := parseStatus(r.Status)
+		if code / 100 != 2 {
+			return nil, "status " + r.Status
+		}
+	}
+	for _, ps := range r.Propstats {
+		if ps.Props == nil {
+			continue
+		}
+		// some servers leave out the status, assume 200.
+		if ps.Status != "" && parseStatus(ps.Status) / 100 != 2 {
+			continue
+		}
+		if props == nil {
+			props = ps.Props
+		} else {
+			props.merge(ps.Props)
+		}
+	}
+	if props == nil {
+		reason = "no valid propstat"
+	}
+	return
+}
+
+func (p *Props) merge(o *Props) {
+	if o.ResourceType_.Collection != nil {
+		p.ResourceType_.Collection = o.ResourceType_.Collection
+	}
+	if o.ResourceType_.RedirectRef != nil {
+		p.ResourceType_.RedirectRef = o.ResourceType_.RedirectRef
+	}
+	if o.RefTarget_.Href != nil {
+		p.RefTarget_.Href = o.RefTarget_.Href
+	}
+	mergeString(&p.IsCollection, o.IsCollection)
+	mergeString(&p.CreationDate, o.CreationDate)
+	mergeString(&p.LastModified, o.LastModified)
+	mergeString(&p.Etag, o.Etag)
+	mergeString(&p.ContentLength, o.ContentLength)
+	mergeString(&p.SpaceUsed, o.SpaceUsed)
+	mergeString(&p.SpaceFree, o.SpaceFree)
+	mergeString(&p.FileId, o.FileId)
+	mergeString(&p.TrashLocation, o.TrashLocation)
+	mergeString(&p.Checksums, o.Checksums)
+}
+
+func mergeString(dst *string, src string) {
+	if src != "" {
+		*dst = src
+	}
+}
+
+// The props of one response of a multistatus, with Name set to what
+// follows prefix in its href ("" for prefix itself), if the href is
+// prefix or directly below it. Otherwise, or if the response has no
+// usable propstat, nil; the caller skips it, so a broken entry does
+// not fail the whole listing.
+func (respTag *Response) hrefProps(prefix string) *Props {
+	props := respTag.cookedProps()
+	if props == nil {
+		return nil
+	}
+	name, ok := stripHrefPrefix(respTag.Href, prefix)
+	if !ok {
+		return nil
+	}
+	props.Name = name
+	return props
+}
+
+// The merged props of a response, with ResourceType and RefTarget
+// filled in. Hrefs of collections get a trailing '/'.
+func (respTag *Response) cookedProps() *Props {
+	props, reason := respTag.props()
+	if props == nil {
+		if trace(T_WEBDAV) {
+			tPrintf("Propfind: skipping %s: %s", respTag.Href, reason)
+		}
+		return nil
+	}
+	props.Etag = stripQuotes(props.Etag)
+
+	// make sure collection hrefs end in '/'
+	isColl := strings.TrimSpace(props.IsCollection)
+	if props.ResourceType_.Collection != nil ||
+	   isColl == "1" || isColl == "t" || isColl == "true" {
+		props.ResourceType = "collection"
+		respTag.Href = addSlash(respTag.Href)
+	}
+	// maybe a symlink.
+	if props.ResourceType_.RedirectRef != nil {
+		h := props.RefTarget_.Href
+		if h == nil {
+			if trace(T_WEBDAV) {
+				tPrintf("Propfind: skipping %s: redirectref without reftarget", respTag.Href)
+			}
+			return nil
+		}
+		props.ResourceType = "redirectref"
+		props.RefTarget = *h
+	}
+	return props
+}
+
+func (d *Client) PropFindWithRedirect(ctx context.Context, path string, depth int, props []string) (ret []*Props, err error) {
+	// if we saw a "this is a directory" redirect before, skip it.
+	if d.slashCacheGet(path) {
+		ret, err = d.PropFind(ctx, path + "/", depth, props)
+		if err == nil {
+			return
+		}
+		// might not be a directory anymore.
+		d.slashCacheDel(path)
+	}
+
+	ret, err = d.PropFind(ctx, path, depth, props)
+
+	// did we get a redirect?
+	if daverr, ok := err.(*DavError); ok {
+		if daverr.Code / 100 != 3 || daverr.Location == "" {
+			return
+		}
+		url, err2 := url.Parse(daverr.Location)
+		if err2 != nil {
+			return
+		}
+		// if it's just a "this is a directory" redirect, retry.
+		if url.Path == d.base + path + "/" {
+			ret, err = d.PropFind(ctx, path + "/", depth, props)
+			if err == nil {
+				d.slashCacheAdd(path)
+			}
+		}
+	}
+	return
+}
+
+func (d *Client) slashCacheGet(path string) bool {
+	d.slashMutex.Lock()
+	defer d.slashMutex.Unlock()
+	return d.slashCache[path]
+}
+
+func (d *Client) slashCacheAdd(path string) {
+	d.slashMutex.Lock()
+	defer d.slashMutex.Unlock()
+	if d.slashCache == nil || len(d.slashCache) >= maxSlashCache {
+		d.slashCache = map[string]bool{}
+	}
+	d.slashCache[path] = true
+}
+
+func (d *Client) slashCacheDel(path string) {
+	d.slashMutex.Lock()
+	defer d.slashMutex.Unlock()
+	delete(d.slashCache, path)
+}
+
+// Forget which paths were found to need a trailing slash.
+func (d *Client) DropCaches() {
+	d.slashMutex.Lock()
+	d.slashCache = nil
+	d.slashMutex.Unlock()
+}
+
+func (d *Client) Readdir(ctx context.Context, path string, detail bool) (ret []Dnode, err error) {
+
+	if trace(T_WEBDAV) {
+		tPrintf("Readdir(%s, %v", path, detail)
+		defer func() {
+			if err != nil {
+				tPrintf("Readdir: %v", err)
+				return
+			}
+			tPrintf("Readdir: returns %v", tJson(ret))
+		}()
+	}
+
+	err = d.ReaddirFunc(ctx, path, detail, func(n Dnode) {
+		ret = append(ret, n)
+	})
+	return
+}
+
+// Like Readdir, but calls fn for every entry as soon as it has
+// been received.
+func (d *Client) ReaddirFunc(ctx context.Context, path string, detail bool, fn func(Dnode)) (err error) {
+	path = addSlash(path)
+	return d.propFindFunc(ctx, path, 1, nil, func(p *Props) {
+		name := stripLastSlash(p.Name)
+		if name == "" || name == "/" {
+			name = "."
+		}
+		if strings.Index(name, "/") >= 0 {
+			return
+		}
+		if name == "._.DS_Store" || name == ".DS_Store" {
+			return
+		}
+		n := Dnode{
+			Name: name,
+			IsDir: p.ResourceType == "collection",
+			IsLink: p.ResourceType == "redirectref",
+			Target: p.RefTarget,
+		}
+		if detail {
+			n.Mtime = parseTime(p.LastModified)
+			n.Ctime = parseTime(p.CreationDate)
+			if n.IsLink {
+				n.Size = uint64(len(n.Target))
+			} else {
+				n.Size, _ = strconv.ParseUint(p.ContentLength, 10, 64)
+			}
+		}
+		fn(n)
+	})
+}
+
+func (d *Client) Stat(ctx context.Context, path string) (ret Dnode, err error) {
+
+	if trace(T_WEBDAV) {
+		tPrintf("Stat(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("Stat: %v", err)
+				return
+			}
+			tPrintf("Readdir: returns %v", tJson(ret))
+		}()
+	}
+
+	props, err := d.PropFindWithRedirect(ctx, path, 0, nil)
+	if err != nil {
+		return
+	}
+	if len(props) != 1 {
+		err = errors.New("500 PropFind error")
+		return
+	}
+	p := props[0]
+	size, _ := strconv.ParseUint(p.ContentLength, 10, 64)
+	ret = Dnode{
+		Name: stripLastSlash(p.Name),
+		IsDir: p.ResourceType == "collection",
+		Mtime: parseTime(p.LastModified),
+		Ctime: parseTime(p.CreationDate),
+		Size: size,
+	} 
+	return
+}
+
+func (d *Client) Get(ctx context.Context, path string) (data []byte, err error) {
+	if trace(T_WEBDAV) {
+		tPrintf("Get(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("Get: %v", err)
+				return
+			}
+			tPrintf("Get: returns %d bytes", len(data))
+		}()
+	}
+
+	return d.GetRange(ctx, path, -1, -1)
+}
+
+func (d *Client) GetRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) && length >= 0 {
+		tPrintf("GetRange(%s, %d, %d)", path, offset, length)
+		defer func() {
+			if err != nil {
+				tPrintf("GetRange: %v", err)
+				return
+			}
+			tPrintf("GetRange: returns %d bytes", len(data))
+		}()
+	}
+	req, err := d.buildRequest(ctx, "GET", path)
+	if err != nil {
+		return
+	}
+	partial := false
+	if (offset >= 0 && length >= 0 ) {
+		partial = true
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset + int64(length) - 1))
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if !statusIsValid(resp) {
+		err = errors.New(resp.Status)
+		return
+	}
+	if partial && resp.StatusCode != 206 {
+		err = d.davToErrno(&DavError{
+			Message: "416 Range Not Satisfiable",
+			Code: 416,
+		})
+		return
+	}
+	data, err = ioutil.ReadAll(resp.Body)
+	if length >= 0 && len(data) > length {
+		data = data[:length]
+	}
+	d.hookBytes(false, len(data))
+	return
+}
+
+func (d *Client) Mkcol(ctx context.Context, path string) (err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) {
+		tPrintf("Mkcol(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("Mkcol: %v", err)
+				return
+			}
+			tPrintf("Mkcol: OK")
+		}()
+	}
+	req, err := d.buildRequest(ctx, "MKCOL", path)
+	if err != nil {
+		return
+	}
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (d *Client) Delete(ctx context.Context, path string) (err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) {
+		tPrintf("Delete(%s)", path)
+		defer func() {
+			if err != nil {
+				tPrintf("Delete: %v", err)
+				return
+			}
+			tPrintf("Delete: OK")
+		}()
+	}
+	req, err := d.buildRequest(ctx, "DELETE", path)
+	if err != nil {
+		return
+	}
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 207 {
+		// multistatus response means there were errors.
+		err = d.multiStatusError("DELETE", resp)
+	}
+	return
+}
+
+func (d *Client) Move(ctx context.Context, oldPath, newPath string) (err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) {
+		tPrintf("Move(%s, %s)", oldPath, newPath)
+		defer func() {
+			if err != nil {
+				tPrintf("Move: %v", err)
+				return
+			}
+			tPrintf("Move: OK")
+		}()
+	}
+	req, err := d.buildRequest(ctx, "MOVE", oldPath)
+	if err != nil {
+		return
+	}
+	if oldPath[len(oldPath)-1] == '/' {
+		req.Header.Set("Overwrite", "F")
+	} else {
+		req.Header.Set("Overwrite", "T")
+	}
+	req.Header.Set("Destination", d.fullUrl(newPath))
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 207 {
+		// multistatus response means there were errors.
+		err = d.multiStatusError("MOVE", resp)
+	}
+	return
+}
+
+func (d *Client) Copy(ctx context.Context, oldPath, newPath string, overwrite bool) (err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if trace(T_WEBDAV) {
+		tPrintf("Copy(%s, %s, %v)", oldPath, newPath, overwrite)
+		defer func() {
+			if err != nil {
+				tPrintf("Copy: %v", err)
+				return
+			}
+			tPrintf("Copy: OK")
+		}()
+	}
+	req, err := d.buildRequest(ctx, "COPY", oldPath)
+	if err != nil {
+		return
+	}
+	if overwrite {
+		req.Header.Set("Overwrite", "T")
+	} else {
+		req.Header.Set("Overwrite", "F")
+	}
+	req.Header.Set("Depth", "infinity")
+	req.Header.Set("Destination", d.fullUrl(newPath))
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 207 {
+		// multistatus response means there were errors.
+		err = d.multiStatusError("COPY", resp)
+	}
+	return
+}
+
+// A 207 Multi-Status reply to DELETE, MOVE or COPY lists the
+// members of the collection that could not be processed. Build
+// an error out of it that has the first failing status code, and
+// the paths (relative to the mount) that failed.
+func (d *Client) multiStatusError(method string, resp *http.Response) error {
+	var obj *MultiStatus
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		obj, err = parseMultiStatus(contents)
+	}
+	if err != nil {
+		return d.davToErrno(&DavError{
+			Message: "500 unexpected error during " + method,
+			Code: 500,
+		})
+	}
+	daverr := &DavError{}
+	for _, r := range obj.Responses {
+		status := r.Status
+		if status == "" {
+			// not per the RFC, but some servers use a propstat.
+			for _, ps := range r.Propstats {
+				if parseStatus(ps.Status) / 100 != 2 {
+					status = ps.Status
+					break
+				}
+			}
+		}
+		code := parseStatus(status)
+		if code / 100 == 2 {
+			continue
+		}
+		path := r.Href
+		if u, _ := url.ParseRequestURI(r.Href); u != nil {
+			path = u.Path
+		}
+		if strings.HasPrefix(path, d.base + "/") {
+			path = path[len(d.base):]
+		}
+		if trace(T_WEBDAV) {
+			tPrintf("%s: %s failed: %s", method, path, status)
+		}
+		if daverr.Code == 0 {
+			daverr.Code = code
+		}
+		daverr.Failed = append(daverr.Failed, path)
+	}
+	if daverr.Code == 0 {
+		daverr.Code = 500
+	}
+	daverr.Message = fmt.Sprintf("%d %s failed for %d resource(s)",
+		daverr.Code, method, len(daverr.Failed))
+	return d.davToErrno(daverr)
+}
+
+// https://blog.sphere.chronosempire.org.uk/2012/11/21/webdav-and-the-http-patch-nightmare
+func (d *Client) apachePutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (created bool, err error) {
+	if trace(T_WEBDAV) {
+		tPrintf("apachePutRange(%s, %d, %d, %v, %v)", path, len(data), offset, create, excl)
+		defer func() {
+			if err != nil {
+				tPrintf("apachePutRange: %v", err)
+				return
+			}
+			tPrintf("apachePutRange: OK, created: %v", created)
+		}()
+	}
+	req, err := d.buildRequest(ctx, "PUT", path, data)
+
+	end := offset + int64(len(data)) - 1
+	if end < offset {
+		end = offset
+	}
+	if create {
+		if excl {
+			req.Header.Set("If-None-Match", "*")
+		}
+	} else {
+		req.Header.Set("If-Match", "*")
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, end))
+
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	created = resp.StatusCode == 201
+	return
+}
+
+// http://sabre.io/dav/http-patch/
+func (d *Client) sabrePutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (created bool, err error) {
+
+	if trace(T_WEBDAV) {
+		tPrintf("sabrePutRange(%s, %d, %d, %v, %v)", path, len(data), offset, create, excl)
+		defer func() {
+			if err != nil {
+				tPrintf("sabrePutRange: %v", err)
+				return
+			}
+			tPrintf("sabrePutRange: OK, created: %v", created)
+		}()
+	}
+
+	req, err := d.buildRequest(ctx, "PATCH", path, data)
+
+	if create {
+		if excl {
+			req.Header.Set("If-None-Match", "*")
+		}
+	} else {
+		req.Header.Set("If-Match", "*")
+	}
+	req.Header.Set("Content-Type", "application/x-sabredav-partialupdate")
+	req.Header.Set("X-Update-Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := d.do(req)
+	defer drainBody(resp)
+	if err != nil {
+		return
+	}
+	created = resp.StatusCode == 201
+	return
+}
+
+func (d *Client) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (created bool, err error) {
+	d.semAcquire()
+	defer d.semRelease()
+	if d.IsSabre {
+		return d.sabrePutRange(ctx, path, data, offset, create, excl)
+	}
+	if d.IsApache {
+		return d.apachePutRange(ctx, path, data, offset, create, excl)
+	}
+	err = d.davToErrno(&DavError{
+		Message: "405 Method Not Allowed",
+		Code: 405,
+	})
+	return
+}
+
+func (d *Client) CanPutRange() bool {
+	return (d.IsSabre || d.IsApache) && !d.PutDisabled
+}
+
+func (d *Client) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (created bool, err error) {
+	d.semAcquire()
+	defer d.semRelease()
+
+	if !d.CanPutRange() && !d.CanUpload() {
+		err = d.davToErrno(&DavError{
+			Message: "405 Method Not Allowed",
+			Code: 405,
+		})
+		return
+	}
+
+	req, err := d.buildRequest(ctx, "PUT", path, data)
+	if create {
+		if excl {
+			req.Header.Set("If-None-Match", "*")
+		}
+	} else {
+		req.Header.Set("If-Match", "*")
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return
+	}
+	created = resp.StatusCode == 201
+	defer resp.Body.Close()
+	return
+}
+
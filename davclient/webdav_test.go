@@ -0,0 +1,240 @@
+package davclient
+
+import (
+	"context"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type propfindEntry struct {
+	name	string
+	isDir	bool
+	size	string
+	mtime	string
+}
+
+// The files in testdata/propfind are hand-written, not captured. They
+// mimic what these servers are known to send: namespace prefixes, 404
+// propstats for missing properties, full URLs or paths in href, date
+// formats, and in some of them a response that failed.
+var propfindFixtures = []struct {
+	file	string
+	prefix	string
+	entries	[]propfindEntry
+}{
+	{ "apache.xml", "/dav/", []propfindEntry{
+		{ "", true, "", "2019-03-14T10:22:31Z" },
+		{ "notes.txt", false, "1832", "2019-03-14T10:25:02Z" },
+		{ "photos/", true, "", "2019-02-01T08:00:00Z" },
+		{ "my report (2019).pdf", false, "204800", "2019-03-10T17:41:09Z" },
+	}},
+	{ "sabredav.xml", "/remote.php/dav/files/alice/Documents/", []propfindEntry{
+		{ "", true, "", "2020-05-05T09:12:44Z" },
+		{ "Example.md", false, "1095", "2020-05-04T15:01:12Z" },
+		{ "Readme First.odt", false, "36227", "2020-05-04T15:01:13Z" },
+		{ "Archive/", true, "", "2020-05-03T11:00:00Z" },
+	}},
+	{ "iis.xml", "/share/", []propfindEntry{
+		{ "", true, "", "2018-11-02T14:03:11Z" },
+		{ "setup.exe", false, "5242880", "2018-11-02T14:05:40Z" },
+		{ "Logs/", true, "", "2018-10-30T09:00:02Z" },
+	}},
+	{ "nginx.xml", "/webdav/", []propfindEntry{
+		{ "", true, "", "2020-04-11T13:40:12Z" },
+		{ "backup.tar.gz", false, "104857600", "2020-04-10T22:00:00Z" },
+		{ "music files/", true, "", "2020-04-09T19:12:45Z" },
+	}},
+	{ "box.xml", "/dav/Projects/", []propfindEntry{
+		{ "", true, "", "2021-01-20T16:04:55Z" },
+		{ "plan.xlsx", false, "48213", "2021-01-19T10:30:00Z" },
+		{ "Q1 Review/", true, "", "2021-01-18T09:00:00Z" },
+	}},
+	{ "sharepoint.xml", "/sites/team/Shared Documents/", []propfindEntry{
+		{ "", true, "0", "2021-03-02T10:15:00Z" },
+		{ "Budget 2021.xlsx", false, "23841", "2021-03-01T16:42:10Z" },
+		{ "Forms/", true, "0", "2020-06-17T12:01:33Z" },
+	}},
+}
+
+func TestMultiStatusFixtures(t *testing.T) {
+	for _, f := range propfindFixtures {
+		contents, err := ioutil.ReadFile(filepath.Join("testdata", "propfind", f.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var props []*Props
+		_, err = decodeMultiStatus(bytes.NewReader(contents), func(r *Response) {
+			if p := r.hrefProps(f.prefix); p != nil {
+				props = append(props, p)
+			}
+		})
+		if err != nil {
+			t.Errorf("%s: %v", f.file, err)
+			continue
+		}
+		if len(props) != len(f.entries) {
+			t.Errorf("%s: got %d entries, want %d", f.file, len(props), len(f.entries))
+			continue
+		}
+		for i, e := range f.entries {
+			p := props[i]
+			if p.Name != e.name {
+				t.Errorf("%s: entry %d: name %q, want %q", f.file, i, p.Name, e.name)
+			}
+			if (p.ResourceType == "collection") != e.isDir {
+				t.Errorf("%s: %q: collection %v, want %v", f.file, e.name, !e.isDir, e.isDir)
+			}
+			if p.ContentLength != e.size {
+				t.Errorf("%s: %q: size %q, want %q", f.file, e.name, p.ContentLength, e.size)
+			}
+			want, _ := time.Parse(time.RFC3339, e.mtime)
+			if mt := parseTime(p.LastModified); !mt.Equal(want) {
+				t.Errorf("%s: %q: mtime %v, want %v", f.file, e.name, mt, want)
+			}
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2021, 1, 12, 19, 15, 42, 0, time.UTC)
+	for _, s := range []string{
+		"2021-01-12T19:15:42Z",
+		"2021-01-12T11:15:42-08:00",
+		"2021-01-12T20:15:42+01:00",
+		"Tue, 12 Jan 2021 19:15:42 GMT",
+		"Tue, 12 Jan 2021 20:15:42 +0100",
+		"Tuesday, 12-Jan-21 19:15:42 GMT",
+	} {
+		if tm := parseTime(s); !tm.Equal(want) {
+			t.Errorf("parseTime(%q) = %v, want %v", s, tm, want)
+		}
+	}
+	if tm := parseTime("2021-01-12T19:15:42.467Z"); tm.Unix() != want.Unix() {
+		t.Errorf("parseTime with fraction = %v", tm)
+	}
+	if tm := parseTime("garbage"); !tm.IsZero() {
+		t.Errorf("parseTime(garbage) = %v, want zero", tm)
+	}
+}
+
+func TestStripHrefPrefix(t *testing.T) {
+	for _, tc := range []struct { href, prefix, name string; ok bool }{
+		{ "/dav/dir/", "/dav/dir/", "", true },
+		{ "/dav/dir/a.txt", "/dav/dir/", "a.txt", true },
+		{ "/dav/dir/sub/", "/dav/dir/", "sub/", true },
+		{ "/dav/dir/sub/a.txt", "/dav/dir/", "", false },
+		// "dir" was not redirected to "dir/".
+		{ "/dav/dir/", "/dav/dir", "", true },
+		{ "/dav/dir/a.txt", "/dav/dir", "a.txt", true },
+		{ "http://example.com/dav/dir/a%20b", "/dav/dir/", "a b", true },
+	} {
+		name, ok := stripHrefPrefix(tc.href, tc.prefix)
+		if name != tc.name || ok != tc.ok {
+			t.Errorf("stripHrefPrefix(%q, %q) = %q, %v", tc.href, tc.prefix, name, ok)
+		}
+	}
+}
+
+func TestMultiStatusError(t *testing.T) {
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", "propfind", "delete-207.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		StatusCode: 207,
+		Body: ioutil.NopCloser(bytes.NewReader(contents)),
+	}
+	d := &Client{ base: "/dav" }
+	err = d.multiStatusError("DELETE", resp)
+	daverr, ok := err.(*DavError)
+	if !ok {
+		t.Fatalf("got %T, want *DavError", err)
+	}
+	if daverr.Code != 423 || daverr.Errnum != syscall.EAGAIN {
+		t.Errorf("got code %d errno %v, want 423 EAGAIN", daverr.Code, daverr.Errnum)
+	}
+	want := []string{ "/container/resource3", "/container/big.iso" }
+	if strings.Join(daverr.Failed, ",") != strings.Join(want, ",") {
+		t.Errorf("failed paths %v, want %v", daverr.Failed, want)
+	}
+}
+
+func TestConnectRedirect(t *testing.T) {
+	ctx := context.Background()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new" + r.URL.Path[4:], http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("Dav", "1")
+		case "PROPFIND":
+			w.WriteHeader(207)
+			w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/new/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	d := &Client{ Url: srv.URL + "/old" }
+	if err := d.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d.Url != srv.URL + "/new" || d.base != "/new" {
+		t.Errorf("got url %s base %s after redirect", d.Url, d.base)
+	}
+
+	// a redirect to another host must be refused.
+	other := httptest.NewServer(http.RedirectHandler(srv.URL + "/new/", http.StatusFound))
+	defer other.Close()
+	d = &Client{ Url: strings.Replace(other.URL, "127.0.0.1", "localhost", 1) }
+	if err := d.Connect(ctx); err == nil {
+		t.Errorf("redirect to another host was followed")
+	}
+}
+
+func TestReaddirFuncLarge(t *testing.T) {
+	ctx := context.Background()
+	const entries = 20000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(207)
+		w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`))
+		w.Write([]byte(`<d:response><d:href>/dav/big/</d:href><d:propstat><d:prop>` +
+			`<d:resourcetype><d:collection/></d:resourcetype></d:prop>` +
+			`<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`))
+		for i := 0; i < entries; i++ {
+			fmt.Fprintf(w, `<d:response><d:href>/dav/big/file%d</d:href><d:propstat><d:prop>` +
+				`<d:getcontentlength>%d</d:getcontentlength></d:prop>` +
+				`<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, i, i)
+		}
+		w.Write([]byte(`</d:multistatus>`))
+	}))
+	defer srv.Close()
+
+	d := &Client{ Url: srv.URL + "/dav", base: "/dav", cc: srv.Client() }
+	n := 0
+	err := d.ReaddirFunc(ctx, "/big", true, func(dn Dnode) {
+		if dn.Name == "." {
+			return
+		}
+		if dn.Name != fmt.Sprintf("file%d", n) || dn.Size != uint64(n) {
+			t.Fatalf("entry %d: %+v", n, dn)
+		}
+		n++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != entries {
+		t.Errorf("got %d entries, want %d", n, entries)
+	}
+}
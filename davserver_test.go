@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miquels/webdavfs/davclient"
+	"golang.org/x/net/webdav"
+)
+
+// An in-process WebDAV server with an in-memory filesystem, for tests.
+// The flavor decides how it does partial updates: "apache" takes a PUT
+// with Content-Range, "sabre" a PATCH with X-Update-Range, and ""
+// cannot do them at all.
+type davServer struct {
+	*httptest.Server
+	fs		webdav.FileSystem
+	dav		*webdav.Handler
+	flavor		string
+	mu		sync.Mutex
+	requests	[]string
+	fail		map[string]int
+}
+
+const davServerPrefix = "/dav"
+
+func newDavServer(flavor string) (s *davServer) {
+	s = &davServer{
+		fs: webdav.NewMemFS(),
+		flavor: flavor,
+		fail: map[string]int{},
+	}
+	s.dav = &webdav.Handler{
+		Prefix: davServerPrefix,
+		FileSystem: s.fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	s.Server = httptest.NewServer(s)
+	return
+}
+
+// Make "METHOD /path" (without the prefix) return status.
+func (s *davServer) failWith(method, path string, status int) {
+	s.mu.Lock()
+	s.fail[method + " " + path] = status
+	s.mu.Unlock()
+}
+
+// Requests seen since the last call, as "METHOD /path".
+func (s *davServer) seen() (r []string) {
+	s.mu.Lock()
+	r, s.requests = s.requests, nil
+	s.mu.Unlock()
+	return
+}
+
+func (s *davServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, davServerPrefix)
+	if path == "" {
+		path = "/"
+	}
+	key := r.Method + " " + path
+	s.mu.Lock()
+	s.requests = append(s.requests, key)
+	status := s.fail[key]
+	s.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		s.options(w)
+	case "PUT":
+		var start, end int64
+		cr := r.Header.Get("Content-Range")
+		if cr == "" {
+			s.put(w, r, path, -1)
+		} else if s.flavor != "apache" {
+			http.Error(w, "Content-Range not supported", 400)
+		} else if _, err := fmt.Sscanf(cr, "bytes %d-%d/*", &start, &end); err != nil {
+			http.Error(w, err.Error(), 400)
+		} else {
+			s.put(w, r, path, start)
+		}
+	case "PATCH":
+		var start int64
+		if s.flavor != "sabre" {
+			http.Error(w, "Method Not Allowed", 405)
+		} else if r.Header.Get("Content-Type") != "application/x-sabredav-partialupdate" {
+			http.Error(w, "Unsupported Media Type", 415)
+		} else if _, err := fmt.Sscanf(r.Header.Get("X-Update-Range"), "bytes=%d-", &start); err != nil {
+			http.Error(w, err.Error(), 400)
+		} else {
+			s.put(w, r, path, start)
+		}
+	default:
+		s.dav.ServeHTTP(w, r)
+	}
+}
+
+func (s *davServer) options(w http.ResponseWriter) {
+	allow := "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK"
+	dav := "1, 2"
+	switch s.flavor {
+	case "apache":
+		w.Header().Set("Server", "Apache/2.4.57 (Unix)")
+		dav += ", <http://apache.org/dav/propset/fs/1>"
+	case "sabre":
+		allow += ", PATCH"
+		dav += ", 3, sabredav-partialupdate"
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", dav)
+	w.Header().Set("MS-Author-Via", "DAV")
+}
+
+// Write the body at offset, or replace the file if offset is -1.
+func (s *davServer) put(w http.ResponseWriter, r *http.Request, path string, offset int64) {
+	ctx := r.Context()
+	fi, err := s.fs.Stat(ctx, path)
+	exists := err == nil
+	if exists && fi.IsDir() {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if (exists && r.Header.Get("If-None-Match") == "*") ||
+	   (!exists && r.Header.Get("If-Match") == "*") {
+		http.Error(w, "Precondition Failed", 412)
+		return
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if offset < 0 {
+		flags |= os.O_TRUNC
+		offset = 0
+	}
+	f, err := s.fs.OpenFile(ctx, path, flags, 0666)
+	if err != nil {
+		// no parent directory.
+		http.Error(w, "Conflict", 409)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		_, err = io.Copy(f, r.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if exists {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+}
+
+// The contents of a file on the server.
+func (s *davServer) file(path string) (data string, err error) {
+	f, err := s.fs.OpenFile(context.Background(), path, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	data = string(b)
+	return
+}
+
+func (s *davServer) writeFile(path, data string) {
+	f, err := s.fs.OpenFile(context.Background(), path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		panic(err)
+	}
+	f.Write([]byte(data))
+	f.Close()
+}
+
+// Start a server and connect a client and an empty node tree to it,
+// as if the share was mounted. The server is closed when the test
+// is done.
+func testMount(t *testing.T, flavor string) (s *davServer, root *Node) {
+	s = newDavServer(flavor)
+	d := &davclient.Client{
+		Url: s.URL + davServerPrefix,
+		Transport: s.Client().Transport,
+	}
+	if err := d.Connect(context.Background()); err != nil {
+		s.Close()
+		t.Fatalf("Connect: %v", err)
+	}
+
+	root = NewFS(newDavBackend(d), WebdavFS{ Mode: 0755 }).root
+	t.Cleanup(s.Close)
+	return
+}
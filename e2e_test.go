@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// These tests drive the FUSE handlers of the node tree the way the
+// kernel would, against the in-process server from davserver_test.go.
+
+func errnoOf(err error) syscall.Errno {
+	if e, ok := err.(fuse.ErrorNumber); ok {
+		return syscall.Errno(e.Errno())
+	}
+	return 0
+}
+
+// No i/o or metadata operation may be left behind on any node.
+func checkRefs(t *testing.T, nd *Node) {
+	t.Helper()
+	if nd.RefCount != [2]int{} {
+		t.Errorf("%s: refcount %v after the operation", nd.getPath(), nd.RefCount)
+	}
+	for _, c := range nd.Child {
+		checkRefs(t, c)
+	}
+}
+
+func lookup(t *testing.T, dir *Node, name string) (*Node, error) {
+	t.Helper()
+	n, err := dir.Lookup(context.Background(), &fuse.LookupRequest{ Name: name }, &fuse.LookupResponse{})
+	checkRefs(t, dir.fs.root)
+	if err != nil {
+		return nil, err
+	}
+	return n.(*Node), nil
+}
+
+func create(t *testing.T, dir *Node, name string, flags fuse.OpenFlags) (*Node, error) {
+	t.Helper()
+	req := &fuse.CreateRequest{ Name: name, Flags: flags | fuse.OpenReadWrite, Mode: 0644 }
+	n, _, err := dir.Create(context.Background(), req, &fuse.CreateResponse{})
+	checkRefs(t, dir.fs.root)
+	if err != nil {
+		return nil, err
+	}
+	return n.(*Node), nil
+}
+
+func write(t *testing.T, nf *Node, off int64, data string) error {
+	t.Helper()
+	req := &fuse.WriteRequest{ Offset: off, Data: []byte(data) }
+	resp := &fuse.WriteResponse{}
+	err := nf.Write(context.Background(), req, resp)
+	checkRefs(t, nf.fs.root)
+	if err == nil && resp.Size != len(data) {
+		t.Errorf("write: %d bytes, want %d", resp.Size, len(data))
+	}
+	return err
+}
+
+func read(t *testing.T, nf *Node, off int64, size int) (string, error) {
+	t.Helper()
+	resp := &fuse.ReadResponse{}
+	err := nf.Read(context.Background(), &fuse.ReadRequest{ Offset: off, Size: size }, resp)
+	checkRefs(t, nf.fs.root)
+	return string(resp.Data), err
+}
+
+func ftruncate(t *testing.T, nf *Node, size uint64) error {
+	t.Helper()
+	req := &fuse.SetattrRequest{ Valid: fuse.SetattrSize, Size: size }
+	err := nf.Setattr(context.Background(), req, &fuse.SetattrResponse{})
+	checkRefs(t, nf.fs.root)
+	return err
+}
+
+func readdir(t *testing.T, dir *Node) (names []string) {
+	t.Helper()
+	dd, err := dir.ReadDirAll(context.Background())
+	checkRefs(t, dir.fs.root)
+	if err != nil {
+		t.Fatalf("ReadDirAll(%s): %v", dir.getPath(), err)
+	}
+	for _, d := range dd {
+		if d.Name != "." {
+			names = append(names, d.Name)
+		}
+	}
+	return
+}
+
+func hasNames(names []string, want ...string) bool {
+	if len(names) != len(want) {
+		return false
+	}
+	m := map[string]bool{}
+	for _, n := range names {
+		m[n] = true
+	}
+	for _, w := range want {
+		if !m[w] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestE2EFile(t *testing.T) {
+	for _, flavor := range []string{ "apache", "sabre" } {
+		t.Run(flavor, func(t *testing.T) {
+			srv, root := testMount(t, flavor)
+			if !root.fs.dav.Caps().PutRange {
+				t.Fatalf("%s: no partial updates", flavor)
+			}
+
+			nf, err := create(t, root, "a.txt", fuse.OpenExclusive)
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			if _, err := create(t, root, "a.txt", fuse.OpenExclusive); errnoOf(err) != syscall.EEXIST {
+				t.Errorf("exclusive create of existing file: %v", err)
+			}
+			if err := write(t, nf, 0, "hello, world"); err != nil {
+				t.Fatal(err)
+			}
+			if err := write(t, nf, 7, "there"); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := srv.file("/a.txt"); data != "hello, there" {
+				t.Errorf("server has %q", data)
+			}
+			if data, err := read(t, nf, 4, 100); err != nil || data != "o, there" {
+				t.Errorf("read: %q, %v", data, err)
+			}
+			if data, err := read(t, nf, 12, 100); err != nil || data != "" {
+				t.Errorf("read at EOF: %q, %v", data, err)
+			}
+
+			// extend, truncate to zero. Shrinking to a non-zero
+			// size cannot be done over WebDAV.
+			if err := ftruncate(t, nf, 16); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := srv.file("/a.txt"); data != "hello, there\x00\x00\x00\x00" {
+				t.Errorf("after extend: %q", data)
+			}
+			if err := ftruncate(t, nf, 5); errnoOf(err) != syscall.ERANGE {
+				t.Errorf("shrink: %v", err)
+			}
+			if err := ftruncate(t, nf, 0); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := srv.file("/a.txt"); data != "" {
+				t.Errorf("after truncate: %q", data)
+			}
+
+			// a file that is already there.
+			srv.writeFile("/b.txt", "0123456789")
+			nb, err := lookup(t, root, "b.txt")
+			if err != nil || nb.Size != 10 {
+				t.Fatalf("lookup: %v, %v", nb, err)
+			}
+			if err := write(t, nb, 8, "abcd"); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := read(t, nb, 0, 100); data != "01234567abcd" || err != nil {
+				t.Errorf("read: %q %v", data, err)
+			}
+			if err := nb.Flush(context.Background(), &fuse.FlushRequest{}); err != nil {
+				t.Errorf("flush: %v", err)
+			}
+		})
+	}
+}
+
+func TestE2EDirectories(t *testing.T) {
+	srv, root := testMount(t, "apache")
+	ctx := context.Background()
+
+	n, err := root.Mkdir(ctx, &fuse.MkdirRequest{ Name: "d", Mode: 0755 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(t, root)
+	dir := n.(*Node)
+	if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{ Name: "d" }); errnoOf(err) != syscall.EACCES {
+		t.Errorf("mkdir of existing directory: %v", err)
+	}
+	srv.writeFile("/a.txt", "aaa")
+	srv.writeFile("/d/x", "x")
+	if names := readdir(t, root); !hasNames(names, "a.txt", "d") {
+		t.Errorf("readdir /: %v", names)
+	}
+	if names := readdir(t, dir); !hasNames(names, "x") {
+		t.Errorf("readdir /d: %v", names)
+	}
+
+	// rename into another directory, and within one.
+	err = root.Rename(ctx, &fuse.RenameRequest{ OldName: "a.txt", NewName: "b.txt" }, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(t, root)
+	if data, _ := srv.file("/d/b.txt"); data != "aaa" {
+		t.Errorf("after rename: %q", data)
+	}
+	if root.getNode("a.txt") != nil || dir.getNode("b.txt") == nil {
+		t.Errorf("node tree not updated by rename")
+	}
+	err = root.Rename(ctx, &fuse.RenameRequest{ OldName: "d", NewName: "e" }, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(t, root)
+	if dir.getPath() != "/e" || dir.getNode("b.txt").getPath() != "/e/b.txt" {
+		t.Errorf("paths after rename: %s %s", dir.getPath(), dir.getNode("b.txt").getPath())
+	}
+	if err := root.Rename(ctx, &fuse.RenameRequest{ OldName: "nothere", NewName: "x" }, root); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("rename of missing file: %v", err)
+	}
+
+	// remove.
+	for _, tc := range []struct {
+		dir	*Node
+		name	string
+		isDir	bool
+		errno	syscall.Errno
+	}{
+		{ root, "e", true, syscall.ENOTEMPTY },
+		{ dir, "b.txt", true, syscall.ENOTDIR },
+		{ dir, "b.txt", false, 0 },
+		{ dir, "x", false, 0 },
+		{ root, "e", false, syscall.EISDIR },
+		{ root, "e", true, 0 },
+		{ root, "e", true, syscall.ENOENT },
+	} {
+		err := tc.dir.Remove(ctx, &fuse.RemoveRequest{ Name: tc.name, Dir: tc.isDir })
+		checkRefs(t, root)
+		if errnoOf(err) != tc.errno || (tc.errno == 0 && err != nil) {
+			t.Errorf("remove %s: %v, want %v", joinPath(tc.dir.getPath(), tc.name), err, tc.errno)
+		}
+	}
+	if names := readdir(t, root); len(names) != 0 {
+		t.Errorf("readdir / after remove: %v", names)
+	}
+	if _, err := lookup(t, root, "e"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("lookup of removed directory: %v", err)
+	}
+}
+
+func TestE2ELargeDir(t *testing.T) {
+	srv, root := testMount(t, "apache")
+	var want []string
+	for i := 0; i < 2 * readDirBatch + 10; i++ {
+		name := fmt.Sprintf("f%04d", i)
+		srv.writeFile("/" + name, "x")
+		want = append(want, name)
+	}
+	if names := readdir(t, root); !hasNames(names, want...) {
+		t.Errorf("readdir /: %d entries, want %d", len(names), len(want))
+	}
+	if len(root.Child) != len(want) {
+		t.Errorf("%d nodes, want %d", len(root.Child), len(want))
+	}
+}
+
+func TestE2EReadOnly(t *testing.T) {
+	srv, root := testMount(t, "")
+	if root.fs.dav.Caps().PutRange {
+		t.Fatal("server without partial updates can do partial updates")
+	}
+	srv.writeFile("/a.txt", "hello")
+	nf, err := lookup(t, root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := read(t, nf, 0, 100); data != "hello" || err != nil {
+		t.Errorf("read: %q %v", data, err)
+	}
+	if err := write(t, nf, 5, "!"); errnoOf(err) != syscall.EACCES {
+		t.Errorf("write: %v", err)
+	}
+	if _, err := create(t, root, "b.txt", 0); errnoOf(err) != syscall.EACCES {
+		t.Errorf("create: %v", err)
+	}
+}
+
+// Status codes from the server end up as the right errno.
+func TestE2EErrors(t *testing.T) {
+	srv, root := testMount(t, "sabre")
+	ctx := context.Background()
+	srv.writeFile("/a.txt", "hello")
+	srv.writeFile("/b.txt", "hello")
+	na, err := lookup(t, root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.failWith("PROPFIND", "/secret", 403)
+	if _, err := lookup(t, root, "secret"); errnoOf(err) != syscall.EACCES {
+		t.Errorf("lookup: %v", err)
+	}
+	srv.failWith("PATCH", "/a.txt", 507)
+	if err := write(t, na, 0, "x"); errnoOf(err) != syscall.ENOSPC {
+		t.Errorf("write: %v", err)
+	}
+	srv.failWith("GET", "/a.txt", 416)
+	if _, err := read(t, na, 0, 5); errnoOf(err) != syscall.ERANGE {
+		t.Errorf("read: %v", err)
+	}
+	srv.failWith("DELETE", "/b.txt", 423)
+	if err := root.Remove(ctx, &fuse.RemoveRequest{ Name: "b.txt" }); errnoOf(err) != syscall.EAGAIN {
+		t.Errorf("remove: %v", err)
+	}
+	srv.failWith("MKCOL", "/d/", 507)
+	if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{ Name: "d" }); errnoOf(err) != syscall.ENOSPC {
+		t.Errorf("mkdir: %v", err)
+	}
+	checkRefs(t, root)
+	if root.getNode("d") != nil {
+		t.Errorf("failed mkdir left a node")
+	}
+}
+
+// A metadata operation on a directory waits until i/o below it is done.
+func TestE2EMetaWaitsForIO(t *testing.T) {
+	srv, root := testMount(t, "apache")
+	srv.writeFile("/a.txt", "hello")
+	na, err := lookup(t, root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	na.incIoRef(0)
+	done := make(chan error)
+	go func() {
+		done <- root.Rename(context.Background(), &fuse.RenameRequest{ OldName: "a.txt", NewName: "b.txt" }, root)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("rename did not wait for i/o: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, r := range srv.seen() {
+		if strings.HasPrefix(r, "MOVE") {
+			t.Errorf("MOVE sent while i/o in progress")
+		}
+	}
+
+	// meanwhile, i/o has to wait for the rename.
+	io := make(chan bool)
+	go func() {
+		na.incIoRef(0)
+		io <- true
+	}()
+	na.decIoRef()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-io
+	na.decIoRef()
+	checkRefs(t, root)
+	if na.getPath() != "/b.txt" {
+		t.Errorf("path after rename: %s", na.getPath())
+	}
+}
+
+// Collects a sequential upload and puts it in place on Close.
+type testUploader struct {
+	b	Backend
+	path	string
+	data	[]byte
+}
+
+func (u *testUploader) Write(ctx context.Context, data []byte) error {
+	u.data = append(u.data, data...)
+	return nil
+}
+
+func (u *testUploader) Close(ctx context.Context) error {
+	_, err := u.b.Put(ctx, u.path, u.data, true, false)
+	return err
+}
+
+func (u *testUploader) Abort() {}
+
+type uploadBackend struct {
+	Backend
+}
+
+func (b *uploadBackend) NewUpload(path string) davclient.Uploader {
+	return &testUploader{ b: b.Backend, path: path }
+}
+
+func TestE2EListDuringUpload(t *testing.T) {
+	_, root := testMount(t, "apache")
+	root.fs.dav = &uploadBackend{ root.fs.dav }
+
+	nf, err := create(t, root, "big", fuse.OpenExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, nf, 0, "hello, ")
+	write(t, nf, 7, "world")
+	if !nf.uploading() {
+		t.Fatalf("no upload in progress")
+	}
+	// The listing has the size on the server, which is still 0.
+	readdir(t, root)
+	if nf.Size != 12 {
+		t.Errorf("size %d during upload, want 12", nf.Size)
+	}
+	if err := nf.Fsync(context.Background(), &fuse.FsyncRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	readdir(t, root)
+	if nf.Size != 12 || nf.uploading() {
+		t.Errorf("size %d after upload, want 12", nf.Size)
+	}
+}
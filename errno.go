@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Errno names that can be used in the errnomap file.
+var errnoNames = map[string]syscall.Errno{
+	"EACCES":	syscall.EACCES,
+	"EAGAIN":	syscall.EAGAIN,
+	"EBUSY":	syscall.EBUSY,
+	"ECONNREFUSED":	syscall.ECONNREFUSED,
+	"EEXIST":	syscall.EEXIST,
+	"EFBIG":	syscall.EFBIG,
+	"EHOSTDOWN":	syscall.EHOSTDOWN,
+	"EHOSTUNREACH":	syscall.EHOSTUNREACH,
+	"EINVAL":	syscall.EINVAL,
+	"EIO":		syscall.EIO,
+	"EISDIR":	syscall.EISDIR,
+	"ELOOP":	syscall.ELOOP,
+	"ENAMETOOLONG":	syscall.ENAMETOOLONG,
+	"ENOENT":	syscall.ENOENT,
+	"ENOSPC":	syscall.ENOSPC,
+	"ENOTDIR":	syscall.ENOTDIR,
+	"ENOTEMPTY":	syscall.ENOTEMPTY,
+	"ENOTSUP":	syscall.ENOTSUP,
+	"EPERM":	syscall.EPERM,
+	"ERANGE":	syscall.ERANGE,
+	"EROFS":	syscall.EROFS,
+	"ESTALE":	syscall.ESTALE,
+	"ETIMEDOUT":	syscall.ETIMEDOUT,
+	"EWOULDBLOCK":	syscall.EWOULDBLOCK,
+	"EDQUOT":	syscall.EDQUOT,
+}
+
+func parseErrno(s string) (e syscall.Errno, err error) {
+	e, ok := errnoNames[strings.ToUpper(strings.TrimSpace(s))]
+	if !ok {
+		err = fmt.Errorf("%s: unknown errno", s)
+	}
+	return
+}
+
+func errnoName(e syscall.Errno) string {
+	for n, v := range errnoNames {
+		// EWOULDBLOCK == EAGAIN, prefer the latter.
+		if v == e && n != "EWOULDBLOCK" {
+			return n
+		}
+	}
+	return strconv.Itoa(int(e))
+}
+
+// Read a file with "status errno" lines, for example
+//
+//	# this server returns 409 for locked files.
+//	409 EBUSY
+//
+// and return it, to override the default mapping of a client.
+func loadErrnoMap(fn string) (m map[int]syscall.Errno, err error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	m = map[int]syscall.Errno{}
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: syntax error", fn, lineno)
+		}
+		code, err := strconv.Atoi(f[0])
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%s:%d: %s: invalid status", fn, lineno, f[0])
+		}
+		e, err := parseErrno(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, lineno, err)
+		}
+		m[code] = e
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestLoadErrnoMap(t *testing.T) {
+	f, err := ioutil.TempFile("", "errnomap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\n409 EBUSY\n507\tedquot # quota\n")
+	f.Close()
+
+	m, err := loadErrnoMap(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &davclient.Client{ ErrnoMap: m }
+	for code, want := range map[int]syscall.Errno{
+		409: syscall.EBUSY,
+		507: syscall.EDQUOT,
+		404: syscall.ENOENT,
+	} {
+		if e := d.StatusErrno(code); e != want {
+			t.Errorf("%d: got %v, want %v", code, e, want)
+		}
+	}
+	if e := d.StatusErrno(599); e != syscall.EIO {
+		t.Errorf("599: got %v, want EIO", e)
+	}
+	if e := davclient.StatusErrno(409); e != syscall.ENOENT {
+		t.Errorf("default for 409 changed to %v", e)
+	}
+}
+
+func TestLoadErrnoMapErrors(t *testing.T) {
+	for _, content := range []string{ "409\n", "abc EIO\n", "409 ENOSUCH\n" } {
+		f, err := ioutil.TempFile("", "errnomap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		f.Close()
+		if _, err := loadErrnoMap(f.Name()); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+		os.Remove(f.Name())
+	}
+}
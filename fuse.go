@@ -5,8 +5,8 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
-	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
@@ -14,13 +14,16 @@ import (
 	"bazil.org/fuse/fs"
 )
 
+// Defaults for the dircache=, statcache= and attrcache= options.
 const (
-	dirCacheTime   = 10 * time.Second
-	statCacheTime  = 1 * time.Second
-	attrValidTime  = 1 * time.Minute
-	entryValidTime = 1 * time.Minute
+	defDirCacheTime   = 10 * time.Second
+	defStatCacheTime  = 1 * time.Second
+	defAttrValidTime  = 1 * time.Minute
 )
 
+// Directory entries that ReadDirAll adds to the node tree in one go.
+const readDirBatch = 256
+
 type WebdavFS struct {
 	Uid		uint32
 	Gid		uint32
@@ -28,10 +31,18 @@ type WebdavFS struct {
 	dirMode		os.FileMode
 	fileMode	os.FileMode
 	blockSize	uint32
+	Verify		bool
 	root		*Node
+	dav		Backend
+	virtual		map[string]*VirtNode
+	dirCacheTime	time.Duration
+	statCacheTime	time.Duration
+	attrValidTime	time.Duration
+	prefetch	map[string]bool
+	prefetchOff	int32
+	prefetchMutex	*sync.Mutex
+	metrics		*metricSet
 }
-var FS *WebdavFS
-var dav *DavClient
 
 func attrSet(v fuse.SetattrValid, f fuse.SetattrValid) bool {
 	return (v & f) > 0
@@ -53,42 +64,56 @@ func getCMtime(c time.Time, m time.Time) (rc time.Time, rm time.Time) {
 	return
 }
 
-func NewFS(d *DavClient, config WebdavFS) *WebdavFS {
+func NewFS(b Backend, config WebdavFS) *WebdavFS {
 
 	if trace(T_FUSE) {
 		tPrintf("NewFS %s", tJson(config))
 	}
 
-	dav = d
-	FS = &config
-	FS.root = rootNode
+	f := &config
+	f.dav = b
+	f.root = &Node{
+		Dnode: Dnode{ IsDir: true },
+		Inode: 1,
+		Child: make(map[string]*Node),
+		fs: f,
+	}
+	f.virtual = map[string]*VirtNode{}
+	f.dirCacheTime = defDirCacheTime
+	f.statCacheTime = defStatCacheTime
+	f.attrValidTime = defAttrValidTime
+	f.prefetch = map[string]bool{}
+	f.prefetchMutex = &sync.Mutex{}
+	if f.metrics == nil {
+		f.metrics = newMetricSet()
+	}
 
-	if FS.Mode == 0 {
-		FS.Mode = 0700
+	if f.Mode == 0 {
+		f.Mode = 0700
 	}
-	FS.Mode = FS.Mode & 0777
-	FS.fileMode = os.FileMode(FS.Mode &^ uint32(0111))
+	f.Mode = f.Mode & 0777
+	f.fileMode = os.FileMode(f.Mode &^ uint32(0111))
 
-	FS.dirMode = os.FileMode(FS.Mode)
-	if FS.dirMode & 0007 > 0 {
-		FS.dirMode |= 0001
+	f.dirMode = os.FileMode(f.Mode)
+	if f.dirMode & 0007 > 0 {
+		f.dirMode |= 0001
 	}
-	if FS.dirMode & 0070 > 0 {
-		FS.dirMode |= 0010
+	if f.dirMode & 0070 > 0 {
+		f.dirMode |= 0010
 	}
-	if FS.dirMode & 0700 > 0 {
-		FS.dirMode |= 0100
+	if f.dirMode & 0700 > 0 {
+		f.dirMode |= 0100
 	}
-	FS.dirMode |= os.ModeDir
+	f.dirMode |= os.ModeDir
 
-	FS.blockSize = 4096
+	f.blockSize = 4096
 	if runtime.GOOS == "darwin" {
 		// if we set this on osxfuse, _all_ I/O will
-		// be limited to FS.blockSize bytes.
-		FS.blockSize = 0
+		// be limited to blockSize bytes.
+		f.blockSize = 0
 	}
 
-	return FS
+	return f
 }
 
 func (fs *WebdavFS) Root() (fs.Node, error) {
@@ -96,6 +121,7 @@ func (fs *WebdavFS) Root() (fs.Node, error) {
 }
 
 func (fs *WebdavFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	defer fs.metrics.fuseOp("Statfs", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Statfs()", req.Header.ID)
 		defer func() {
@@ -106,8 +132,7 @@ func (fs *WebdavFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *f
 			}
 		}()
 	}
-	wanted := []string{ "quota-available-bytes", "quota-used-bytes" }
-	props, err := dav.PropFind("/", 0, wanted)
+	spaceUsed, spaceFree, err := fs.dav.Statfs(ctx)
 	if err != nil {
 		return
 	}
@@ -116,15 +141,11 @@ func (fs *WebdavFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *f
 	total := uint64(negOne)
 	free := uint64(negOne)
 
-	if len(props) == 1 {
-		spaceUsed, _ := strconv.ParseUint(props[0].SpaceUsed, 10, 64)
-		spaceFree, _ := strconv.ParseUint(props[0].SpaceFree, 10, 64)
-		if spaceUsed > 0 || spaceFree > 0 {
-			used := (spaceUsed + 4095) / 4096
-			free =  (spaceFree + 4095) / 4096
-			if free > 0 {
-				total = used + free
-			}
+	if spaceUsed > 0 || spaceFree > 0 {
+		used := (spaceUsed + 4095) / 4096
+		free =  (spaceFree + 4095) / 4096
+		if free > 0 {
+			total = used + free
 		}
 	}
 
@@ -141,6 +162,7 @@ func (fs *WebdavFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *f
 }
 
 func (nd *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (ret fs.Node, err error) {
+	defer nd.fs.metrics.fuseOp("Mkdir", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Mkdir(%s)", req.Header.ID, req.Name)
 		defer func() {
@@ -154,7 +176,7 @@ func (nd *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (ret fs.Node,
 	nd.incMetaRefThenLock(req.Header.ID)
 	path := joinPath(nd.getPath(), req.Name)
 	nd.Unlock()
-	err = dav.Mkcol(addSlash(path))
+	err = nd.fs.dav.Mkcol(ctx, addSlash(path))
 	nd.Lock()
 	if err == nil {
 		now := time.Now()
@@ -173,6 +195,7 @@ func (nd *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (ret fs.Node,
 }
 
 func (nd *Node) Rename(ctx context.Context, req *fuse.RenameRequest, destDir fs.Node) (err error) {
+	defer nd.fs.metrics.fuseOp("Rename", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Rename(%s, %s)", req.Header.ID, req.OldName, req.NewName)
 		defer func() {
@@ -237,11 +260,13 @@ func (nd *Node) Rename(ctx context.Context, req *fuse.RenameRequest, destDir fs.
 		// find out if it's a dir or not, so stat.
 		nd.Unlock()
 		var dnode Dnode
-		dnode, err = dav.Stat(oldPath)
+		dnode, err = nd.fs.dav.Stat(ctx, oldPath)
 		isDir = dnode.IsDir
 	} else {
 		isDir = node.IsDir
 		nd.Unlock()
+		// upload has to end up at the old name first.
+		err = node.uploadSync(ctx)
 	}
 
 	if err == nil {
@@ -249,12 +274,16 @@ func (nd *Node) Rename(ctx context.Context, req *fuse.RenameRequest, destDir fs.
 			oldPath = addSlash(oldPath)
 			newPath = addSlash(newPath)
 		}
-		err = dav.Move(oldPath, newPath)
+		err = nd.fs.dav.Move(ctx, oldPath, newPath)
 	}
 
 	nd.Lock()
 	if err == nil {
 		nd.moveNode(destNode, req.OldName, req.NewName)
+	} else if partialFailure(err, "Rename", req.Header.ID) {
+		// both source and destination are now in an unknown state.
+		nd.invalidateSubtree(req.OldName)
+		destNode.invalidateSubtree(req.NewName)
 	}
 	lock1.decMetaRef()
 	if lock2 != nil {
@@ -265,6 +294,7 @@ func (nd *Node) Rename(ctx context.Context, req *fuse.RenameRequest, destDir fs.
 }
 
 func (nd *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer nd.fs.metrics.fuseOp("Remove", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Remove(%s)", req.Header.ID, req.Name)
 		defer func() {
@@ -277,44 +307,62 @@ func (nd *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error)
 	}
 	nd.incMetaRefThenLock(req.Header.ID)
 	path := joinPath(nd.getPath(), req.Name)
+	node := nd.getNode(req.Name)
 	nd.Unlock()
-	props, err := dav.PropFindWithRedirect(path, 1, nil)
+	if node != nil {
+		node.uploadMutex.Lock()
+		node.uploadAbort()
+		node.uploadMutex.Unlock()
+	}
+	dnode, err := nd.fs.dav.Stat(ctx, path)
 	if err == nil {
-		if len(props) != 1 {
-			if req.Dir {
-				err = fuse.Errno(syscall.ENOTEMPTY)
-			} else {
-				err = fuse.EIO
-			}
+		if req.Dir && !dnode.IsDir {
+			err = fuse.Errno(syscall.ENOTDIR)
 		}
-		if err == nil {
-			isDir := false
-			if props[0].ResourceType == "collection" {
-				isDir = true
-			}
-			if req.Dir && !isDir {
-				err = fuse.Errno(syscall.ENOTDIR)
-			}
-			if !req.Dir && isDir {
-				err = fuse.Errno(syscall.EISDIR)
+		if !req.Dir && dnode.IsDir {
+			err = fuse.Errno(syscall.EISDIR)
+		}
+	}
+	if err == nil && req.Dir {
+		// DELETE of a collection is recursive, rmdir is not.
+		path = addSlash(path)
+		empty := true
+		err = nd.fs.dav.Readdir(ctx, path, func(d Dnode) {
+			if d.Name != "." {
+				empty = false
 			}
+		})
+		if err == nil && !empty {
+			err = fuse.Errno(syscall.ENOTEMPTY)
 		}
 	}
 	if err == nil {
-		if req.Dir {
-			path = addSlash(path)
-		}
-		err = dav.Delete(path)
+		err = nd.fs.dav.Delete(ctx, path)
 	}
 	nd.Lock()
 	if err == nil {
 		nd.delNode(req.Name)
+	} else if partialFailure(err, "Remove", req.Header.ID) {
+		nd.invalidateSubtree(req.Name)
 	}
 	nd.decMetaRef()
 	nd.Unlock()
 	return
 }
 
+// See if a collection operation only partially succeeded.
+func partialFailure(err error, op string, id fuse.RequestID) bool {
+	daverr, ok := err.(fuseError)
+	if !ok || len(daverr.Failed) == 0 {
+		return false
+	}
+	if trace(T_FUSE) {
+		tPrintf("%d %s: partial failure: %s", id, op,
+			strings.Join(daverr.Failed, ", "))
+	}
+	return true
+}
+
 func (nd *Node) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
 	// should not be called if Getattr exists.
 	r := &fuse.GetattrRequest{}
@@ -325,6 +373,7 @@ func (nd *Node) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
 }
 
 func (nd *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) (err error) {
+	defer nd.fs.metrics.fuseOp("Getattr", time.Now(), &err)
 
 	if trace(T_FUSE) {
 		tPrintf("%d Getattr(%s)", req.Header.ID, nd.Name)
@@ -344,12 +393,14 @@ func (nd *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fus
 	nd.incIoRef(req.Header.ID)
 
 	dnode := nd.Dnode
-	if !nd.statInfoFresh() {
+	fresh := nd.statInfoFresh()
+	nd.fs.metrics.cacheLookup("stat", fresh)
+	if !fresh && !nd.uploading() {
 		path := nd.getPath()
 		if nd.IsDir {
 			path = addSlash(path)
 		}
-		dnode, err = dav.Stat(path)
+		dnode, err = nd.fs.dav.Stat(ctx, path)
 		if err == nil {
 			nd.statInfoTouch()
 		}
@@ -364,20 +415,20 @@ func (nd *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fus
 		} else {
 			// All well, build fuse.Attr.
 			nd.Dnode = dnode
-			mode := FS.fileMode
+			mode := nd.fs.fileMode
 			ctime, mtime := getCMtime(nd.Ctime, nd.Mtime)
 			atime := nd.Atime
 			if atime.IsZero() {
 				atime = mtime
 			}
 			if nd.IsDir {
-				mode = FS.dirMode
+				mode = nd.fs.dirMode
 			}
 			if nd.IsLink {
 				mode = os.ModeSymlink | 0777
 			}
 			resp.Attr = fuse.Attr{
-				Valid: attrValidTime,
+				Valid: loadDuration(&nd.fs.attrValidTime),
 				Inode: nd.Inode,
 				Size: nd.Size,
 				Blocks: (nd.Size + 511) / 512,
@@ -387,9 +438,9 @@ func (nd *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fus
 				Crtime: ctime,
 				Mode: mode,
 				Nlink: 1,
-				Uid: FS.Uid,
-				Gid: FS.Gid,
-				BlockSize: FS.blockSize,
+				Uid: nd.fs.Uid,
+				Gid: nd.fs.Gid,
+				BlockSize: nd.fs.blockSize,
 			}
 		}
 	}
@@ -398,6 +449,7 @@ func (nd *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fus
 }
 
 func (nd *Node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (rn fs.Node, err error) {
+	defer nd.fs.metrics.fuseOp("Lookup", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Lookup(%s)", req.Header.ID, req.Name)
 		defer func() {
@@ -408,14 +460,35 @@ func (nd *Node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 			}
 		}()
 	}
+	if nd.Parent == nil {
+		if vn, ok := nd.fs.virtual[req.Name]; ok {
+			rn = vn
+			return
+		}
+	}
 	nd.incIoRef(req.Header.ID)
 	defer nd.decIoRef()
 
+	nd.prefetch(ctx)
+
 	// do we have a recent entry available?
 	nd.Lock()
 	nn := nd.getNode(req.Name)
 	valid := nn != nil && nn.statInfoFresh()
+	if !valid && nd.dirCacheFresh() {
+		d, ok := nd.DirCache[req.Name]
+		if !ok {
+			nd.Unlock()
+			nd.fs.metrics.cacheLookup("stat", true)
+			err = fuse.ENOENT
+			return
+		}
+		nn = nd.addNode(d, true)
+		nn.ListTime = nd.DirCacheTime
+		valid = true
+	}
 	nd.Unlock()
+	nd.fs.metrics.cacheLookup("stat", valid)
 	if valid {
 		rn = nn
 		return
@@ -423,17 +496,17 @@ func (nd *Node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 
 	// need to call stat
 	path := joinPath(nd.getPath(), req.Name)
-	dnode, err := dav.Stat(path)
+	dnode, err := nd.fs.dav.Stat(ctx, path)
 
 	if err == nil {
 		node := nd.addNode(dnode, true)
 		rn = node
 	}
-	nd.decIoRef()
 	return
 }
 
 func (nd *Node) ReadDirAll(ctx context.Context) (dd []fuse.Dirent, err error) {
+	defer nd.fs.metrics.fuseOp("ReadDirAll", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("- ReaddirAll(%s)", nd.Name)
 		defer func() {
@@ -447,20 +520,17 @@ func (nd *Node) ReadDirAll(ctx context.Context) (dd []fuse.Dirent, err error) {
 	nd.incIoRef(0)
 	defer nd.decIoRef()
 
-	path := nd.getPath()
-	dirs, err := dav.Readdir(path, true)
-	if err != nil {
-		return
-	}
-
-	nd.Lock()
-	defer nd.Unlock()
+	nd.prefetch(ctx)
 
+	// Entries are added as they come in, a batch at a time, so we
+	// never have the whole listing in memory twice and do not take
+	// the lock for every entry. Called with the lock held.
 	seen := map[string]bool{}
-	for _, d := range dirs {
+	add := func(d Dnode) {
 		ino := nd.Inode
 		if d.Name != "" && d.Name != "." {
 			nn := nd.addNode(d, false)
+			nn.listInfoTouch()
 			ino = nn.Inode
 		}
 
@@ -479,6 +549,43 @@ func (nd *Node) ReadDirAll(ctx context.Context) (dd []fuse.Dirent, err error) {
 
 		seen[d.Name] = true
 	}
+
+	nd.Lock()
+	cached := nd.dirCacheFresh()
+	nd.fs.metrics.cacheLookup("dir", cached)
+	if cached {
+		add(Dnode{ Name: "." })
+		for _, d := range nd.DirCache {
+			add(d)
+		}
+	}
+	nd.Unlock()
+	if !cached {
+		path := nd.getPath()
+		batch := make([]Dnode, 0, readDirBatch)
+		addBatch := func() {
+			nd.Lock()
+			for _, d := range batch {
+				add(d)
+			}
+			nd.Unlock()
+			batch = batch[:0]
+		}
+		err = nd.fs.dav.Readdir(ctx, path, func(d Dnode) {
+			batch = append(batch, d)
+			if len(batch) == readDirBatch {
+				addBatch()
+			}
+		})
+		if err != nil {
+			dd = nil
+			return
+		}
+		addBatch()
+	}
+
+	nd.Lock()
+	defer nd.Unlock()
 	for _, x := range nd.Child {
 		if !seen[x.Name] {
 			x.invalidateThisNode()
@@ -488,6 +595,7 @@ func (nd *Node) ReadDirAll(ctx context.Context) (dd []fuse.Dirent, err error) {
 }
 
 func (nd *Node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fs.Node, handle fs.Handle, err error) {
+	defer nd.fs.metrics.fuseOp("Create", time.Now(), &err)
 	nd.incMetaRefThenLock(req.Header.ID)
 	path := nd.getPath()
 	nd.Unlock()
@@ -511,18 +619,28 @@ func (nd *Node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 	if trunc {
 		// A simple put with no body creates and truncates the
 		// file if it's not there.
-		created, err = dav.Put(path, []byte{}, true, excl)
-	} else {
+		created, err = nd.fs.dav.Put(ctx, path, []byte{}, true, excl)
+	} else if nd.fs.dav.Caps().PutRange {
 		// A Put-Range at offset 0 with an empty body
 		// creates the file if not present, but doesn't
 		// truncate it.
-		created, err = dav.PutRange(path, []byte{}, 0, true, excl)
+		created, err = nd.fs.dav.PutRange(ctx, path, []byte{}, 0, true, excl)
+	} else {
+		// Only sequential uploads. Create the file if it
+		// is not there, but do not truncate it.
+		created, err = nd.fs.dav.Put(ctx, path, []byte{}, true, true)
+		if daverr, ok := err.(fuseError); ok && daverr.Code == 412 && !excl {
+			err = nil
+		}
+	}
+	if daverr, ok := err.(fuseError); ok && daverr.Code == 412 && excl {
+		err = fuse.EEXIST
 	}
 	if err == nil && excl && !created {
 		err = fuse.EEXIST
 	}
 	if err == nil {
-		dnode, err := dav.Stat(path)
+		dnode, err := nd.fs.dav.Stat(ctx, path)
 		if err == nil {
 			n := nd.addNode(dnode, true)
 			node = n
@@ -550,15 +668,19 @@ func (nd *Node) Forget() {
 }
 
 func (nd *Node) ftruncate(ctx context.Context, size uint64, id fuse.RequestID) (err error) {
+	err = nd.uploadSync(ctx)
+	if err != nil {
+		return
+	}
 	nd.incMetaRefThenLock(id)
 	path := nd.getPath()
 	nd.Unlock()
 	if size == 0 {
 		if nd.Size > 0 {
-			_, err = dav.Put(path, []byte{}, false, false)
+			_, err = nd.fs.dav.Put(ctx, path, []byte{}, false, false)
 		}
 	} else if size > nd.Size {
-		_, err = dav.PutRange(path, []byte{0}, int64(size - 1), false, false)
+		_, err = nd.fs.dav.PutRange(ctx, path, []byte{0}, int64(size - 1), false, false)
 	} else if size != nd.Size {
 		err = fuse.ERANGE
 	}
@@ -572,6 +694,7 @@ func (nd *Node) ftruncate(ctx context.Context, size uint64, id fuse.RequestID) (
 }
 
 func (nd *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer nd.fs.metrics.fuseOp("Setattr", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Setattr(%s, %s)", req.Header.ID, nd.Name, tJson(req))
 		defer func() {
@@ -592,7 +715,7 @@ func (nd *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 	v := req.Valid
 	if attrSet(v, invalid) {
 		if trace(T_FUSE) {
-			tPrintf("%d Setattr($s): invalid attributes (mode %d, invalid %d)",
+			tPrintf("%d Setattr(%s): invalid attributes (mode %d, invalid %d)",
 				req.Header.ID, nd.Name, v, invalid)
 		}
 		return fuse.EPERM
@@ -626,9 +749,9 @@ func (nd *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 		// http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
 	}
 
-	mode := FS.fileMode
+	mode := nd.fs.fileMode
 	if nd.IsDir {
-		mode = FS.dirMode
+		mode = nd.fs.dirMode
 	}
 	if nd.IsLink {
 		mode = os.ModeSymlink | 0777
@@ -639,7 +762,7 @@ func (nd *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 		atime = mtime
 	}
 	attr := fuse.Attr{
-		Valid: attrValidTime,
+		Valid: loadDuration(&nd.fs.attrValidTime),
 		Inode: nd.Inode,
 		Size:	nd.Size,
 		Blocks:	nd.Size / 512,
@@ -649,8 +772,8 @@ func (nd *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 		Crtime: ctime,
 		Mode: mode,
 		Nlink: 1,
-		Uid: FS.Uid,
-		Gid: FS.Gid,
+		Uid: nd.fs.Uid,
+		Gid: nd.fs.Gid,
 		BlockSize: 4096,
 	}
 	resp.Attr = attr
@@ -665,6 +788,7 @@ func (nf *Node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string
 }
 
 func (nf *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	defer nf.fs.metrics.fuseOp("Fsync", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Fsync(%s)", req.Header.ID, nf.Name)
 		defer func() {
@@ -677,10 +801,35 @@ func (nf *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 		err = fuse.Errno(syscall.ESTALE)
 		return
 	}
-	return nil
+	err = nf.uploadSync(ctx)
+	if err == nil {
+		err = nf.fs.dav.Sync(ctx, nf.getPath())
+	}
+	return
+}
+
+func (nf *Node) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer nf.fs.metrics.fuseOp("Flush", time.Now(), &err)
+	if trace(T_FUSE) {
+		tPrintf("%d Flush(%s)", req.Header.ID, nf.Name)
+		defer func() {
+			if err != nil {
+				tPrintf("%d Flush(%s): %v", req.Header.ID, nf.Name, err)
+			}
+		}()
+	}
+	err = nf.uploadSync(ctx)
+	if err == nil {
+		err = nf.fs.dav.Sync(ctx, nf.getPath())
+	}
+	if err == nil {
+		err = nf.verifyClose(ctx)
+	}
+	return
 }
 
 func (nf *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer nf.fs.metrics.fuseOp("Read", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Read(%s, %d, %d)", req.Header.ID, nf.Name, req.Offset, req.Size)
 		defer func() {
@@ -697,6 +846,10 @@ func (nf *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Read
 	}
 	nf.incIoRef(req.Header.ID)
 	defer nf.decIoRef()
+	err = nf.uploadSync(ctx)
+	if err != nil {
+		return
+	}
 	nf.Lock()
 	toRead := int64(nf.Size) - req.Offset
 	nf.Unlock()
@@ -708,14 +861,16 @@ func (nf *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Read
 		toRead = int64(req.Size)
 	}
 	path := nf.getPath()
-	data, err := dav.GetRange(path, req.Offset, int(toRead))
+	data, err := nf.fs.dav.GetRange(ctx, path, req.Offset, int(toRead))
 	if err == nil {
 		resp.Data = data
+		nf.verifyAdd(false, req.Offset, data)
 	}
 	return
 }
 
 func (nf *Node) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer nf.fs.metrics.fuseOp("Write", time.Now(), &err)
 	if trace(T_FUSE) {
 		tPrintf("%d Write(%s, %d, %d)", req.Header.ID, nf.Name, req.Offset, len(req.Data))
 		defer func() {
@@ -736,14 +891,21 @@ func (nf *Node) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wr
 	}
 	nf.incIoRef(req.Header.ID)
 	path := nf.getPath()
-	_, err = dav.PutRange(path, req.Data, req.Offset, false, false)
+	nf.uploadMutex.Lock()
+	uploaded, err := nf.uploadWrite(ctx, path, req.Data, req.Offset)
+	nf.uploadMutex.Unlock()
+	if err == nil && !uploaded {
+		_, err = nf.fs.dav.PutRange(ctx, path, req.Data, req.Offset, false, false)
+	}
 	if err == nil {
 		resp.Size = len(req.Data)
+		nf.verifyAdd(true, req.Offset, req.Data)
 		sz := uint64(req.Offset) + uint64(len(req.Data))
 		nf.Lock()
 		if sz > nf.Size {
 			nf.Size = sz
 		}
+		nf.dirCacheInvalidate()
 		nf.Unlock()
 	}
 	nf.decIoRef()
@@ -751,6 +913,7 @@ func (nf *Node) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wr
 }
 
 func (nf *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	defer nf.fs.metrics.fuseOp("Open", time.Now(), &err)
 	trunc := flagSet(req.Flags, fuse.OpenTruncate)
 	read  := req.Flags.IsReadWrite() || req.Flags.IsReadOnly()
 	write := req.Flags.IsReadWrite() || req.Flags.IsWriteOnly()
@@ -765,7 +928,8 @@ func (nf *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Open
 			}
 		}()
 	}
-	if nf.IsDir {
+	if nf.IsDir || nf.uploading() {
+		// while uploading, the server does not have the data yet.
 		handle = nf
 		return
 	}
@@ -774,7 +938,7 @@ func (nf *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Open
 	path := nf.getPath()
 
 	// See if kernel cache is still valid.
-	dnode, err := dav.Stat(path)
+	dnode, err := nf.fs.dav.Stat(ctx, path)
 	if err == nil {
 		nf.Lock()
 		nf.Dnode = dnode
@@ -787,7 +951,7 @@ func (nf *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Open
 		// This is actually not called, truncating is
 		// done by calling Setattr with 0 size.
 		if trunc {
-			_, err = dav.Put(path, []byte{}, false, false)
+			_, err = nf.fs.dav.Put(ctx, path, []byte{}, false, false)
 			if err == nil {
 				nf.Size = 0
 			}
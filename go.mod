@@ -5,6 +5,7 @@ go 1.12
 require (
 	bazil.org/fuse v0.0.0-20200419173433-3ba628eaf417
 	github.com/pborman/getopt/v2 v2.1.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/net v0.1.0
 )
 
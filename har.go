@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests to the server can be written to a HTTP Archive (HAR 1.2)
+// file with the har=FILE option or "webdavfs ctl MOUNTPOINT har FILE".
+// That is easier to share with a server vendor than a trace. Entries
+// are added while the mount runs, and the file is kept valid JSON
+// after every entry. Credentials are never written.
+
+type harNameValue struct {
+	Name		string		`json:"name"`
+	Value		string		`json:"value"`
+}
+
+type harPostData struct {
+	MimeType	string		`json:"mimeType"`
+	Text		string		`json:"text"`
+}
+
+type harRequest struct {
+	Method		string		`json:"method"`
+	Url		string		`json:"url"`
+	HttpVersion	string		`json:"httpVersion"`
+	Cookies		[]harNameValue	`json:"cookies"`
+	Headers		[]harNameValue	`json:"headers"`
+	QueryString	[]harNameValue	`json:"queryString"`
+	PostData	*harPostData	`json:"postData,omitempty"`
+	HeadersSize	int		`json:"headersSize"`
+	BodySize	int64		`json:"bodySize"`
+}
+
+type harContent struct {
+	Size		int64		`json:"size"`
+	MimeType	string		`json:"mimeType"`
+	Text		string		`json:"text,omitempty"`
+	Comment		string		`json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status		int		`json:"status"`
+	StatusText	string		`json:"statusText"`
+	HttpVersion	string		`json:"httpVersion"`
+	Cookies		[]harNameValue	`json:"cookies"`
+	Headers		[]harNameValue	`json:"headers"`
+	Content		harContent	`json:"content"`
+	RedirectURL	string		`json:"redirectURL"`
+	HeadersSize	int		`json:"headersSize"`
+	BodySize	int64		`json:"bodySize"`
+	Error		string		`json:"_error,omitempty"`
+}
+
+// Milliseconds, -1 if it does not apply.
+type harTimings struct {
+	Blocked		float64		`json:"blocked"`
+	Dns		float64		`json:"dns"`
+	Connect		float64		`json:"connect"`
+	Send		float64		`json:"send"`
+	Wait		float64		`json:"wait"`
+	Receive		float64		`json:"receive"`
+	Ssl		float64		`json:"ssl"`
+}
+
+type harEntry struct {
+	StartedDateTime	string		`json:"startedDateTime"`
+	Time		float64		`json:"time"`
+	Request		harRequest	`json:"request"`
+	Response	harResponse	`json:"response"`
+	Cache		struct{}	`json:"cache"`
+	Timings		harTimings	`json:"timings"`
+	ServerIPAddress	string		`json:"serverIPAddress,omitempty"`
+}
+
+const harHeader = `{"log":{"version":"1.2","creator":{"name":"webdavfs","version":"` + VERSION + `"},"entries":[`
+const harTrailer = "\n]}}\n"
+
+type harWriter struct {
+	sync.Mutex
+	file		*os.File
+	entries		int
+	maxBody		int
+}
+
+var harMutex sync.Mutex
+var har *harWriter
+
+// Start writing to file. maxBody is how much of XML request and
+// response bodies is included.
+func startHar(file string, maxBody int) (err error) {
+	fh, err := unprivOpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(fh, harHeader + harTrailer)
+	if err != nil {
+		fh.Close()
+		return
+	}
+	stopHar()
+	harMutex.Lock()
+	har = &harWriter{ file: fh, maxBody: maxBody }
+	harMutex.Unlock()
+	return
+}
+
+func stopHar() {
+	harMutex.Lock()
+	h := har
+	har = nil
+	harMutex.Unlock()
+	if h != nil {
+		h.Lock()
+		h.file.Close()
+		h.Unlock()
+	}
+}
+
+func getHar() *harWriter {
+	harMutex.Lock()
+	defer harMutex.Unlock()
+	return har
+}
+
+// Overwrite the trailer with the new entry, then write the trailer.
+func (h *harWriter) add(e *harEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	sep := "\n"
+	if h.entries > 0 {
+		sep = ",\n"
+	}
+	end, err := h.file.Seek(-int64(len(harTrailer)), io.SeekEnd)
+	if err != nil {
+		return
+	}
+	h.file.WriteAt([]byte(sep + string(b) + harTrailer), end)
+	h.entries++
+}
+
+var harRedact = map[string]bool{
+	"Authorization":	true,
+	"Proxy-Authorization":	true,
+	"Cookie":		true,
+	"Set-Cookie":		true,
+}
+
+func harHeaders(hdr http.Header) (r []harNameValue) {
+	r = []harNameValue{}
+	for _, name := range sortedHeaderNames(hdr) {
+		for _, v := range hdr[name] {
+			if harRedact[name] {
+				v = "REDACTED"
+			}
+			r = append(r, harNameValue{ name, v })
+		}
+	}
+	return
+}
+
+func sortedHeaderNames(hdr http.Header) []string {
+	names := []string{}
+	for n := range hdr {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isXml(contentType string) bool {
+	return strings.Contains(contentType, "xml")
+}
+
+func truncate(b []byte, max int) string {
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
+
+func msSince(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+// Times of the phases of a request, from httptrace.
+type harTrace struct {
+	start, gotConn, dnsStart, dnsDone, connStart, connDone	time.Time
+	tlsStart, tlsDone, wroteRequest, firstByte, done	time.Time
+	serverAddr	string
+}
+
+func (t *harTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart: func(string, string) { t.connStart = time.Now() },
+		ConnectDone: func(string, string, error) { t.connDone = time.Now() },
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.gotConn = time.Now()
+			if info.Conn != nil {
+				t.serverAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+func (t *harTrace) timings() harTimings {
+	connDone := t.connDone
+	if t.tlsDone.After(connDone) {
+		connDone = t.tlsDone
+	}
+	blockedUntil := t.gotConn
+	if !t.dnsStart.IsZero() {
+		blockedUntil = t.dnsStart
+	} else if !t.connStart.IsZero() {
+		blockedUntil = t.connStart
+	}
+	return harTimings{
+		Blocked: msSince(t.start, blockedUntil),
+		Dns: msSince(t.dnsStart, t.dnsDone),
+		Connect: msSince(t.connStart, connDone),
+		Ssl: msSince(t.tlsStart, t.tlsDone),
+		Send: msSince(t.gotConn, t.wroteRequest),
+		Wait: msSince(t.wroteRequest, t.firstByte),
+		Receive: msSince(t.firstByte, t.done),
+	}
+}
+
+// The response body; the entry is written when it is closed.
+type harBody struct {
+	io.ReadCloser
+	h		*harWriter
+	entry		*harEntry
+	trace		*harTrace
+	keep		bool
+	body		[]byte
+	size		int64
+	once		sync.Once
+}
+
+func (b *harBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if b.keep && len(b.body) <= b.h.maxBody {
+		b.body = append(b.body, p[:n]...)
+	}
+	if err == io.EOF {
+		b.finish("")
+	} else if err != nil {
+		b.finish(err.Error())
+	}
+	return
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish("")
+	return err
+}
+
+func (b *harBody) finish(errMsg string) {
+	b.once.Do(func() {
+		b.trace.done = time.Now()
+		e := b.entry
+		e.Response.BodySize = b.size
+		e.Response.Content.Size = b.size
+		if b.keep && len(b.body) > 0 {
+			e.Response.Content.Text = truncate(b.body, b.h.maxBody)
+			if len(b.body) > b.h.maxBody {
+				e.Response.Content.Comment = "truncated"
+			}
+		}
+		e.Response.Error = errMsg
+		e.Timings = b.trace.timings()
+		e.Time = msSince(b.trace.start, b.trace.done)
+		e.ServerIPAddress, _, _ = net.SplitHostPort(b.trace.serverAddr)
+		b.h.add(e)
+	})
+}
+
+func (h *harWriter) roundTrip(tr http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	t := &harTrace{ start: time.Now() }
+	u := *req.URL
+	u.User = nil
+	e := &harEntry{
+		StartedDateTime: t.start.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method: req.Method,
+			Url: u.String(),
+			HttpVersion: req.Proto,
+			Cookies: []harNameValue{},
+			Headers: harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize: req.ContentLength,
+		},
+	}
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{ k, v })
+		}
+	}
+	ct := req.Header.Get("Content-Type")
+	if h.maxBody > 0 && isXml(ct) && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			b, _ := ioutil.ReadAll(io.LimitReader(body, int64(h.maxBody) + 1))
+			body.Close()
+			e.Request.PostData = &harPostData{ MimeType: ct, Text: truncate(b, h.maxBody) }
+		}
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		e.Response = harResponse{
+			Cookies: []harNameValue{},
+			Headers: []harNameValue{},
+			HeadersSize: -1,
+			BodySize: -1,
+		}
+		b := &harBody{ h: h, entry: e, trace: t }
+		b.finish(err.Error())
+		return
+	}
+	e.Response = harResponse{
+		Status: resp.StatusCode,
+		HttpVersion: resp.Proto,
+		Cookies: []harNameValue{},
+		Headers: harHeaders(resp.Header),
+		Content: harContent{ MimeType: resp.Header.Get("Content-Type") },
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+	e.Response.StatusText = http.StatusText(resp.StatusCode)
+	if s := strings.SplitN(resp.Status, " ", 2); len(s) == 2 {
+		e.Response.StatusText = s[1]
+	}
+	keep := h.maxBody > 0 && isXml(e.Response.Content.MimeType)
+	resp.Body = &harBody{ ReadCloser: resp.Body, h: h, entry: e, trace: t, keep: keep }
+	return
+}
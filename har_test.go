@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestHar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(207)
+		w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"></d:multistatus>`))
+	}))
+	defer srv.Close()
+
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	if err := startHar(fh.Name(), 20); err != nil {
+		t.Fatal(err)
+	}
+	defer stopHar()
+
+	d := &davclient.Client{ Url: srv.URL, Username: "joe", Password: "pw", Cookie: "c=1", RoundTrip: roundTrip }
+	for i := 0; i < 2; i++ {
+		d.PropFind(context.Background(), "/dir/", 1, nil)
+	}
+
+	data, _ := ioutil.ReadFile(fh.Name())
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "Basic ") {
+		t.Errorf("credentials in HAR file")
+	}
+	var h struct {
+		Log struct {
+			Entries []harEntry
+		}
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatalf("HAR file is not valid JSON: %v\n%s", err, data)
+	}
+	if len(h.Log.Entries) != 2 {
+		t.Fatalf("%d entries", len(h.Log.Entries))
+	}
+	e := h.Log.Entries[0]
+	if e.Request.Method != "PROPFIND" || e.Response.Status != 207 || e.Response.StatusText != "Multi-Status" {
+		t.Errorf("entry: %+v", e)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != `<?xml version="1.0" ...` {
+		t.Errorf("request body: %+v", e.Request.PostData)
+	}
+	if e.Response.Content.Text != `<?xml version="1.0"?...` || e.Response.Content.Size != 67 {
+		t.Errorf("response content: %+v", e.Response.Content)
+	}
+	if e.Timings.Wait < 0 || e.ServerIPAddress != "127.0.0.1" {
+		t.Errorf("timings %+v address %q", e.Timings, e.ServerIPAddress)
+	}
+	redacted := 0
+	for _, hdr := range append(e.Request.Headers, e.Response.Headers...) {
+		if hdr.Value == "REDACTED" {
+			redacted++
+		}
+	}
+	if redacted != 3 {
+		t.Errorf("%d headers redacted, want 3", redacted)
+	}
+}
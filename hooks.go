@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// The WebDAV client reports to our trace file, log and the metrics
+// of its mount.
+
+func init() {
+	davclient.SetTrace(trace, tPrintf)
+}
+
+func davHooks(ms *metricSet) davclient.Hooks {
+	return davclient.Hooks{
+		Log: func(level string, msg string) {
+			if level == "warn" {
+				logWarnf("%s", msg)
+			} else {
+				logInfof("%s", msg)
+			}
+		},
+		Request: logRequest,
+		Try: ms.davRequest,
+		Bytes: ms.bytes,
+	}
+}
+
+// Every request goes through the recorder and the HAR writer, if
+// they are active. They are on the transport level, so that they
+// see each redirect and retry.
+func roundTrip(tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if r := getRecorder(); r != nil {
+		tr = &recordTransport{ tr, r }
+	}
+	if h := getHar(); h != nil {
+		return h.roundTrip(tr, req)
+	}
+	return tr.RoundTrip(req)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// Backends that wrap another Backend. Methods they do not care about
+// are passed on through the embedded Backend. From the bottom up, a
+// mount has dav, retry (backendretry=), crypt (crypt), cache
+// (backendcache=) and trace. Retry and cache are off by default: the
+// node tree already caches, and davclient retries per request.
+
+const backendRetryDelay = 100 * time.Millisecond
+
+// Caches the results of Stat and Readdir for ttl. Changes that go
+// through the cache drop what it knows about the paths involved,
+// changes made elsewhere are seen when the entries expire.
+type cacheBackend struct {
+	Backend
+	ttl		time.Duration
+	mu		sync.Mutex
+	stats		map[string]cachedStat
+	dirs		map[string]cachedDir
+}
+
+type cachedStat struct {
+	dnode		Dnode
+	when		time.Time
+}
+
+type cachedDir struct {
+	list		[]Dnode
+	when		time.Time
+}
+
+func newCacheBackend(b Backend, ttl time.Duration) *cacheBackend {
+	return &cacheBackend{
+		Backend: b,
+		ttl: ttl,
+		stats: map[string]cachedStat{},
+		dirs: map[string]cachedDir{},
+	}
+}
+
+func (b *cacheBackend) fresh(when time.Time) bool {
+	return when.Add(b.ttl).After(time.Now())
+}
+
+// Forget path, everything below it, and the listing of its parent.
+func (b *cacheBackend) forget(path string) {
+	path = memPath(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.dirs, pathpkg.Dir(path))
+	prefix := addSlash(path)
+	for p := range b.stats {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(b.stats, p)
+		}
+	}
+	for p := range b.dirs {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(b.dirs, p)
+		}
+	}
+}
+
+func (b *cacheBackend) Stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	key := memPath(path)
+	b.mu.Lock()
+	c, ok := b.stats[key]
+	b.mu.Unlock()
+	if ok && b.fresh(c.when) {
+		return c.dnode, nil
+	}
+	dnode, err = b.Backend.Stat(ctx, path)
+	if err == nil {
+		b.mu.Lock()
+		b.stats[key] = cachedStat{ dnode, time.Now() }
+		b.mu.Unlock()
+	}
+	return
+}
+
+func (b *cacheBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) (err error) {
+	key := memPath(path)
+	b.mu.Lock()
+	c, ok := b.dirs[key]
+	b.mu.Unlock()
+	if ok && b.fresh(c.when) {
+		for _, d := range c.list {
+			fn(d)
+		}
+		return
+	}
+	var list []Dnode
+	err = b.Backend.Readdir(ctx, path, func(d Dnode) {
+		list = append(list, d)
+		fn(d)
+	})
+	if err == nil {
+		b.mu.Lock()
+		b.dirs[key] = cachedDir{ list, time.Now() }
+		b.mu.Unlock()
+	}
+	return
+}
+
+func (b *cacheBackend) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (bool, error) {
+	defer b.forget(path)
+	return b.Backend.Put(ctx, path, data, create, excl)
+}
+
+func (b *cacheBackend) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error) {
+	defer b.forget(path)
+	return b.Backend.PutRange(ctx, path, data, offset, create, excl)
+}
+
+func (b *cacheBackend) Mkcol(ctx context.Context, path string) error {
+	defer b.forget(path)
+	return b.Backend.Mkcol(ctx, path)
+}
+
+func (b *cacheBackend) Delete(ctx context.Context, path string) error {
+	defer b.forget(path)
+	return b.Backend.Delete(ctx, path)
+}
+
+func (b *cacheBackend) Move(ctx context.Context, oldPath, newPath string) error {
+	defer b.forget(oldPath)
+	defer b.forget(newPath)
+	return b.Backend.Move(ctx, oldPath, newPath)
+}
+
+func (b *cacheBackend) NewUpload(path string) davclient.Uploader {
+	u := b.Backend.NewUpload(path)
+	if u == nil {
+		return nil
+	}
+	return &cacheUploader{ u, b, path }
+}
+
+// The file changes when the upload is done.
+type cacheUploader struct {
+	davclient.Uploader
+	b		*cacheBackend
+	path		string
+}
+
+func (u *cacheUploader) Close(ctx context.Context) error {
+	defer u.b.forget(u.path)
+	return u.Uploader.Close(ctx)
+}
+
+// Retries the calls that only read, if the error looks like it might
+// go away: EAGAIN (423 Locked, 429 Too Many Requests), ETIMEDOUT and
+// EIO. Calls that change something are not retried, since the first
+// attempt might have gone through.
+type retryBackend struct {
+	Backend
+	tries		int
+	delay		time.Duration
+}
+
+func newRetryBackend(b Backend, tries int, delay time.Duration) *retryBackend {
+	return &retryBackend{ Backend: b, tries: tries, delay: delay }
+}
+
+func retryable(err error) bool {
+	e, ok := err.(fuse.ErrorNumber)
+	if !ok {
+		return false
+	}
+	switch syscall.Errno(e.Errno()) {
+	case syscall.EAGAIN, syscall.ETIMEDOUT, syscall.EIO:
+		return true
+	}
+	return false
+}
+
+// Call fn until it works, or does not fail in a way that might go
+// away, or we run out of tries. The delay doubles every time.
+func (b *retryBackend) retry(ctx context.Context, fn func() error) (err error) {
+	delay := b.delay
+	for try := 1; ; try++ {
+		err = fn()
+		if err == nil || try >= b.tries || !retryable(err) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (b *retryBackend) Stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	err = b.retry(ctx, func() (err error) {
+		dnode, err = b.Backend.Stat(ctx, path)
+		return
+	})
+	return
+}
+
+// A listing can only be retried if nothing was passed on yet.
+func (b *retryBackend) list(ctx context.Context, fn func(Dnode), do func(func(Dnode)) error) (err error) {
+	seen := false
+	var final error
+	err = b.retry(ctx, func() error {
+		err := do(func(d Dnode) {
+			seen = true
+			fn(d)
+		})
+		if err != nil && seen {
+			final = err
+			return nil
+		}
+		return err
+	})
+	if final != nil {
+		err = final
+	}
+	return
+}
+
+func (b *retryBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) error {
+	return b.list(ctx, fn, func(fn func(Dnode)) error {
+		return b.Backend.Readdir(ctx, path, fn)
+	})
+}
+
+func (b *retryBackend) ReadTree(ctx context.Context, path string, fn func(Dnode)) error {
+	return b.list(ctx, fn, func(fn func(Dnode)) error {
+		return b.Backend.ReadTree(ctx, path, fn)
+	})
+}
+
+func (b *retryBackend) GetRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	err = b.retry(ctx, func() (err error) {
+		data, err = b.Backend.GetRange(ctx, path, offset, length)
+		return
+	})
+	return
+}
+
+func (b *retryBackend) Statfs(ctx context.Context) (used, free uint64, err error) {
+	err = b.retry(ctx, func() (err error) {
+		used, free, err = b.Backend.Statfs(ctx)
+		return
+	})
+	return
+}
+
+func (b *retryBackend) Checksums(ctx context.Context, path string) (sums davclient.Checksums, err error) {
+	err = b.retry(ctx, func() (err error) {
+		sums, err = b.Backend.Checksums(ctx, path)
+		return
+	})
+	return
+}
+
+// Traces every call with "-T backend": what the filesystem asked for,
+// before the layers below turn it into something else.
+type traceBackend struct {
+	Backend
+}
+
+func newTraceBackend(b Backend) *traceBackend {
+	return &traceBackend{ b }
+}
+
+func traceCall(start time.Time, call string, err *error) {
+	if *err != nil {
+		tPrintf("backend %s: %v (%v)", call, *err, time.Since(start))
+	} else {
+		tPrintf("backend %s: OK (%v)", call, time.Since(start))
+	}
+}
+
+func (b *traceBackend) Stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Stat(%s)", path), &err)
+	}
+	return b.Backend.Stat(ctx, path)
+}
+
+func (b *traceBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Readdir(%s)", path), &err)
+	}
+	return b.Backend.Readdir(ctx, path, fn)
+}
+
+func (b *traceBackend) ReadTree(ctx context.Context, path string, fn func(Dnode)) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("ReadTree(%s)", path), &err)
+	}
+	return b.Backend.ReadTree(ctx, path, fn)
+}
+
+func (b *traceBackend) GetRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("GetRange(%s, %d, %d)", path, offset, length), &err)
+	}
+	return b.Backend.GetRange(ctx, path, offset, length)
+}
+
+func (b *traceBackend) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (created bool, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Put(%s, %d bytes, create=%v excl=%v)",
+			path, len(data), create, excl), &err)
+	}
+	return b.Backend.Put(ctx, path, data, create, excl)
+}
+
+func (b *traceBackend) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (created bool, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("PutRange(%s, %d, %d bytes, create=%v excl=%v)",
+			path, offset, len(data), create, excl), &err)
+	}
+	return b.Backend.PutRange(ctx, path, data, offset, create, excl)
+}
+
+func (b *traceBackend) Mkcol(ctx context.Context, path string) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Mkcol(%s)", path), &err)
+	}
+	return b.Backend.Mkcol(ctx, path)
+}
+
+func (b *traceBackend) Delete(ctx context.Context, path string) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Delete(%s)", path), &err)
+	}
+	return b.Backend.Delete(ctx, path)
+}
+
+func (b *traceBackend) Move(ctx context.Context, oldPath, newPath string) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Move(%s, %s)", oldPath, newPath), &err)
+	}
+	return b.Backend.Move(ctx, oldPath, newPath)
+}
+
+func (b *traceBackend) Sync(ctx context.Context, path string) (err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Sync(%s)", path), &err)
+	}
+	return b.Backend.Sync(ctx, path)
+}
+
+func (b *traceBackend) Statfs(ctx context.Context) (used, free uint64, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), "Statfs()", &err)
+	}
+	return b.Backend.Statfs(ctx)
+}
+
+func (b *traceBackend) Checksums(ctx context.Context, path string) (sums davclient.Checksums, err error) {
+	if trace(T_BACKEND) {
+		defer traceCall(time.Now(), fmt.Sprintf("Checksums(%s)", path), &err)
+	}
+	return b.Backend.Checksums(ctx, path)
+}
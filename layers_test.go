@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Counts the calls, and fails the first "fail" of them.
+type countingBackend struct {
+	Backend
+	calls		int
+	fail		int
+	errno		syscall.Errno
+}
+
+func (b *countingBackend) Stat(ctx context.Context, path string) (Dnode, error) {
+	b.calls++
+	if b.calls <= b.fail {
+		return Dnode{}, fuse.Errno(b.errno)
+	}
+	return b.Backend.Stat(ctx, path)
+}
+
+func (b *countingBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) error {
+	b.calls++
+	return b.Backend.Readdir(ctx, path, fn)
+}
+
+func TestCacheBackend(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemBackend()
+	cb := &countingBackend{ Backend: mem }
+	b := newCacheBackend(cb, time.Minute)
+
+	b.Put(ctx, "/a", []byte("abc"), true, false)
+	for i := 0; i < 3; i++ {
+		if d, err := b.Stat(ctx, "/a"); err != nil || d.Size != 3 {
+			t.Fatalf("Stat: %+v, %v", d, err)
+		}
+		b.Readdir(ctx, "/", func(Dnode) {})
+	}
+	if cb.calls != 2 {
+		t.Errorf("%d calls, want 2", cb.calls)
+	}
+
+	// A change through the cache is seen at once.
+	b.PutRange(ctx, "/a", []byte("defg"), 3, false, false)
+	if d, _ := b.Stat(ctx, "/a"); d.Size != 7 {
+		t.Errorf("size %d after write, want 7", d.Size)
+	}
+	b.Mkcol(ctx, "/dir/")
+	b.Move(ctx, "/a", "/dir/a")
+	var names []string
+	b.Readdir(ctx, "/", func(d Dnode) {
+		names = append(names, d.Name)
+	})
+	if !hasNames(names, ".", "dir") {
+		t.Errorf("Readdir after move: %v", names)
+	}
+	if _, err := b.Stat(ctx, "/a"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("Stat of moved file: %v", err)
+	}
+
+	// But a change elsewhere only when the entry expires.
+	b.ttl = 0
+	mem.Delete(ctx, "/dir")
+	if _, err := b.Stat(ctx, "/dir/a"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("Stat after expiry: %v", err)
+	}
+}
+
+func TestRetryBackend(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemBackend()
+	mem.Put(ctx, "/a", []byte("abc"), true, false)
+
+	cb := &countingBackend{ Backend: mem, fail: 2, errno: syscall.EAGAIN }
+	b := newRetryBackend(cb, 3, time.Millisecond)
+	if _, err := b.Stat(ctx, "/a"); err != nil || cb.calls != 3 {
+		t.Errorf("Stat: %v after %d calls", err, cb.calls)
+	}
+
+	cb = &countingBackend{ Backend: mem, fail: 5, errno: syscall.EIO }
+	b = newRetryBackend(cb, 3, time.Millisecond)
+	if _, err := b.Stat(ctx, "/a"); errnoOf(err) != syscall.EIO || cb.calls != 3 {
+		t.Errorf("Stat: %v after %d calls, want EIO after 3", err, cb.calls)
+	}
+
+	cb = &countingBackend{ Backend: mem, fail: 5, errno: syscall.ENOENT }
+	b = newRetryBackend(cb, 3, time.Millisecond)
+	if _, err := b.Stat(ctx, "/a"); errnoOf(err) != syscall.ENOENT || cb.calls != 1 {
+		t.Errorf("Stat: %v after %d calls, want ENOENT after 1", err, cb.calls)
+	}
+}
+
+func TestBackendRetryOption(t *testing.T) {
+	m := &mount{ cmdline: MountOptions{ BackendRetry: 2 } }
+	if mo, err := m.loadConfig(); err != nil || mo.Retries != 0 {
+		t.Errorf("backendretry: retries %d, %v", mo.Retries, err)
+	}
+	m.cmdline.Retries, m.cmdline.RetriesSet = 3, true
+	if _, err := m.loadConfig(); err == nil {
+		t.Error("retries and backendretry both accepted")
+	}
+}
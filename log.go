@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log messages, as opposed to traces, are always on. They have a
+// level and optional key/value fields, and are written as text, JSON
+// or logfmt to stderr, a file, syslog or the systemd journal. This is
+// set with the log=, logformat= and logto= options.
+
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{ "error", "warn", "info", "debug" }
+
+type logSink interface {
+	write(level int, t time.Time, msg string, fields []interface{}) error
+}
+
+type logger struct {
+	sync.Mutex
+	level		int
+	sink		logSink
+}
+
+var logOut = &logger{
+	level: levelInfo,
+	sink: &streamSink{ w: os.Stderr, format: "text" },
+}
+
+func parseLevel(s string) (int, error) {
+	for i, n := range levelNames {
+		if s == n {
+			return i, nil
+		}
+	}
+	return 0, errors.New("unknown log level " + s)
+}
+
+// Set up logging. to is "stderr", "syslog", "journald" or a file
+// name. The default for a daemon is the journal if there is one,
+// and syslog otherwise.
+func setupLogging(level, format, to string) (err error) {
+	lvl := levelInfo
+	if level != "" {
+		lvl, err = parseLevel(level)
+		if err != nil {
+			return
+		}
+	}
+	switch format {
+	case "":
+		format = "text"
+	case "text", "json", "logfmt":
+	default:
+		return errors.New("unknown log format " + format)
+	}
+	if to == "" {
+		to = "stderr"
+		if IsDaemon() {
+			to = "syslog"
+			if _, err := os.Stat(journalSocket); err == nil {
+				to = "journald"
+			}
+		}
+	}
+
+	var sink logSink
+	switch to {
+	case "stderr":
+		sink = &streamSink{ w: os.Stderr, format: format }
+	case "syslog":
+		var w *syslog.Writer
+		w, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, progname)
+		if err != nil {
+			return
+		}
+		sink = &syslogSink{ w: w, format: format }
+	case "journald":
+		var conn *net.UnixConn
+		conn, err = net.DialUnix("unixgram", nil,
+			&net.UnixAddr{ Name: journalSocket, Net: "unixgram" })
+		if err != nil {
+			return
+		}
+		sink = &journalSink{ conn: conn }
+	default:
+		var fh *os.File
+		fh, err = unprivOpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return
+		}
+		sink = &streamSink{ w: fh, format: format }
+	}
+
+	logOut.Lock()
+	old := logOut.sink
+	logOut.level = lvl
+	logOut.sink = sink
+	logOut.Unlock()
+	if c, ok := old.(io.Closer); ok {
+		c.Close()
+	}
+	return
+}
+
+func logEnabled(level int) bool {
+	logOut.Lock()
+	defer logOut.Unlock()
+	return level <= logOut.level
+}
+
+// Log msg with key/value pairs.
+func logEvent(level int, msg string, fields ...interface{}) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	if level > logOut.level {
+		return
+	}
+	logOut.sink.write(level, time.Now(), msg, fields)
+}
+
+func logErrorf(format string, args ...interface{}) {
+	logEvent(levelError, fmt.Sprintf(format, args...))
+}
+
+func logWarnf(format string, args ...interface{}) {
+	logEvent(levelWarn, fmt.Sprintf(format, args...))
+}
+
+func logInfof(format string, args ...interface{}) {
+	logEvent(levelInfo, fmt.Sprintf(format, args...))
+}
+
+// A failed request to the server. 5xx and network errors are errors,
+// authentication failures warnings. Others, such as a 404 on a
+// lookup, are usually expected and only logged at debug level.
+func logRequest(req *http.Request, resp *http.Response, err error, latency time.Duration) {
+	if err == nil && resp.StatusCode / 100 == 2 {
+		return
+	}
+	level := levelDebug
+	status := 0
+	if resp != nil && resp.StatusCode != 0 {
+		status = resp.StatusCode
+	}
+	switch {
+	case status == 0 || status >= 500:
+		level = levelError
+	case status == 401 || status == 403:
+		level = levelWarn
+	}
+	if !logEnabled(level) {
+		return
+	}
+	fields := []interface{}{ "method", req.Method, "path", req.URL.Path }
+	if status != 0 {
+		fields = append(fields, "status", status)
+	}
+	fields = append(fields, "latency", latency)
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+	logEvent(level, "request failed", fields...)
+}
+
+func logValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case time.Duration:
+		return x.Round(time.Microsecond).String()
+	case error:
+		return x.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+func logfmtQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatLogfmt(fields []interface{}) string {
+	a := []string{}
+	for i := 0; i + 1 < len(fields); i += 2 {
+		a = append(a, fmt.Sprintf("%s=%s", fields[i], logfmtQuote(logValue(fields[i+1]))))
+	}
+	return strings.Join(a, " ")
+}
+
+// Like json.Marshal of a map, but keeps the order of the fields.
+func formatJson(fields []interface{}) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := 0; i + 1 < len(fields); i += 2 {
+		v := fields[i+1]
+		switch x := v.(type) {
+		case time.Duration:
+			v = x.Seconds()
+		case error:
+			v = x.Error()
+		}
+		k, _ := json.Marshal(logValue(fields[i]))
+		j, err := json.Marshal(v)
+		if err != nil {
+			j, _ = json.Marshal(logValue(v))
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(j)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Format a message. The time and level are left out if t is zero,
+// for syslog which has them already.
+func formatLog(format string, level int, t time.Time, msg string, fields []interface{}) string {
+	switch format {
+	case "json":
+		f := []interface{}{}
+		if !t.IsZero() {
+			f = append(f, "time", t.Format(time.RFC3339Nano), "level", levelNames[level])
+		}
+		f = append(f, "msg", msg)
+		return formatJson(append(f, fields...))
+	case "logfmt":
+		f := []interface{}{}
+		if !t.IsZero() {
+			f = append(f, "time", t.Format(time.RFC3339Nano), "level", levelNames[level])
+		}
+		f = append(f, "msg", msg)
+		return formatLogfmt(append(f, fields...))
+	}
+	s := msg
+	if len(fields) > 0 {
+		s += " " + formatLogfmt(fields)
+	}
+	if !t.IsZero() {
+		prefix := progname
+		if level != levelInfo {
+			prefix += ": " + levelNames[level]
+		}
+		s = fmt.Sprintf("%s %s: %s", t.Format(timeFmt), prefix, s)
+	}
+	return s
+}
+
+type streamSink struct {
+	w		io.Writer
+	format		string
+}
+
+func (s *streamSink) write(level int, t time.Time, msg string, fields []interface{}) error {
+	_, err := io.WriteString(s.w, formatLog(s.format, level, t, msg, fields) + "\n")
+	return err
+}
+
+func (s *streamSink) Close() error {
+	if fh, ok := s.w.(*os.File); ok && fh != os.Stderr && fh != os.Stdout {
+		return fh.Close()
+	}
+	return nil
+}
+
+type syslogSink struct {
+	w		*syslog.Writer
+	format		string
+}
+
+func (s *syslogSink) write(level int, t time.Time, msg string, fields []interface{}) error {
+	m := formatLog(s.format, level, time.Time{}, msg, fields)
+	switch level {
+	case levelError:
+		return s.w.Err(m)
+	case levelWarn:
+		return s.w.Warning(m)
+	case levelInfo:
+		return s.w.Info(m)
+	}
+	return s.w.Debug(m)
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// The native journald protocol: a datagram with one FIELD=value
+// per line. Values with a newline are sent as the field name, a
+// newline, a 64 bit little endian length and the value.
+const journalSocket = "/run/systemd/journal/socket"
+
+type journalSink struct {
+	conn		*net.UnixConn
+}
+
+var journalPriority = []int{ 3, 4, 6, 7 }
+
+func journalField(b []byte, name string, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(b, name + "=" + value + "\n"...)
+	}
+	b = append(b, name + "\n"...)
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(value)))
+	b = append(b, l[:]...)
+	return append(b, value + "\n"...)
+}
+
+// webdav method -> WEBDAV_METHOD
+func journalName(key string) string {
+	b := []byte(strings.ToUpper("webdav_" + key))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (s *journalSink) message(level int, msg string, fields []interface{}) []byte {
+	b := journalField(nil, "MESSAGE", formatLog("text", level, time.Time{}, msg, fields))
+	b = journalField(b, "PRIORITY", strconv.Itoa(journalPriority[level]))
+	b = journalField(b, "SYSLOG_IDENTIFIER", progname)
+	names := []string{}
+	values := map[string]string{}
+	for i := 0; i + 1 < len(fields); i += 2 {
+		n := journalName(logValue(fields[i]))
+		names = append(names, n)
+		values[n] = logValue(fields[i+1])
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		b = journalField(b, n, values[n])
+	}
+	return b
+}
+
+func (s *journalSink) write(level int, t time.Time, msg string, fields []interface{}) error {
+	_, err := s.conn.Write(s.message(level, msg, fields))
+	return err
+}
+
+func (s *journalSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatLog(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := []interface{}{ "method", "GET", "path", "/a b", "status", 500, "latency", 1500 * time.Millisecond }
+	for _, tc := range []struct { format, want string }{
+		{ "text", `2020-01-02 03:04:05 webdavfs: error: request failed method=GET path="/a b" status=500 latency=1.5s` },
+		{ "logfmt", `time=2020-01-02T03:04:05Z level=error msg="request failed" method=GET path="/a b" status=500 latency=1.5s` },
+		{ "json", `{"time":"2020-01-02T03:04:05Z","level":"error","msg":"request failed","method":"GET","path":"/a b","status":500,"latency":1.5}` },
+	} {
+		saveName := progname
+		progname = "webdavfs"
+		got := formatLog(tc.format, levelError, tm, "request failed", fields)
+		progname = saveName
+		if got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestJournalMessage(t *testing.T) {
+	s := &journalSink{}
+	b := s.message(levelWarn, "two\nlines", []interface{}{ "http-status", 401 })
+	if !bytes.HasPrefix(b, []byte("MESSAGE\n\x19\x00\x00\x00\x00\x00\x00\x00two\nlines http-status=401\n")) {
+		t.Errorf("MESSAGE: %q", b)
+	}
+	for _, f := range []string{ "PRIORITY=4\n", "WEBDAV_HTTP_STATUS=401\n" } {
+		if !bytes.Contains(b, []byte(f)) {
+			t.Errorf("missing %q in %q", f, b)
+		}
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	saveLog := logOut
+	logOut = &logger{ level: levelWarn, sink: &streamSink{ w: &buf, format: "logfmt" } }
+	defer func() { logOut = saveLog }()
+
+	req := &http.Request{ Method: "PROPFIND", URL: &url.URL{ Path: "/dav/x" } }
+	logRequest(req, &http.Response{ StatusCode: 207 }, nil, time.Millisecond)
+	logRequest(req, &http.Response{ StatusCode: 404 }, errors.New("404 Not Found"), time.Millisecond)
+	logRequest(req, &http.Response{ StatusCode: 502 }, errors.New("502 Bad Gateway"), time.Millisecond)
+	logRequest(req, nil, errors.New("connection refused"), time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "level=error") || !strings.Contains(lines[0], "status=502") ||
+	    !strings.Contains(lines[0], "path=/dav/x") {
+		t.Errorf("502: %s", lines[0])
+	}
+	if strings.Contains(lines[1], "status=") || !strings.Contains(lines[1], `error="connection refused"`) {
+		t.Errorf("network error: %s", lines[1])
+	}
+}
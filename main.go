@@ -5,9 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	"github.com/pborman/getopt/v2"
 )
 
@@ -23,9 +22,9 @@ type Opts struct {
 	Sloppy		bool
 	Verbose		bool
 	RawOptions	string
+	Mounts		string
 }
 var opts = Opts{}
-var mountOpts MountOptions
 var progname = path.Base(os.Args[0])
 
 var DefaultPath = "/usr/local/bin:/usr/local/sbin:/bin:/sbin:/usr/bin:/usr/sbin"
@@ -35,12 +34,15 @@ func usage(err error, code int) {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
 	fmt.Fprintf(os.Stderr, "Usage: %s [-sfhV] [-D] [-T opts] [-F file] [-o opts] url mountpoint\n", progname)
+	fmt.Fprintf(os.Stderr, "       %s [-sfhV] [-D] [-T opts] [-F file] [-o opts] -m mountsfile\n", progname)
+	fmt.Fprintf(os.Stderr, "       %s ctl mountpoint command [args...]\n", progname)
 	fmt.Fprintf(os.Stderr, "       -s:           ignore unknown mount options\n")
 	fmt.Fprintf(os.Stderr, "       -f:           don't actually mount\n")
 	fmt.Fprintf(os.Stderr, "       -D:           daemonize (default when called as mount.*)\n")
 	fmt.Fprintf(os.Stderr, "       -T opts:      trace options\n")
 	fmt.Fprintf(os.Stderr, "       -F file:      trace file\n")
 	fmt.Fprintf(os.Stderr, "       -o opts:      mount options\n")
+	fmt.Fprintf(os.Stderr, "       -m file:      serve all mounts listed in file\n")
 	fmt.Fprintf(os.Stderr, "       -V|--version  print version\n")
 	fmt.Fprintf(os.Stderr, "       -h|--help     print help message\n")
 	os.Exit(code)
@@ -54,6 +56,9 @@ func fatal(err string) {
 // rebuild the os.Args array, string username/password.
 func rebuildOptions(url, path string) {
 	args := []string{ os.Args[0], url, path }
+	if mountsFile != "" {
+		args = []string{ os.Args[0], "-m" + mountsFile }
+	}
 	bools := ""
 	if opts.NoMtab {
 		bools += "n"
@@ -115,6 +120,10 @@ func main() {
 	}
 	file.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctlMain(os.Args[2:]))
+	}
+
 	version := false
 	help := false
 
@@ -127,6 +136,7 @@ func main() {
 	getopt.Flag(&opts.Fake, 'f', "do everything but the actual mount")
 	getopt.Flag(&opts.Verbose, 'v', "be verbose")
 	getopt.Flag(&opts.RawOptions, 'o', "mount options")
+	getopt.Flag(&opts.Mounts, 'm', "mounts file")
 	getopt.FlagLong(&version, "version", 'V', "show version").SetOptional()
 	getopt.FlagLong(&help, "help", 'h', "show this help").SetOptional()
 
@@ -156,186 +166,156 @@ func main() {
 		os.Exit(0)
 	}
 
-	// check that we have two non-option args at the end
-	if l < 3 || strings.HasPrefix(os.Args[l-2], "-") ||
-	            strings.HasPrefix(os.Args[l-1], "-") {
-		usage(nil, 1)
-	}
+	if opts.Mounts != "" {
+		// all mounts come from the mounts file.
+		if getopt.NArgs() != 0 {
+			usage(nil, 1)
+		}
+		mountsFile, _ = filepath.Abs(opts.Mounts)
+		defaults, err := parseMountOptions(opts.RawOptions, opts.Sloppy)
+		if err != nil {
+			fatal(err.Error())
+		}
+		mounts, err = readMountsFile(mountsFile, defaults)
+		if err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		// check that we have two non-option args at the end
+		if l < 3 || strings.HasPrefix(os.Args[l-2], "-") ||
+			    strings.HasPrefix(os.Args[l-1], "-") {
+			usage(nil, 1)
+		}
 
-	// now the two non-options left are url and mountpoint.
-	url := getopt.Arg(0)
-	mountpoint := getopt.Arg(1)
+		// now the two non-options left are url and mountpoint.
+		m := &mount{ url: getopt.Arg(0), mountpoint: getopt.Arg(1) }
+		m.cmdline, err = parseMountOptions(opts.RawOptions, opts.Sloppy)
+		if err != nil {
+			fatal(err.Error())
+		}
+		mounts = []*mount{ m }
+	}
 
-	// parse mount options, then add defaults.
-	mountOpts, err := parseMountOptions(opts.RawOptions, opts.Sloppy)
-	if err != nil {
-		fatal(err.Error())
+	// With more than one mount, errors say which one.
+	mountErr := func(m *mount, err error) string {
+		if len(mounts) > 1 {
+			return m.mountpoint + ": " + err.Error()
+		}
+		return err.Error()
 	}
-	if mountOpts.MaxConns == 0 {
-		mountOpts.MaxConns = 8
+	mountFatal := func(m *mount, err error) {
+		fatal(mountErr(m, err))
 	}
-	if mountOpts.MaxIdleConns == 0 {
-		mountOpts.MaxIdleConns = 8
+	for _, m := range mounts {
+		m.opts, err = m.loadConfig()
+		if err != nil {
+			mountFatal(m, err)
+		}
 	}
 
+	// Options that are not per mount are the same for all of them.
+	mountOpts := mounts[0].opts
+
 	if strings.HasPrefix(progname, "mount.") || opts.Daemonize {
 		if !IsDaemon() {
-			rebuildOptions(url, mountpoint)
+			rebuildOptions(mounts[0].url, mounts[0].mountpoint)
 			Daemonize()
 		}
 	}
 
-	err = traceOpts(opts.TraceOpts, opts.TraceFile)
+	err = traceOpts(mountOpts.Trace, mountOpts.TraceFile)
 	if err != nil {
 		fatal(err.Error())
 	}
-
-	config := WebdavFS{}
-	if os.Getuid() != 0 {
-		config.Uid = uint32(os.Getuid())
-		config.Gid = uint32(os.Getgid())
+	err = setupLogging(mountOpts.LogLevel, mountOpts.LogFormat, mountOpts.LogTo)
+	if err != nil {
+		fatal("log: " + err.Error())
 	}
-	config.Mode = mountOpts.Mode
 
-	// if running from fstab with "uid=123,gid=456" set some reasonable
-	// defaults so that that uid can actually access the files.
-	if os.Getuid() == 0 && mountOpts.Uid != 0 && mountOpts.Mode == 0 {
-		mountOpts.AllowOther = true
-		config.Mode = 0700
+	// for some reason we can end up without a $PATH ..
+	if os.Getenv("PATH") == "" {
+		os.Setenv("PATH", DefaultPath)
 	}
 
-	if mountOpts.Uid > 0 {
-		if os.Getuid() != 0 && os.Getuid() != int(mountOpts.Uid) {
-			fatal("uid option: permission denied")
+	if mountOpts.Har != "" {
+		err = startHar(mountOpts.Har, int(mountOpts.HarBody))
+		if err != nil {
+			fatal("har: " + err.Error())
 		}
-		config.Uid = mountOpts.Uid
+		defer stopHar()
 	}
-	if mountOpts.Gid > 0 {
-		if os.Getuid() != 0 {
-			ok := false
-			if os.Getgid() == int(mountOpts.Gid) {
-				ok = true
-			}
-			groups, err := os.Getgroups()
-			if err == nil {
-				for _, gr := range groups {
-					if gr == int(mountOpts.Gid) {
-						ok = true
-					}
-				}
-			}
-			if !ok {
-				fatal("gid option: permission denied")
-			}
+	if mountOpts.Record != "" {
+		err = startRecording(mountOpts.Record)
+		if err != nil {
+			fatal("record: " + err.Error())
 		}
-		config.Gid = mountOpts.Gid
+		defer stopRecording()
 	}
-
-	if mountOpts.AllowOther {
-		if !mountOpts.NoDefaultPermissions {
-			if config.Mode == 0 {
-				config.Mode = 0755
-			}
-			mountOpts.DefaultPermissions = true
-		} else {
-			if config.Mode == 0 {
-				config.Mode = 0777
-			}
+	for _, m := range mounts {
+		err = m.setup()
+		if err != nil {
+			mountFatal(m, err)
 		}
 	}
-
-	username := os.Getenv("WEBDAV_USERNAME")
-	password := os.Getenv("WEBDAV_PASSWORD")
-	cookie   := os.Getenv("WEBDAV_COOKIE")
-	if mountOpts.Username != "" {
-		username = mountOpts.Username
-	}
-	if mountOpts.Password != "" {
-		password = mountOpts.Password
-	}
-	if mountOpts.Cookie != "" {
-		cookie = mountOpts.Cookie
-	}
 	os.Unsetenv("WEBDAV_USERNAME")
 	os.Unsetenv("WEBDAV_PASSWORD")
 	os.Unsetenv("WEBDAV_COOKIE")
+	os.Unsetenv("WEBDAV_CRYPT_PASSWORD")
 
-	// for some reason we can end up without a $PATH ..
-	if os.Getenv("PATH") == "" {
-		os.Setenv("PATH", DefaultPath)
-	}
-
-	dav := &DavClient{
-		Url: url,
-		MaxConns: int(mountOpts.MaxConns),
-		MaxIdleConns: int(mountOpts.MaxIdleConns),
-		Username: username,
-		Password: password,
-		Cookie: cookie,
-		PutDisabled: mountOpts.ReadWriteDirOps,
-		IsSabre: mountOpts.SabreDavPartialUpdate,
-	}
-	err = dav.Mount()
-	if err != nil {
-		fatal(err.Error())
-	}
-	if !dav.CanPutRange() && !mountOpts.ReadOnly && !mountOpts.ReadWriteDirOps {
-		fmt.Fprintf(os.Stderr, "%s: no PUT Range support, mounting read-only\n", url)
-		mountOpts.ReadOnly = true
+	if mountOpts.Metrics != "" {
+		err = startMetrics(mountOpts.Metrics)
+		if err != nil {
+			fatal("metrics: " + err.Error())
+		}
 	}
 	if opts.Fake {
 		return
 	}
-
-	fmo := []fuse.MountOption{
-		fuse.FSName(url),
-		fuse.Subtype("webdavfs"),
-		fuse.VolumeName(url),
-		fuse.MaxReadahead(1024 * 1024),
-	}
-
-	if mountOpts.AllowRoot {
-		fmo = append(fmo, fuse.AllowRoot())
-	}
-	if mountOpts.AllowOther {
-		fmo = append(fmo, fuse.AllowOther())
-	}
-	if mountOpts.AsyncRead {
-		fmo = append(fmo, fuse.AsyncRead())
-	}
-	if mountOpts.DefaultPermissions {
-		fmo = append(fmo, fuse.DefaultPermissions())
-	}
-	if mountOpts.NonEmpty {
-		fmo = append(fmo, fuse.AllowNonEmptyMount())
-	}
-	if mountOpts.ReadOnly {
-		fmo = append(fmo, fuse.ReadOnly())
+	// A mount that fails is left out, the others are served. m.mount()
+	// cleans up after itself, so there is nothing to undo.
+	var mounted []*mount
+	for _, m := range mounts {
+		err = m.mount()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", progname, mountErr(m, err))
+			continue
+		}
+		mounted = append(mounted, m)
 	}
-
-	c, err := fuse.Mount(
-		mountpoint,
-		fmo...,
-	)
-	if err != nil {
-		fatal(err.Error())
+	if len(mounted) == 0 {
+		os.Exit(1)
 	}
-	defer c.Close()
+	failed := len(mounted) < len(mounts)
+	mounts = mounted
 
 	if IsDaemon() {
 		Detach()
 	}
 	traceredirectStdoutErr()
 
-	err = fs.Serve(c, NewFS(dav, config))
-	if err != nil {
-		fatal(err.Error())
+	go handleSignals()
+
+	// Serve until all of them are unmounted. If one of them fails,
+	// the others keep running; the exit status says something went
+	// wrong, here or when mounting.
+	errs := make(chan error, len(mounts))
+	for _, m := range mounts {
+		go func(m *mount) {
+			err := m.serve()
+			if err != nil && len(mounts) > 1 {
+				err = fmt.Errorf("%s: %v", m.mountpoint, err)
+			}
+			errs <- err
+		}(m)
 	}
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		fatal(err.Error())
+	for range mounts {
+		if err := <-errs; err != nil {
+			logErrorf("%v", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
 }
 
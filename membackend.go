@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// A Backend that keeps everything in memory. It behaves like a WebDAV
+// server that can do partial updates: DELETE of a directory removes
+// everything below it, and moving a file over another file replaces it.
+type memBackend struct {
+	Quota		uint64
+	mu		sync.Mutex
+	files		map[string]*memFile
+}
+
+type memFile struct {
+	Dnode
+	data		[]byte
+}
+
+func newMemBackend() *memBackend {
+	now := time.Now()
+	return &memBackend{
+		files: map[string]*memFile{
+			"/": { Dnode: Dnode{ IsDir: true, Mtime: now, Ctime: now } },
+		},
+	}
+}
+
+func memPath(path string) string {
+	return pathpkg.Clean("/" + path)
+}
+
+// Parent directory of path must exist. Called with the lock held.
+func (b *memBackend) parent(path string) (err error) {
+	dir := b.files[pathpkg.Dir(path)]
+	if dir == nil {
+		return fuse.ENOENT
+	}
+	if !dir.IsDir {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	return
+}
+
+// Everything below dir, sorted. Called with the lock held.
+func (b *memBackend) below(dir string) (paths []string) {
+	prefix := addSlash(dir)
+	for p := range b.files {
+		if p != "/" && strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return
+}
+
+func (b *memBackend) Stat(ctx context.Context, path string) (dnode Dnode, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.files[memPath(path)]
+	if f == nil {
+		err = fuse.ENOENT
+		return
+	}
+	return f.Dnode, nil
+}
+
+func (b *memBackend) Readdir(ctx context.Context, path string, fn func(Dnode)) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = memPath(path)
+	dir := b.files[path]
+	if dir == nil {
+		return fuse.ENOENT
+	}
+	if !dir.IsDir {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	d := dir.Dnode
+	d.Name = "."
+	fn(d)
+	for _, p := range b.below(path) {
+		if pathpkg.Dir(p) == path {
+			fn(b.files[p].Dnode)
+		}
+	}
+	return
+}
+
+func (b *memBackend) ReadTree(ctx context.Context, path string, fn func(Dnode)) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = memPath(path)
+	if b.files[path] == nil {
+		return fuse.ENOENT
+	}
+	for _, p := range b.below(path) {
+		d := b.files[p].Dnode
+		d.Name = strings.TrimPrefix(p, addSlash(path))
+		fn(d)
+	}
+	return
+}
+
+func (b *memBackend) GetRange(ctx context.Context, path string, offset int64, length int) (data []byte, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.files[memPath(path)]
+	if f == nil {
+		err = fuse.ENOENT
+		return
+	}
+	if f.IsDir {
+		err = fuse.Errno(syscall.EISDIR)
+		return
+	}
+	if offset < 0 || length < 0 {
+		return append([]byte{}, f.data...), nil
+	}
+	if offset >= int64(len(f.data)) {
+		return []byte{}, nil
+	}
+	end := offset + int64(length)
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return append([]byte{}, f.data[offset:end]...), nil
+}
+
+// Write data at offset. With truncate, the old contents are dropped first.
+func (b *memBackend) write(path string, data []byte, offset int64, truncate, create, excl bool) (created bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = memPath(path)
+	f := b.files[path]
+	now := time.Now()
+	switch {
+	case f != nil && f.IsDir:
+		err = fuse.Errno(syscall.EISDIR)
+	case f != nil && create && excl:
+		err = fuse.EEXIST
+	case f == nil && !create:
+		err = fuse.ENOENT
+	case f == nil:
+		err = b.parent(path)
+		if err == nil {
+			f = &memFile{ Dnode: Dnode{ Name: pathpkg.Base(path), Ctime: now } }
+			b.files[path] = f
+			created = true
+		}
+	}
+	if err != nil {
+		return
+	}
+	if truncate {
+		f.data = nil
+	}
+	if end := offset + int64(len(data)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end - int64(len(f.data)))...)
+	}
+	copy(f.data[offset:], data)
+	f.Size = uint64(len(f.data))
+	f.Mtime = now
+	return
+}
+
+func (b *memBackend) Put(ctx context.Context, path string, data []byte, create bool, excl bool) (bool, error) {
+	return b.write(path, data, 0, true, create, excl)
+}
+
+func (b *memBackend) PutRange(ctx context.Context, path string, data []byte, offset int64, create bool, excl bool) (bool, error) {
+	return b.write(path, data, offset, false, create, excl)
+}
+
+func (b *memBackend) Mkcol(ctx context.Context, path string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = memPath(path)
+	if b.files[path] != nil {
+		return fuse.EEXIST
+	}
+	if err = b.parent(path); err != nil {
+		return
+	}
+	now := time.Now()
+	b.files[path] = &memFile{ Dnode: Dnode{
+		Name: pathpkg.Base(path),
+		IsDir: true,
+		Mtime: now,
+		Ctime: now,
+	}}
+	return
+}
+
+func (b *memBackend) Delete(ctx context.Context, path string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = memPath(path)
+	if b.files[path] == nil || path == "/" {
+		return fuse.ENOENT
+	}
+	for _, p := range b.below(path) {
+		delete(b.files, p)
+	}
+	delete(b.files, path)
+	return
+}
+
+func (b *memBackend) Move(ctx context.Context, oldPath, newPath string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	oldPath, newPath = memPath(oldPath), memPath(newPath)
+	f := b.files[oldPath]
+	if f == nil || oldPath == "/" {
+		return fuse.ENOENT
+	}
+	if newPath == oldPath || strings.HasPrefix(newPath, addSlash(oldPath)) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if err = b.parent(newPath); err != nil {
+		return
+	}
+	if dst := b.files[newPath]; dst != nil {
+		if f.IsDir || dst.IsDir {
+			return fuse.EEXIST
+		}
+	}
+	for _, p := range b.below(oldPath) {
+		b.files[newPath + p[len(oldPath):]] = b.files[p]
+		delete(b.files, p)
+	}
+	delete(b.files, oldPath)
+	f.Name = pathpkg.Base(newPath)
+	b.files[newPath] = f
+	return
+}
+
+func (b *memBackend) Sync(ctx context.Context, path string) error {
+	return nil
+}
+
+func (b *memBackend) Statfs(ctx context.Context) (used, free uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Quota == 0 {
+		return
+	}
+	for _, f := range b.files {
+		used += f.Size
+	}
+	if used < b.Quota {
+		free = b.Quota - used
+	}
+	return
+}
+
+func (b *memBackend) Checksums(ctx context.Context, path string) (sums davclient.Checksums, err error) {
+	data, err := b.GetRange(ctx, path, -1, -1)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	return davclient.Checksums{ "SHA256": hex.EncodeToString(sum[:]) }, nil
+}
+
+func (b *memBackend) NewUpload(path string) davclient.Uploader {
+	return nil
+}
+
+func (b *memBackend) Caps() Caps {
+	return Caps{ PutRange: true }
+}
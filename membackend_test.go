@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// The FUSE handlers on top of the in-memory backend, no HTTP involved.
+func TestMemFS(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemBackend()
+	mem.Quota = 1 << 20
+	f := NewFS(mem, WebdavFS{ Mode: 0755, Verify: true })
+	root := f.root
+
+	nf, err := create(t, root, "a.txt", fuse.OpenExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := create(t, root, "a.txt", fuse.OpenExclusive); errnoOf(err) != syscall.EEXIST {
+		t.Errorf("exclusive create of existing file: %v", err)
+	}
+	if err := write(t, nf, 0, "hello, world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(t, nf, 7, "there"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nf.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Errorf("flush with verify: %v", err)
+	}
+	if data, err := read(t, nf, 0, 100); err != nil || data != "hello, there" {
+		t.Errorf("read: %q, %v", data, err)
+	}
+	if err := ftruncate(t, nf, 5); errnoOf(err) != syscall.ERANGE {
+		t.Errorf("truncate to 5: %v", err)
+	}
+	if err := ftruncate(t, nf, 0); err != nil {
+		t.Errorf("truncate to 0: %v", err)
+	}
+
+	n, err := root.Mkdir(ctx, &fuse.MkdirRequest{ Name: "d", Mode: 0755 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := n.(*Node)
+	if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{ Name: "d" }); errnoOf(err) != syscall.EEXIST {
+		t.Errorf("mkdir of existing directory: %v", err)
+	}
+	err = root.Rename(ctx, &fuse.RenameRequest{ OldName: "a.txt", NewName: "b.txt" }, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(t, root)
+	if names := readdir(t, root); !hasNames(names, "d") {
+		t.Errorf("readdir /: %v", names)
+	}
+	if names := readdir(t, dir); !hasNames(names, "b.txt") {
+		t.Errorf("readdir /d: %v", names)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{ Name: "d", Dir: true }); errnoOf(err) != syscall.ENOTEMPTY {
+		t.Errorf("rmdir of non-empty directory: %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{ Name: "d" }); errnoOf(err) != syscall.EISDIR {
+		t.Errorf("unlink of directory: %v", err)
+	}
+
+	resp := &fuse.StatfsResponse{}
+	if err := f.Statfs(ctx, &fuse.StatfsRequest{}, resp); err != nil || resp.Blocks != 256 {
+		t.Errorf("statfs: %+v, %v", resp, err)
+	}
+}
+
+// Two mounts in one process do not share nodes or options.
+func TestMemFSIndependent(t *testing.T) {
+	a := NewFS(newMemBackend(), WebdavFS{ Mode: 0755 })
+	b := NewFS(newMemBackend(), WebdavFS{ Mode: 0755 })
+	if _, err := create(t, a.root, "a.txt", fuse.OpenExclusive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookup(t, b.root, "a.txt"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("file of one mount seen in the other: %v", err)
+	}
+	setTunables(a, &MountOptions{ AttrCache: 5, AttrCacheSet: true })
+	if a.attrValidTime != 5 * time.Second || b.attrValidTime != defAttrValidTime {
+		t.Errorf("attrcache: %v %v", a.attrValidTime, b.attrValidTime)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus metrics, in the text exposition format, served on
+// http://ADDR/metrics when the metrics=ADDR mount option is set.
+// ADDR is a port (bound to localhost), host:port, or the path of
+// a unix socket.
+
+var latencyBuckets = []float64{ .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30 }
+
+type histogram struct {
+	counts		[]uint64
+	count		uint64
+	sum		float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// The metrics of one mount. They are reported with a "mount" label.
+type metricSet struct {
+	sync.Mutex
+	davRequests	map[[2]string]uint64
+	davLatency	map[string]*histogram
+	fuseOps		map[string]uint64
+	fuseErrors	map[string]uint64
+	fuseLatency	map[string]*histogram
+	cache		map[[2]string]uint64
+	bytesRead	uint64
+	bytesWritten	uint64
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		davRequests: map[[2]string]uint64{},
+		davLatency: map[string]*histogram{},
+		fuseOps: map[string]uint64{},
+		fuseErrors: map[string]uint64{},
+		fuseLatency: map[string]*histogram{},
+		cache: map[[2]string]uint64{},
+	}
+}
+
+// Set by startMetrics while client hooks may already be running,
+// so it is only used atomically.
+var metricsOn int32
+
+func metricsEnabled() bool {
+	return atomic.LoadInt32(&metricsOn) != 0
+}
+
+func setMetricsEnabled(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&metricsOn, v)
+}
+
+func observe(m map[string]*histogram, key string, d time.Duration) {
+	h := m[key]
+	if h == nil {
+		h = &histogram{}
+		m[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// A request to the server. status is the HTTP status, or 0 if the
+// request failed before there was one.
+func (ms *metricSet) davRequest(method string, status int, d time.Duration) {
+	if !metricsEnabled() || ms == nil {
+		return
+	}
+	st := "error"
+	if status > 0 {
+		st = strconv.Itoa(status)
+	}
+	ms.Lock()
+	ms.davRequests[[2]string{ method, st }]++
+	observe(ms.davLatency, method, d)
+	ms.Unlock()
+}
+
+// Called as "defer nd.fs.metrics.fuseOp(op, time.Now(), &err)".
+func (ms *metricSet) fuseOp(op string, start time.Time, err *error) {
+	if !metricsEnabled() || ms == nil {
+		return
+	}
+	ms.Lock()
+	ms.fuseOps[op]++
+	if err != nil && *err != nil {
+		ms.fuseErrors[op]++
+	}
+	observe(ms.fuseLatency, op, time.Since(start))
+	ms.Unlock()
+}
+
+func (ms *metricSet) cacheLookup(name string, hit bool) {
+	if !metricsEnabled() || ms == nil {
+		return
+	}
+	res := "miss"
+	if hit {
+		res = "hit"
+	}
+	ms.Lock()
+	ms.cache[[2]string{ name, res }]++
+	ms.Unlock()
+}
+
+func (ms *metricSet) bytes(written bool, n int) {
+	if !metricsEnabled() || ms == nil {
+		return
+	}
+	if written {
+		atomic.AddUint64(&ms.bytesWritten, uint64(n))
+	} else {
+		atomic.AddUint64(&ms.bytesRead, uint64(n))
+	}
+}
+
+func writeHistograms(w io.Writer, name, mnt, label string, m map[string]*histogram) {
+	for _, key := range sortedKeys(m) {
+		h := m[key]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{mount=%q,%s=%q,le=\"%g\"} %d\n", name, mnt, label, key, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{mount=%q,%s=%q,le=\"+Inf\"} %d\n", name, mnt, label, key, h.count)
+		fmt.Fprintf(w, "%s_sum{mount=%q,%s=%q} %g\n", name, mnt, label, key, h.sum)
+		fmt.Fprintf(w, "%s_count{mount=%q,%s=%q} %d\n", name, mnt, label, key, h.count)
+	}
+}
+
+func sortedKeys(m map[string]*histogram) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func sortedPairs(m map[[2]string]uint64) (keys [][2]string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return
+}
+
+// All series of a metric are written together, one mount after the other.
+func writeMetrics(w io.Writer) {
+	for _, m := range mounts {
+		m.fs.metrics.Lock()
+		defer m.fs.metrics.Unlock()
+	}
+
+	fmt.Fprintf(w, "# HELP webdavfs_dav_requests_total WebDAV requests by method and status.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_dav_requests_total counter\n")
+	for _, m := range mounts {
+		ms := m.fs.metrics
+		for _, k := range sortedPairs(ms.davRequests) {
+			fmt.Fprintf(w, "webdavfs_dav_requests_total{mount=%q,method=%q,status=%q} %d\n",
+				m.mountpoint, k[0], k[1], ms.davRequests[k])
+		}
+	}
+	fmt.Fprintf(w, "# HELP webdavfs_dav_request_duration_seconds WebDAV request latency.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_dav_request_duration_seconds histogram\n")
+	for _, m := range mounts {
+		writeHistograms(w, "webdavfs_dav_request_duration_seconds", m.mountpoint, "method", m.fs.metrics.davLatency)
+	}
+
+	fmt.Fprintf(w, "# HELP webdavfs_dav_requests_in_flight WebDAV requests in progress.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_dav_requests_in_flight gauge\n")
+	for _, m := range mounts {
+		inFlight, _ := m.client.Load()
+		fmt.Fprintf(w, "webdavfs_dav_requests_in_flight{mount=%q} %d\n", m.mountpoint, inFlight)
+	}
+	fmt.Fprintf(w, "# HELP webdavfs_dav_queue_length Requests waiting for a connection slot (maxconns).\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_dav_queue_length gauge\n")
+	for _, m := range mounts {
+		_, waiting := m.client.Load()
+		fmt.Fprintf(w, "webdavfs_dav_queue_length{mount=%q} %d\n", m.mountpoint, waiting)
+	}
+
+	fmt.Fprintf(w, "# HELP webdavfs_read_bytes_total Bytes of file data read from the server.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_read_bytes_total counter\n")
+	for _, m := range mounts {
+		fmt.Fprintf(w, "webdavfs_read_bytes_total{mount=%q} %d\n", m.mountpoint,
+			atomic.LoadUint64(&m.fs.metrics.bytesRead))
+	}
+	fmt.Fprintf(w, "# HELP webdavfs_written_bytes_total Bytes of file data written to the server.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_written_bytes_total counter\n")
+	for _, m := range mounts {
+		fmt.Fprintf(w, "webdavfs_written_bytes_total{mount=%q} %d\n", m.mountpoint,
+			atomic.LoadUint64(&m.fs.metrics.bytesWritten))
+	}
+
+	fmt.Fprintf(w, "# HELP webdavfs_cache_requests_total Cache lookups by cache and result.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_cache_requests_total counter\n")
+	for _, m := range mounts {
+		ms := m.fs.metrics
+		for _, k := range sortedPairs(ms.cache) {
+			fmt.Fprintf(w, "webdavfs_cache_requests_total{mount=%q,cache=%q,result=%q} %d\n",
+				m.mountpoint, k[0], k[1], ms.cache[k])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP webdavfs_fuse_ops_total FUSE operations.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_fuse_ops_total counter\n")
+	for _, m := range mounts {
+		ms := m.fs.metrics
+		for _, op := range sortedKeys(ms.fuseLatency) {
+			fmt.Fprintf(w, "webdavfs_fuse_ops_total{mount=%q,op=%q} %d\n", m.mountpoint, op, ms.fuseOps[op])
+		}
+	}
+	fmt.Fprintf(w, "# HELP webdavfs_fuse_errors_total FUSE operations that returned an error.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_fuse_errors_total counter\n")
+	for _, m := range mounts {
+		ms := m.fs.metrics
+		for _, op := range sortedKeys(ms.fuseLatency) {
+			fmt.Fprintf(w, "webdavfs_fuse_errors_total{mount=%q,op=%q} %d\n", m.mountpoint, op, ms.fuseErrors[op])
+		}
+	}
+	fmt.Fprintf(w, "# HELP webdavfs_fuse_op_duration_seconds FUSE operation latency.\n")
+	fmt.Fprintf(w, "# TYPE webdavfs_fuse_op_duration_seconds histogram\n")
+	for _, m := range mounts {
+		writeHistograms(w, "webdavfs_fuse_op_duration_seconds", m.mountpoint, "op", m.fs.metrics.fuseLatency)
+	}
+}
+
+// A unix socket that is left over from an earlier run is removed,
+// but nothing else.
+func metricsListen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "/") {
+		if fi, err := os.Lstat(addr); err == nil {
+			if fi.Mode() & os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s: exists and is not a socket", addr)
+			}
+			os.Remove(addr)
+		}
+		return net.Listen("unix", addr)
+	}
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = "127.0.0.1:" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+func startMetrics(addr string) error {
+	l, err := metricsListen(addr)
+	if err != nil {
+		return err
+	}
+	setMetricsEnabled(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go http.Serve(l, mux)
+	return nil
+}
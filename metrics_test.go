@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	setMetricsEnabled(true)
+	saved := mounts
+	defer func() {
+		setMetricsEnabled(false)
+		mounts = saved
+	}()
+	a := &mount{ mountpoint: "/mnt/a", client: &davclient.Client{}, fs: &WebdavFS{ metrics: newMetricSet() } }
+	b := &mount{ mountpoint: "/mnt/b", client: &davclient.Client{}, fs: &WebdavFS{ metrics: newMetricSet() } }
+	mounts = []*mount{ a, b }
+
+	ms := a.fs.metrics
+	ms.davRequest("PROPFIND", 207, 30 * time.Millisecond)
+	ms.davRequest("PROPFIND", 207, 2 * time.Second)
+	ms.davRequest("GET", 0, time.Millisecond)
+	ms.cacheLookup("stat", true)
+	ms.cacheLookup("stat", false)
+	ms.bytes(false, 100)
+	err := errors.New("failed")
+	ms.fuseOp("Lookup", time.Now(), &err)
+	b.fs.metrics.davRequest("PROPFIND", 207, time.Millisecond)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`webdavfs_dav_requests_total{mount="/mnt/a",method="PROPFIND",status="207"} 2`,
+		`webdavfs_dav_requests_total{mount="/mnt/a",method="GET",status="error"} 1`,
+		`webdavfs_dav_requests_total{mount="/mnt/b",method="PROPFIND",status="207"} 1`,
+		`webdavfs_dav_request_duration_seconds_bucket{mount="/mnt/a",method="PROPFIND",le="0.05"} 1`,
+		`webdavfs_dav_request_duration_seconds_bucket{mount="/mnt/a",method="PROPFIND",le="2.5"} 2`,
+		`webdavfs_dav_request_duration_seconds_count{mount="/mnt/a",method="PROPFIND"} 2`,
+		`webdavfs_dav_requests_in_flight{mount="/mnt/b"} 0`,
+		`webdavfs_cache_requests_total{mount="/mnt/a",cache="stat",result="hit"} 1`,
+		`webdavfs_cache_requests_total{mount="/mnt/a",cache="stat",result="miss"} 1`,
+		`webdavfs_read_bytes_total{mount="/mnt/a"} 100`,
+		`webdavfs_read_bytes_total{mount="/mnt/b"} 0`,
+		`webdavfs_fuse_ops_total{mount="/mnt/a",op="Lookup"} 1`,
+		`webdavfs_fuse_errors_total{mount="/mnt/a",op="Lookup"} 1`,
+	} {
+		if !strings.Contains(out, want + "\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if n := strings.Count(out, "# TYPE webdavfs_dav_requests_total "); n != 1 {
+		t.Errorf("TYPE line for webdavfs_dav_requests_total %d times", n)
+	}
+}
+
+func TestMetricsListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a stale socket is replaced.
+	sock := filepath.Join(dir, "metrics.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = metricsListen(sock); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	l.Close()
+
+	// anything else is left alone.
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0644)
+	if _, err = metricsListen(file); err == nil {
+		t.Error("listening on a regular file succeeded")
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "data" {
+		t.Error("regular file was removed")
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// One process can serve several mounts, listed in a mounts file that
+// is given with -m. Every mount has its own client, node tree, options
+// and credentials. Clients of the same server share their connection
+// pool.
+//
+// The mounts file has mount options like a config file, followed by a
+// section per mount:
+//
+//	# for all mounts
+//	credhelper = pass show dav
+//	uid = 1000
+//
+//	[/mnt/dav/home]
+//	url = https://dav.example.com/home/
+//
+//	[/mnt/dav/projects]
+//	url = https://dav.example.com/projects/
+//	ro
+//
+// Options that are not per mount, like trace= and metrics=, can only
+// be set before the first section, or in a config= file named there.
+
+type mount struct {
+	url		string
+	mountpoint	string
+	// Options from -o or the mounts file, before the config file.
+	cmdline		MountOptions
+	// config= was set in the section of this mount.
+	ownConfig	bool
+	opts		MountOptions
+	client		*davclient.Client
+	fs		*WebdavFS
+	conn		*fuse.Conn
+	server		*fs.Server
+	ctl		net.Listener
+	// Changed by a reload while Reauth reads them, see credSource.
+	credMutex	sync.Mutex
+	credFile	string
+	credHelper	string
+}
+
+// The mounts of this process, in the order they were mounted.
+var mounts []*mount
+
+// Set by -m, and read again on reload.
+var mountsFile string
+
+var processOptions = map[string]bool{
+	"trace":	true,
+	"tracefile":	true,
+	"log":		true,
+	"logformat":	true,
+	"logto":	true,
+	"har":		true,
+	"harbody":	true,
+	"record":	true,
+	"metrics":	true,
+}
+
+// Read a mounts file. The options in defaults come first, then the
+// ones at the top of the file, then the ones in the section.
+func readMountsFile(file string, defaults MountOptions) (ms []*mount, err error) {
+	var m *mount
+	seen := map[string]bool{}
+	err = configLines(file, func(k, v string) error {
+		if strings.HasPrefix(k, "[") && strings.HasSuffix(k, "]") && v == "" {
+			mp := strings.TrimSpace(k[1:len(k)-1])
+			if mp == "" {
+				return errors.New("empty mountpoint")
+			}
+			mp, _ = filepath.Abs(mp)
+			if seen[mp] {
+				return errors.New(mp + ": mounted twice")
+			}
+			seen[mp] = true
+			m = &mount{ mountpoint: mp, cmdline: defaults }
+			ms = append(ms, m)
+			return nil
+		}
+		if m == nil {
+			if k == "url" {
+				return errors.New("url: not in a [mountpoint] section")
+			}
+			return defaults.set(k, v, false)
+		}
+		if processOptions[k] {
+			return errors.New(k + ": only allowed before the first [mountpoint]")
+		}
+		if k == "url" {
+			m.url = v
+			return nil
+		}
+		if k == "config" {
+			m.ownConfig = true
+		}
+		return m.cmdline.set(k, v, false)
+	})
+	if err != nil {
+		return
+	}
+	if len(ms) == 0 {
+		err = errors.New(file + ": no mounts")
+	}
+	for _, m := range ms {
+		if m.url == "" {
+			err = errors.New(file + ": " + m.mountpoint + ": no url")
+			return
+		}
+	}
+	return
+}
+
+// The options of this mount: the command line or mounts file, then
+// the config file, then defaults.
+func (m *mount) loadConfig() (mo MountOptions, err error) {
+	mo = m.cmdline
+	if mo.Trace == "" {
+		mo.Trace = opts.TraceOpts
+	}
+	if mo.TraceFile == "" {
+		mo.TraceFile = opts.TraceFile
+	}
+	if mo.Config != "" {
+		mo.Config, _ = filepath.Abs(mo.Config)
+		err = readConfigFile(mo.Config, &mo, m.ownConfig)
+		if err != nil {
+			return
+		}
+	}
+	// We might be re-executed as a daemon, so make paths absolute.
+	for _, p := range []*string{ &mo.Credentials, &mo.CACert, &mo.ClientCert, &mo.ClientKey } {
+		if *p != "" {
+			*p, _ = filepath.Abs(*p)
+		}
+	}
+	if mo.MaxConns == 0 {
+		mo.MaxConns = 8
+	}
+	if mo.MaxIdleConns == 0 {
+		mo.MaxIdleConns = 8
+	}
+	if mo.BackendRetry > 0 {
+		// retried by the backend layer, not per request as well.
+		if mo.RetriesSet && mo.Retries > 0 {
+			err = errors.New("retries and backendretry cannot both be set")
+			return
+		}
+		mo.Retries = 0
+	} else if !mo.RetriesSet {
+		mo.Retries = 3
+	}
+	return
+}
+
+// Where the credentials come from.
+func (m *mount) credSource() (file, helper string) {
+	m.credMutex.Lock()
+	defer m.credMutex.Unlock()
+	return m.credFile, m.credHelper
+}
+
+func (m *mount) setCredSource(file, helper string) {
+	m.credMutex.Lock()
+	m.credFile, m.credHelper = file, helper
+	m.credMutex.Unlock()
+}
+
+func (m *mount) getCredentials() (username, password, cookie string, err error) {
+	file, helper := m.credSource()
+	if helper != "" {
+		return runCredHelper(helper)
+	}
+	if file != "" {
+		return readCredentials(file)
+	}
+	err = errors.New("no credentials file or helper")
+	return
+}
+
+// Read the credentials file or run the helper again, and use the new
+// credentials if they changed. Used as Client.Reauth on a 401.
+func (m *mount) reloadCredentials() (changed bool, err error) {
+	username, password, cookie, err := m.getCredentials()
+	if err != nil {
+		return
+	}
+	changed = m.client.SetCredentials(username, password, cookie)
+	if changed {
+		logInfof("%s: reloaded credentials", m.client.Url)
+	}
+	return
+}
+
+// Everything up to the actual mount: check the options, connect to
+// the server, and build the filesystem.
+func (m *mount) setup() (err error) {
+	mo := &m.opts
+	url := m.url
+	var downErrno syscall.Errno
+	if mo.SoftErr != "" {
+		downErrno, err = parseErrno(mo.SoftErr)
+		if err != nil {
+			return errors.New("softerr: " + err.Error())
+		}
+	}
+	var errnoMap map[int]syscall.Errno
+	if mo.ErrnoMap != "" {
+		errnoMap, err = loadErrnoMap(mo.ErrnoMap)
+		if err != nil {
+			return
+		}
+	}
+
+	config := WebdavFS{ metrics: newMetricSet() }
+	if os.Getuid() != 0 {
+		config.Uid = uint32(os.Getuid())
+		config.Gid = uint32(os.Getgid())
+	}
+	config.Mode = mo.Mode
+	config.Verify = mo.Verify == "onclose"
+
+	// if running from fstab with "uid=123,gid=456" set some reasonable
+	// defaults so that that uid can actually access the files.
+	if os.Getuid() == 0 && mo.Uid != 0 && mo.Mode == 0 {
+		mo.AllowOther = true
+		config.Mode = 0700
+	}
+
+	if mo.Uid > 0 {
+		if os.Getuid() != 0 && os.Getuid() != int(mo.Uid) {
+			return errors.New("uid option: permission denied")
+		}
+		config.Uid = mo.Uid
+	}
+	if mo.Gid > 0 {
+		if os.Getuid() != 0 {
+			ok := false
+			if os.Getgid() == int(mo.Gid) {
+				ok = true
+			}
+			groups, err := os.Getgroups()
+			if err == nil {
+				for _, gr := range groups {
+					if gr == int(mo.Gid) {
+						ok = true
+					}
+				}
+			}
+			if !ok {
+				return errors.New("gid option: permission denied")
+			}
+		}
+		config.Gid = mo.Gid
+	}
+
+	if mo.AllowOther {
+		if !mo.NoDefaultPermissions {
+			if config.Mode == 0 {
+				config.Mode = 0755
+			}
+			mo.DefaultPermissions = true
+		} else {
+			if config.Mode == 0 {
+				config.Mode = 0777
+			}
+		}
+	}
+
+	username := os.Getenv("WEBDAV_USERNAME")
+	password := os.Getenv("WEBDAV_PASSWORD")
+	cookie   := os.Getenv("WEBDAV_COOKIE")
+	m.setCredSource(mo.Credentials, mo.CredHelper)
+	if mo.Credentials != "" || mo.CredHelper != "" {
+		username, password, cookie, err = m.getCredentials()
+		if err != nil {
+			return
+		}
+	}
+	if mo.Username != "" {
+		username = mo.Username
+	}
+	if mo.Password != "" {
+		password = mo.Password
+	}
+	if mo.Cookie != "" {
+		cookie = mo.Cookie
+	}
+	var secret []byte
+	if mo.Crypt {
+		secret, err = readCryptSecret(mo.CryptKeyFile)
+		if err != nil {
+			return
+		}
+	}
+
+	m.client = &davclient.Client{
+		Url: url,
+		MaxConns: int(mo.MaxConns),
+		MaxIdleConns: int(mo.MaxIdleConns),
+		Retries: int(mo.Retries),
+		TrustRedirects: mo.TrustRedirects,
+		Hard: mo.Hard,
+		DownErrno: downErrno,
+		ErrnoMap: errnoMap,
+		ProbeInterval: time.Duration(mo.ProbeInterval) * time.Second,
+		Timeout: time.Duration(mo.Timeout) * time.Second,
+		CACert: mo.CACert,
+		ClientCert: mo.ClientCert,
+		ClientKey: mo.ClientKey,
+		ShareTransport: true,
+		Username: username,
+		Password: password,
+		Cookie: cookie,
+		PutDisabled: mo.ReadWriteDirOps,
+		IsSabre: mo.SabreDavPartialUpdate,
+		NoChunking: mo.NoChunking,
+		NoTus: mo.NoTus,
+		ProbePutRange: mo.ProbePutRange,
+		ChunkSize: int(mo.ChunkSize) * 1024 * 1024,
+		RoundTrip: roundTrip,
+		Hooks: davHooks(config.metrics),
+	}
+	m.client.Reauth = func() bool {
+		if file, helper := m.credSource(); file == "" && helper == "" {
+			return false
+		}
+		changed, err := m.reloadCredentials()
+		if err != nil {
+			logErrorf("%s", err)
+		}
+		return changed
+	}
+	err = m.client.Connect(context.Background())
+	if err != nil {
+		return
+	}
+	if opts.Verbose && m.client.Url != stripLastSlash(url) {
+		fmt.Fprintf(os.Stderr, "%s: redirected to %s\n", url, m.client.Url)
+	}
+
+	var backend Backend = newDavBackend(m.client)
+	if mo.BackendRetry > 0 {
+		backend = newRetryBackend(backend, int(mo.BackendRetry) + 1, backendRetryDelay)
+	}
+	var crypt *Crypt
+	if mo.Crypt {
+		var salt []byte
+		salt, err = loadCryptSalt(context.Background(), backend)
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		crypt, err = NewCrypt(secret, salt)
+		if err != nil {
+			return
+		}
+		backend = newCryptBackend(backend, crypt)
+	}
+	if mo.BackendCache > 0 {
+		backend = newCacheBackend(backend, time.Duration(mo.BackendCache) * time.Second)
+	}
+	backend = newTraceBackend(backend)
+	caps := backend.Caps()
+	if !caps.PutRange && caps.Upload && opts.Verbose {
+		fmt.Fprintf(os.Stderr, "%s: no PUT Range support, only sequential writes\n", url)
+	}
+	if !caps.PutRange && !caps.Upload && !mo.ReadOnly && !mo.ReadWriteDirOps {
+		fmt.Fprintf(os.Stderr, "%s: no PUT Range support, mounting read-only\n", url)
+		mo.ReadOnly = true
+	}
+	m.fs = NewFS(backend, config)
+	m.fs.setPrefetchPaths(mo.Prefetch)
+	setTunables(m.fs, mo)
+	if mo.Trashbin && crypt != nil {
+		fmt.Fprintf(os.Stderr, "%s: trashbin: not supported with crypt, ignored\n", url)
+	} else if mo.Trashbin && !m.client.IsNextcloud {
+		fmt.Fprintf(os.Stderr, "%s: trashbin: not a Nextcloud server, ignored\n", url)
+	} else if mo.Trashbin {
+		setupTrashDirs(m.fs, m.client)
+	}
+	if !mo.NoSearch && crypt == nil {
+		setupSearchDir(m.fs, m.client)
+	}
+	return
+}
+
+// Start the control socket and mount the filesystem.
+func (m *mount) mount() (err error) {
+	mo := &m.opts
+	if mo.CtlSocket != "none" {
+		sock := mo.CtlSocket
+		if sock == "" {
+			dir := ctlSocketDir()
+			if err = os.MkdirAll(dir, 0700); err == nil {
+				err = checkCtlSocketDir(dir)
+			}
+			sock = filepath.Join(dir, ctlSocketName(m.mountpoint))
+		}
+		if err == nil {
+			err = m.startControl(sock)
+		}
+		if err != nil {
+			return errors.New("control socket: " + err.Error())
+		}
+	}
+
+	fmo := []fuse.MountOption{
+		fuse.FSName(m.url),
+		fuse.Subtype("webdavfs"),
+		fuse.VolumeName(m.url),
+		fuse.MaxReadahead(1024 * 1024),
+	}
+
+	if mo.AllowRoot {
+		fmo = append(fmo, fuse.AllowRoot())
+	}
+	if mo.AllowOther {
+		fmo = append(fmo, fuse.AllowOther())
+	}
+	if mo.AsyncRead {
+		fmo = append(fmo, fuse.AsyncRead())
+	}
+	if mo.DefaultPermissions {
+		fmo = append(fmo, fuse.DefaultPermissions())
+	}
+	if mo.NonEmpty {
+		fmo = append(fmo, fuse.AllowNonEmptyMount())
+	}
+	if mo.ReadOnly {
+		fmo = append(fmo, fuse.ReadOnly())
+	}
+
+	m.conn, err = fuse.Mount(m.mountpoint, fmo...)
+	if err != nil {
+		m.stopControl()
+	}
+	return
+}
+
+// Serve requests until the filesystem is unmounted.
+func (m *mount) serve() (err error) {
+	defer m.conn.Close()
+	defer m.stopControl()
+	m.server = fs.New(m.conn, nil)
+	err = m.server.Serve(m.fs)
+	if err != nil {
+		// Do not leave a dead mount behind.
+		fuse.Unmount(m.mountpoint)
+		return
+	}
+
+	// check if the mount process has an error to report
+	<-m.conn.Ready
+	return m.conn.MountError
+}
+
+// Apply reloaded options to the running mount.
+func (m *mount) reload(mo *MountOptions) (err error) {
+	// the retry layer decides about the per-request retries.
+	if mo.BackendRetry != m.opts.BackendRetry {
+		return errors.New("backendretry: cannot be changed by a reload")
+	}
+	setTunables(m.fs, mo)
+
+	err = m.client.Reload(davclient.Tunables{
+		Retries: int(mo.Retries),
+		Timeout: time.Duration(mo.Timeout) * time.Second,
+		MaxIdleConns: int(mo.MaxIdleConns),
+		CACert: mo.CACert,
+		ClientCert: mo.ClientCert,
+		ClientKey: mo.ClientKey,
+	})
+	if err != nil {
+		return
+	}
+
+	m.setCredSource(mo.Credentials, mo.CredHelper)
+	if mo.Credentials != "" || mo.CredHelper != "" {
+		_, err = m.reloadCredentials()
+	}
+	return
+}
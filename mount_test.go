@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Mount the in-process server through the kernel. The test is skipped
+// if there is no /dev/fuse or no fusermount.
+func fuseMount(t *testing.T, flavor string) (srv *davServer, dir string) {
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("FUSE not available: %v", err)
+	}
+	f.Close()
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("FUSE not available: no fusermount")
+	}
+
+	srv, root := testMount(t, flavor)
+	dir, err = ioutil.TempDir("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := fuse.Mount(dir, fuse.FSName("webdavfs-test"), fuse.Subtype("webdavfs"))
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("mount: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.Serve(c, root.fs)
+	}()
+	<-c.Ready
+	if c.MountError != nil {
+		t.Fatalf("mount: %v", c.MountError)
+	}
+	t.Cleanup(func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("unmount: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+		c.Close()
+		os.Remove(dir)
+	})
+	return
+}
+
+func TestMountFiles(t *testing.T) {
+	for _, flavor := range []string{ "apache", "sabre" } {
+		t.Run(flavor, func(t *testing.T) {
+			srv, dir := fuseMount(t, flavor)
+			fn := filepath.Join(dir, "a.txt")
+
+			if err := ioutil.WriteFile(fn, []byte("hello, world\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := srv.file("/a.txt"); data != "hello, world\n" {
+				t.Errorf("server has %q", data)
+			}
+			fh, err := os.OpenFile(fn, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fh.WriteAt([]byte("there"), 7); err != nil {
+				t.Fatal(err)
+			}
+			if err := fh.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := ioutil.ReadFile(fn); string(data) != "hello, there\n" || err != nil {
+				t.Errorf("read back: %q %v", data, err)
+			}
+			if err := os.Truncate(fn, 0); err != nil {
+				t.Fatal(err)
+			}
+			if fi, err := os.Stat(fn); err != nil || fi.Size() != 0 {
+				t.Errorf("after truncate: %v %v", fi, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "nothere")); !os.IsNotExist(err) {
+				t.Errorf("stat of missing file: %v", err)
+			}
+		})
+	}
+}
+
+func TestMountDirectories(t *testing.T) {
+	srv, dir := fuseMount(t, "apache")
+	srv.writeFile("/a.txt", "aaa")
+	sub := filepath.Join(dir, "sub")
+
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(sub, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := srv.file("/sub/b.txt"); data != "aaa" {
+		t.Errorf("after rename: %q", data)
+	}
+	names := func(d string) string {
+		fis, err := ioutil.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n []string
+		for _, fi := range fis {
+			n = append(n, fi.Name())
+		}
+		sort.Strings(n)
+		return strings.Join(n, " ")
+	}
+	if n := names(dir); n != "sub" {
+		t.Errorf("readdir: %s", n)
+	}
+	if n := names(sub); n != "b.txt" {
+		t.Errorf("readdir sub: %s", n)
+	}
+	if err := syscall.Rmdir(sub); err != syscall.ENOTEMPTY {
+		t.Errorf("rmdir of non-empty directory: %v", err)
+	}
+	if err := os.Remove(filepath.Join(sub, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(sub); err != nil {
+		t.Fatal(err)
+	}
+	if n := names(dir); n != "" {
+		t.Errorf("readdir after remove: %s", n)
+	}
+}
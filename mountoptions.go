@@ -3,6 +3,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 )
@@ -26,6 +28,48 @@ type MountOptions struct {
 	MaxConns		uint32
 	MaxIdleConns		uint32
 	SabreDavPartialUpdate	bool
+	ErrnoMap		string
+	Retries			uint32
+	RetriesSet		bool
+	TrustRedirects		bool
+	Hard			bool
+	SoftErr			string
+	ProbeInterval		uint32
+	NoChunking		bool
+	NoTus			bool
+	ProbePutRange		bool
+	Trashbin		bool
+	NoSearch		bool
+	Crypt			bool
+	CryptKeyFile		string
+	Verify			string
+	Prefetch		string
+	Metrics			string
+	Credentials		string
+	CtlSocket		string
+	Config			string
+	CredHelper		string
+	Trace			string
+	TraceFile		string
+	Timeout			uint32
+	StatCache		uint32
+	StatCacheSet		bool
+	DirCache		uint32
+	DirCacheSet		bool
+	AttrCache		uint32
+	AttrCacheSet		bool
+	CACert			string
+	ClientCert		string
+	ClientKey		string
+	LogLevel		string
+	LogFormat		string
+	LogTo			string
+	Har			string
+	HarBody			uint32
+	Record			string
+	ChunkSize		uint32
+	BackendCache		uint32
+	BackendRetry		uint32
 }
 
 func parseUInt32(v string, base int, name string, loc *uint32) (err error) {
@@ -47,51 +91,181 @@ func parseMountOptions(n string, sloppy bool) (mo MountOptions, err error) {
 		if len(a) > 1 {
 			v = a[1]
 		}
-		switch a[0] {
-		case "allow_root":
-			mo.AllowRoot = true
-		case "allow_other":
-			mo.AllowOther = true
-		case "default_permissions":
-			mo.DefaultPermissions = true
-		case "no_default_permissions":
-			mo.NoDefaultPermissions = true
-		case "ro":
-			mo.ReadOnly = true
-		case "rw":
-			mo.ReadWrite = true
-		case "rwdirops":
-			mo.ReadWriteDirOps = true
-		case "uid":
-			err = parseUInt32(v, 10, "uid", &mo.Uid)
-		case "gid":
-			err = parseUInt32(v, 10, "gid", &mo.Gid)
-		case "mode":
-			err = parseUInt32(v, 8, "mode", &mo.Mode)
-		case "cookie":
-			mo.Cookie = v
-		case "password":
-			mo.Password = v
-		case "username":
-			mo.Username = v
-		case "async_read":
-			mo.AsyncRead = true
-		case "nonempty":
-			mo.NonEmpty = true
-		case "maxconns":
-			err = parseUInt32(v, 10, "maxconns", &mo.MaxConns)
-		case "maxidleconns":
-			err = parseUInt32(v, 10, "maxidleconns", &mo.MaxIdleConns)
-		case "sabredav_partialupdate":
-			mo.SabreDavPartialUpdate = true
-		default:
-			if !sloppy {
-				err = errors.New(a[0] + ": unknown option")
-			}
+		err = mo.set(a[0], v, sloppy)
+		if err != nil {
+			return
 		}
+	}
+	return
+}
+
+// Call fn with the key and value of every line of a config file.
+// Empty lines and lines starting with '#' are skipped.
+func configLines(file string, fn func(k, v string) error) (err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		a := strings.SplitN(line, "=", 2)
+		v := ""
+		if len(a) > 1 {
+			v = strings.TrimSpace(a[1])
+		}
+		err = fn(strings.TrimSpace(a[0]), v)
 		if err != nil {
+			err = fmt.Errorf("%s line %d: %v", file, n + 1, err)
 			return
 		}
 	}
 	return
 }
+
+// A config file has one mount option per line. Values may contain
+// commas here, so this is also where trace= and credhelper= go.
+// A config file of just one mount of several cannot set the options
+// that are not per mount.
+func readConfigFile(file string, mo *MountOptions, perMount bool) (err error) {
+	return configLines(file, func(k, v string) error {
+		if perMount && processOptions[k] {
+			return errors.New(k + ": not allowed in the config file of one mount")
+		}
+		return mo.set(k, v, false)
+	})
+}
+
+func (mo *MountOptions) set(k, v string, sloppy bool) (err error) {
+	switch k {
+	case "allow_root":
+		mo.AllowRoot = true
+	case "allow_other":
+		mo.AllowOther = true
+	case "default_permissions":
+		mo.DefaultPermissions = true
+	case "no_default_permissions":
+		mo.NoDefaultPermissions = true
+	case "ro":
+		mo.ReadOnly = true
+	case "rw":
+		mo.ReadWrite = true
+	case "rwdirops":
+		mo.ReadWriteDirOps = true
+	case "uid":
+		err = parseUInt32(v, 10, "uid", &mo.Uid)
+	case "gid":
+		err = parseUInt32(v, 10, "gid", &mo.Gid)
+	case "mode":
+		err = parseUInt32(v, 8, "mode", &mo.Mode)
+	case "cookie":
+		mo.Cookie = v
+	case "password":
+		mo.Password = v
+	case "username":
+		mo.Username = v
+	case "async_read":
+		mo.AsyncRead = true
+	case "nonempty":
+		mo.NonEmpty = true
+	case "maxconns":
+		err = parseUInt32(v, 10, "maxconns", &mo.MaxConns)
+	case "maxidleconns":
+		err = parseUInt32(v, 10, "maxidleconns", &mo.MaxIdleConns)
+	case "sabredav_partialupdate":
+		mo.SabreDavPartialUpdate = true
+	case "errnomap":
+		mo.ErrnoMap = v
+	case "retries":
+		err = parseUInt32(v, 10, "retries", &mo.Retries)
+		mo.RetriesSet = true
+	case "trust_redirects":
+		mo.TrustRedirects = true
+	case "hard":
+		mo.Hard = true
+	case "soft":
+		mo.Hard = false
+	case "softerr":
+		mo.SoftErr = v
+	case "probeinterval":
+		err = parseUInt32(v, 10, "probeinterval", &mo.ProbeInterval)
+	case "nochunking":
+		mo.NoChunking = true
+	case "notus":
+		mo.NoTus = true
+	case "probe_putrange":
+		mo.ProbePutRange = true
+	case "trashbin":
+		mo.Trashbin = true
+	case "nosearch":
+		mo.NoSearch = true
+	case "crypt":
+		mo.Crypt = true
+	case "cryptkeyfile":
+		mo.Crypt = true
+		mo.CryptKeyFile = v
+	case "prefetch":
+		mo.Prefetch = v
+	case "metrics":
+		mo.Metrics = v
+	case "credentials":
+		mo.Credentials = v
+	case "ctlsocket":
+		mo.CtlSocket = v
+	case "verify":
+		if v != "onclose" {
+			err = errors.New("verify: unknown mode " + v)
+		}
+		mo.Verify = v
+	case "chunksize":
+		err = parseUInt32(v, 10, "chunksize", &mo.ChunkSize)
+	case "backendcache":
+		err = parseUInt32(v, 10, "backendcache", &mo.BackendCache)
+	case "backendretry":
+		err = parseUInt32(v, 10, "backendretry", &mo.BackendRetry)
+	case "config":
+		mo.Config = v
+	case "credhelper":
+		mo.CredHelper = v
+	case "trace":
+		mo.Trace = v
+	case "tracefile":
+		mo.TraceFile = v
+	case "timeout":
+		err = parseUInt32(v, 10, "timeout", &mo.Timeout)
+	case "statcache":
+		err = parseUInt32(v, 10, "statcache", &mo.StatCache)
+		mo.StatCacheSet = true
+	case "dircache":
+		err = parseUInt32(v, 10, "dircache", &mo.DirCache)
+		mo.DirCacheSet = true
+	case "attrcache":
+		err = parseUInt32(v, 10, "attrcache", &mo.AttrCache)
+		mo.AttrCacheSet = true
+	case "cacert":
+		mo.CACert = v
+	case "clientcert":
+		mo.ClientCert = v
+	case "clientkey":
+		mo.ClientKey = v
+	case "log":
+		mo.LogLevel = v
+	case "logformat":
+		mo.LogFormat = v
+	case "logto":
+		mo.LogTo = v
+	case "har":
+		mo.Har = v
+	case "harbody":
+		err = parseUInt32(v, 10, "harbody", &mo.HarBody)
+	case "record":
+		mo.Record = v
+	default:
+		if !sloppy {
+			err = errors.New(k + ": unknown option")
+		}
+	}
+	return
+}
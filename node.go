@@ -2,15 +2,14 @@
 package main
 
 import (
-	"os"
 	"runtime/debug"
-	"runtime/pprof"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/miquels/webdavfs/davclient"
 )
 
 const (
@@ -22,6 +21,7 @@ type Node struct {
 	Dnode
 	Atime		time.Time
 	LastStat	time.Time
+	ListTime	time.Time
 	DirCache	map[string]Dnode
 	DirCacheTime	time.Time
 	Inode		uint64
@@ -30,11 +30,14 @@ type Node struct {
 	Parent		*Node
 	Child		map[string]*Node
 	InUse		bool
-}
-
-var rootNode = &Node{
-	Inode:		1,
-	Child:		make(map[string]*Node),
+	upload		davclient.Uploader
+	uploadOff	int64
+	uploadMutex	sync.Mutex
+	// Like upload != nil, but under the node lock.
+	uploadBusy	bool
+	verifyRead	*verifier
+	verifyWrite	*verifier
+	fs		*WebdavFS
 }
 
 var EBUSY = fuse.Errno(syscall.EBUSY)
@@ -50,8 +53,6 @@ func (nd *Node) Lock() {
 		lockTimer = time.AfterFunc(2 * time.Second, func() {
 			tPrintf("LOCKERR (%s) Lock held longer than 2 seconds:\n%s",
 				name, stack)
-			tPrintf("== dump of all goroutines:")
-			pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
 		})
 	}
 	lockRef++
@@ -84,6 +85,10 @@ func (nd *Node) addNode(d Dnode, really bool) *Node {
 			n.InUse = true
 		}
 		n.LastStat = time.Now()
+		if n.uploadBusy {
+			// the server does not have all of the data yet.
+			d.Size = n.Size
+		}
 		n.Dnode = d
 		return n
 	}
@@ -93,6 +98,7 @@ func (nd *Node) addNode(d Dnode, really bool) *Node {
 		Parent: nd,
 		InUse: really,
 		LastStat: time.Now(),
+		fs: nd.fs,
 	}
 	if d.IsDir {
 		nn.Child = map[string]*Node{}
@@ -169,8 +175,27 @@ func (nd *Node) invalidateNode(name string) {
 	}
 }
 
-func lookupNode(path string) (de *Node) {
-	d := rootNode
+// After a partially failed DELETE or MOVE we do not know what
+// is left of a subtree. Mark all of it as stale and drop what we can.
+func (nd *Node) invalidateSubtree(name string) {
+	nn := nd.Child[name]
+	if nn == nil {
+		return
+	}
+	nn.markStale()
+	nn.invalidateThisNode()
+}
+
+func (nd *Node) markStale() {
+	nd.LastStat = time.Time{}
+	nd.ListTime = time.Time{}
+	for _, c := range nd.Child {
+		c.markStale()
+	}
+}
+
+func (fs *WebdavFS) lookupNode(path string) (de *Node) {
+	d := fs.root
 	if path != "/" {
 		pelem := strings.Split(path[1:], "/")
 		for _, n := range(pelem) {
@@ -201,6 +226,32 @@ func (de *Node) getPath() string {
 	return path
 }
 
+func stripLastSlash(s string) string {
+	l := len(s)
+	for l > 0 {
+		if s[l-1] != '/' {
+			return s[:l]
+		}
+		l--
+	}
+	return s
+}
+
+func addSlash(s string) string {
+	if len(s) > 0 && s[len(s)-1] != '/' {
+		s += "/"
+	}
+	return s
+}
+
+func joinPath(s1, s2 string) string {
+	if (len(s1) > 0 && s1[len(s1)-1] == '/') ||
+	   (len(s2) > 0 && s2[0] == '/') {
+		return s1 + s2
+	}
+	return s1 + "/" + s2
+}
+
 // no IO operations must be going on at this node or above.
 // perhaps use a global refcount as well - faster
 func (de *Node) doesIO() bool {
@@ -291,6 +342,7 @@ func (de *Node) incMetaRef(id fuse.RequestID) error {
 		}
 		de.Lock()
 	}
+	de.dirCacheInvalidate()
 	// dbgPrintf("node: incMetaRef %s@%p: ref now %d\n", de.Name, de, de.RefCount[RefMeta])
 	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// Subtrees listed in the prefetch= mount option are read with one
+// Depth: infinity PROPFIND on first access. The result fills the
+// directory caches of all nodes in the subtree, so that a walk of
+// the tree does not need a request per directory. Those caches are
+// fresh for dircache= seconds, like the attributes from any listing.
+
+// Colon separated list of paths, relative to the root of the mount.
+func (f *WebdavFS) setPrefetchPaths(s string) {
+	for _, p := range strings.Split(s, ":") {
+		if p == "" {
+			continue
+		}
+		if p[0] != '/' {
+			p = "/" + p
+		}
+		if p != "/" {
+			p = stripLastSlash(p)
+		}
+		f.prefetch[p] = true
+	}
+}
+
+// Prefetch the subtree at nd, if it is configured and the cache
+// is not fresh anymore. Called without the lock held.
+func (nd *Node) prefetch(ctx context.Context) {
+	f := nd.fs
+	if len(f.prefetch) == 0 || atomic.LoadInt32(&f.prefetchOff) != 0 {
+		return
+	}
+	path := nd.getPath()
+	if !f.prefetch[path] {
+		return
+	}
+	f.prefetchMutex.Lock()
+	defer f.prefetchMutex.Unlock()
+	nd.Lock()
+	fresh := nd.dirCacheFresh()
+	nd.Unlock()
+	if fresh {
+		return
+	}
+
+	// Entries by directory, relative to path.
+	listing := map[string][]Dnode{}
+	err := f.dav.ReadTree(ctx, path, func(d Dnode) {
+		dir := ""
+		if i := strings.LastIndex(d.Name, "/"); i >= 0 {
+			dir = d.Name[:i+1]
+			d.Name = d.Name[i+1:]
+		}
+		listing[dir] = append(listing[dir], d)
+	})
+	if err != nil {
+		if err == davclient.ErrFiniteDepth {
+			logInfof("%s: prefetch: %v, using Depth: 1", path, err)
+			atomic.StoreInt32(&f.prefetchOff, 1)
+		}
+		return
+	}
+	nd.Lock()
+	nd.fillDirCache("", listing, time.Now())
+	nd.Unlock()
+}
+
+func (nd *Node) fillDirCache(dir string, listing map[string][]Dnode, now time.Time) {
+	nd.DirCache = map[string]Dnode{}
+	nd.DirCacheTime = now
+	for _, d := range listing[dir] {
+		nd.DirCache[d.Name] = d
+		if d.IsDir {
+			nd.addNode(d, false).fillDirCache(dir + d.Name + "/", listing, now)
+		}
+	}
+}
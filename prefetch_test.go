@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+const treeResponse = `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+ <d:response><d:href>/dav/proj/</d:href>
+  <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+ <d:response><d:href>/dav/proj/src/</d:href>
+  <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+ <d:response><d:href>/dav/proj/src/main.go</d:href>
+  <d:propstat><d:prop><d:resourcetype/><d:getcontentlength>123</d:getcontentlength></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+ <d:response><d:href>/dav/proj/README</d:href>
+  <d:propstat><d:prop><d:resourcetype/><d:getcontentlength>7</d:getcontentlength></d:prop>
+  <d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+</d:multistatus>`
+
+func TestPrefetch(t *testing.T) {
+	finite := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" || r.Header.Get("Depth") != "infinity" {
+			t.Errorf("unexpected %s, depth %s", r.Method, r.Header.Get("Depth"))
+		}
+		if finite {
+			w.WriteHeader(403)
+			w.Write([]byte(`<?xml version="1.0"?><d:error xmlns:d="DAV:"><d:propfind-finite-depth/></d:error>`))
+			return
+		}
+		w.WriteHeader(207)
+		w.Write([]byte(treeResponse))
+	}))
+	defer srv.Close()
+
+	d := &davclient.Client{ Url: srv.URL + "/dav", Transport: srv.Client().Transport }
+	f := NewFS(newDavBackend(d), WebdavFS{})
+	root := f.root
+	ctx := context.Background()
+	f.setPrefetchPaths("proj/")
+
+	proj := root.addNode(Dnode{ Name: "proj", IsDir: true }, true)
+	proj.prefetch(ctx)
+
+	if !proj.dirCacheFresh() || len(proj.DirCache) != 2 {
+		t.Fatalf("proj: %v", proj.DirCache)
+	}
+	src := proj.getNode("src")
+	if src == nil || !src.dirCacheFresh() {
+		t.Fatal("src not prefetched")
+	}
+	if f := src.DirCache["main.go"]; f.Size != 123 || f.IsDir {
+		t.Errorf("main.go: %+v", f)
+	}
+
+	// The cache is fresh for dircache= seconds.
+	setTunables(f, &MountOptions{ DirCache: 0, DirCacheSet: true })
+	if proj.dirCacheFresh() {
+		t.Error("cache fresh with dircache=0")
+	}
+	setTunables(f, &MountOptions{ DirCache: 60, DirCacheSet: true })
+
+	// A change in a directory drops its cache.
+	src.dirCacheInvalidate()
+	if src.dirCacheFresh() || proj.dirCacheFresh() {
+		t.Error("cache still fresh after invalidate")
+	}
+
+	finite = true
+	proj.DirCache = nil
+	proj.prefetch(ctx)
+	if atomic.LoadInt32(&f.prefetchOff) == 0 || d.DepthInfinity() || proj.DirCache != nil {
+		t.Error("no fallback on propfind-finite-depth")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A session with a server can be recorded with the record=FILE option,
+// and played back later with a ReplayTransport. That turns a problem
+// with a server we have no access to into a local regression test.
+//
+// The file has one JSON object per request. Credentials are not
+// recorded, and URLs are stored without scheme and host, so that
+// the replay does not depend on them. Bodies are recorded up to
+// recordMaxBody bytes; a longer body is cut off and marked truncated.
+
+const recordMaxBody = 1024 * 1024
+
+type recordEntry struct {
+	Method		string		`json:"method"`
+	Url		string		`json:"url"`
+	Header		http.Header	`json:"header,omitempty"`
+	Body		string		`json:"body,omitempty"`
+	Body64		[]byte		`json:"body64,omitempty"`
+	Truncated	bool		`json:"truncated,omitempty"`
+	Status		int		`json:"status"`
+	RespHeader	http.Header	`json:"respHeader,omitempty"`
+	RespBody	string		`json:"respBody,omitempty"`
+	RespBody64	[]byte		`json:"respBody64,omitempty"`
+	RespTruncated	bool		`json:"respTruncated,omitempty"`
+}
+
+func setBody(s *string, b64 *[]byte, data []byte) {
+	if utf8.Valid(data) {
+		*s = string(data)
+	} else {
+		*b64 = data
+	}
+}
+
+func getBody(s string, b64 []byte) []byte {
+	if b64 != nil {
+		return b64
+	}
+	return []byte(s)
+}
+
+func redactHeader(hdr http.Header) http.Header {
+	h := http.Header{}
+	for k, v := range hdr {
+		if harRedact[k] {
+			v = []string{ "REDACTED" }
+		}
+		h[k] = v
+	}
+	return h
+}
+
+func requestUrl(req *http.Request) string {
+	return req.URL.RequestURI()
+}
+
+type recorder struct {
+	sync.Mutex
+	file		*os.File
+}
+
+var recordMutex sync.Mutex
+var rec *recorder
+
+func startRecording(file string) (err error) {
+	fh, err := unprivOpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	stopRecording()
+	recordMutex.Lock()
+	rec = &recorder{ file: fh }
+	recordMutex.Unlock()
+	return
+}
+
+func stopRecording() {
+	recordMutex.Lock()
+	r := rec
+	rec = nil
+	recordMutex.Unlock()
+	if r != nil {
+		r.Lock()
+		r.file.Close()
+		r.Unlock()
+	}
+}
+
+func getRecorder() *recorder {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+	return rec
+}
+
+func (r *recorder) add(e *recordEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.Lock()
+	r.file.Write(append(b, '\n'))
+	r.Unlock()
+}
+
+// Reads at most recordMaxBody bytes of body, and reports if there was more.
+func readMaxBody(body io.Reader) (data []byte, truncated bool) {
+	data, _ = ioutil.ReadAll(io.LimitReader(body, recordMaxBody + 1))
+	if len(data) > recordMaxBody {
+		data, truncated = data[:recordMaxBody], true
+	}
+	return
+}
+
+// Records the request and the response. The entry is written when
+// the response body has been read or closed.
+type recordTransport struct {
+	next		http.RoundTripper
+	r		*recorder
+}
+
+// The response body; it is passed through as it is read.
+type recordBody struct {
+	io.ReadCloser
+	r		*recorder
+	entry		*recordEntry
+	body		[]byte
+	truncated	bool
+	once		sync.Once
+}
+
+func (b *recordBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if room := recordMaxBody - len(b.body); n > room {
+		b.body = append(b.body, p[:room]...)
+		b.truncated = true
+	} else {
+		b.body = append(b.body, p[:n]...)
+	}
+	if err != nil {
+		b.finish()
+	}
+	return
+}
+
+func (b *recordBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *recordBody) finish() {
+	b.once.Do(func() {
+		e := b.entry
+		setBody(&e.RespBody, &e.RespBody64, b.body)
+		e.RespTruncated = b.truncated
+		b.r.add(e)
+	})
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	e := &recordEntry{
+		Method: req.Method,
+		Url: requestUrl(req),
+		Header: redactHeader(req.Header),
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, truncated := readMaxBody(body)
+			body.Close()
+			setBody(&e.Body, &e.Body64, data)
+			e.Truncated = truncated
+		}
+	}
+	resp, err = t.next.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	e.Status = resp.StatusCode
+	e.RespHeader = redactHeader(resp.Header)
+	resp.Body = &recordBody{ ReadCloser: resp.Body, r: t.r, entry: e }
+	return
+}
+
+// Serves the responses from a recording. Requests are matched on
+// method, URL and the Depth and Range headers. If the same request
+// was recorded more than once, the responses are returned in order,
+// and the last one is repeated after that. An entry with a truncated
+// body cannot be replayed faithfully; it fails with ErrTruncated and
+// is counted as missed.
+type ReplayTransport struct {
+	sync.Mutex
+	entries		map[string][]*recordEntry
+	Missed		[]string
+}
+
+var ErrNotRecorded = errors.New("request not in recording")
+var ErrTruncated = errors.New("recorded body was truncated")
+
+func replayKey(method, url string, hdr http.Header) string {
+	return strings.Join([]string{ method, url, hdr.Get("Depth"), hdr.Get("Range") }, " ")
+}
+
+func NewReplayTransport(r io.Reader) (t *ReplayTransport, err error) {
+	t = &ReplayTransport{ entries: map[string][]*recordEntry{} }
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64 * 1024 * 1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		e := &recordEntry{}
+		err = json.Unmarshal(line, e)
+		if err != nil {
+			return
+		}
+		k := replayKey(e.Method, e.Url, e.Header)
+		t.entries[k] = append(t.entries[k], e)
+	}
+	err = scanner.Err()
+	return
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	k := replayKey(req.Method, requestUrl(req), req.Header)
+	t.Lock()
+	q := t.entries[k]
+	var e *recordEntry
+	if len(q) > 0 {
+		e = q[0]
+		if len(q) > 1 {
+			t.entries[k] = q[1:]
+		}
+	} else {
+		t.Missed = append(t.Missed, k)
+	}
+	truncated := e != nil && (e.Truncated || e.RespTruncated)
+	if truncated {
+		t.Missed = append(t.Missed, k + " (truncated)")
+	}
+	t.Unlock()
+	if e == nil {
+		return nil, ErrNotRecorded
+	}
+	if truncated {
+		return nil, ErrTruncated
+	}
+	body := getBody(e.RespBody, e.RespBody64)
+	hdr := http.Header{}
+	for k, v := range e.RespHeader {
+		hdr[k] = v
+	}
+	resp = &http.Response{
+		Status: strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode: e.Status,
+		Proto: "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: hdr,
+		Body: ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request: req,
+	}
+	return
+}
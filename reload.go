@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// On SIGHUP (or "webdavfs ctl MOUNTPOINT reload") the config file
+// is read again, and credentials, TLS certificates, trace and log
+// options, timeouts and cache times are applied to the running mount.
+// Options that change how the filesystem is mounted are not.
+
+// The cache times are read without the node lock (Getattr), so
+// they are loaded and stored atomically.
+func loadDuration(d *time.Duration) time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(d)))
+}
+
+func storeDuration(d *time.Duration, v time.Duration) {
+	atomic.StoreInt64((*int64)(d), int64(v))
+}
+
+func setTunables(f *WebdavFS, mo *MountOptions) {
+	if mo.StatCacheSet {
+		storeDuration(&f.statCacheTime, time.Duration(mo.StatCache) * time.Second)
+	}
+	if mo.DirCacheSet {
+		storeDuration(&f.dirCacheTime, time.Duration(mo.DirCache) * time.Second)
+	}
+	if mo.AttrCacheSet {
+		storeDuration(&f.attrValidTime, time.Duration(mo.AttrCache) * time.Second)
+	}
+}
+
+// A SIGHUP and a "reload" on a control socket can come in at the
+// same time; they are done one after the other.
+var reloadMutex sync.Mutex
+
+// Reload the configuration of all mounts. With -m, the mounts file is
+// read again as well; mounts that were added to it or removed from it
+// are not mounted or unmounted. A mount whose new configuration fails
+// keeps the old one, the others are reloaded anyway.
+func reloadConfig() (err error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	if mountsFile != "" {
+		defaults, err := parseMountOptions(opts.RawOptions, opts.Sloppy)
+		if err != nil {
+			return err
+		}
+		ms, err := readMountsFile(mountsFile, defaults)
+		if err != nil {
+			return err
+		}
+		byPath := map[string]*mount{}
+		for _, m := range ms {
+			byPath[m.mountpoint] = m
+		}
+		for _, m := range mounts {
+			if n := byPath[m.mountpoint]; n != nil {
+				m.cmdline = n.cmdline
+				m.ownConfig = n.ownConfig
+			}
+		}
+	}
+
+	davclient.ResetSharedTransports()
+	var errs []string
+	for i, m := range mounts {
+		mo, err := m.loadConfig()
+		if err != nil {
+			errs = append(errs, m.mountpoint + ": " + err.Error())
+			continue
+		}
+		if i == 0 {
+			// Trace options first, so that the rest can be traced.
+			err = reloadProcess(&mo)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		err = m.reload(&mo)
+		if err != nil {
+			errs = append(errs, m.mountpoint + ": " + err.Error())
+			continue
+		}
+		logInfof("%s: configuration reloaded", m.client.Url)
+	}
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	return
+}
+
+// The options that are not per mount come from the first one.
+func reloadProcess(mo *MountOptions) (err error) {
+	trace := mo.Trace
+	if trace == "" {
+		trace = "none"
+	}
+	fn := ""
+	if mo.TraceFile != traceFileName {
+		fn = mo.TraceFile
+	}
+	err = setTrace(trace, fn)
+	if err != nil {
+		return
+	}
+	return setupLogging(mo.LogLevel, mo.LogFormat, mo.LogTo)
+}
+
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		err := reloadConfig()
+		if err != nil {
+			logErrorf("reload: %v", err)
+		}
+	}
+}
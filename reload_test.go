@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miquels/webdavfs/davclient"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fh.WriteString("# reloadable\ntrace = webdav,fuse\ncredhelper=pass show dav | sed 's/,/ /'\ntimeout=5\nstatcache=0\n")
+	fh.Close()
+
+	m := &mount{}
+	m.cmdline, err = parseMountOptions("config=" + fh.Name() + ",timeout=30", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo, err := m.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mo.Trace != "webdav,fuse" || mo.CredHelper != "pass show dav | sed 's/,/ /'" {
+		t.Errorf("trace %q credhelper %q", mo.Trace, mo.CredHelper)
+	}
+	if mo.Timeout != 5 || !mo.StatCacheSet || mo.StatCache != 0 {
+		t.Errorf("timeout %d statcache %v/%d", mo.Timeout, mo.StatCacheSet, mo.StatCache)
+	}
+	if mo.MaxConns != 8 || mo.Retries != 3 {
+		t.Errorf("defaults not set: %d %d", mo.MaxConns, mo.Retries)
+	}
+
+	fh, _ = os.OpenFile(fh.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	fh.WriteString("bogus=1\n")
+	fh.Close()
+	if _, err = m.loadConfig(); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("unknown option: %v", err)
+	}
+}
+
+func TestCredHelper(t *testing.T) {
+	u, p, c, err := runCredHelper(`printf 'export WEBDAV_USERNAME="joe"\nWEBDAV_PASSWORD=x y\ncookie=a=b\n'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "joe" || p != "x y" || c != "a=b" {
+		t.Errorf("got %q %q %q", u, p, c)
+	}
+	if _, _, _, err = runCredHelper("exit 1"); err == nil {
+		t.Errorf("failing helper succeeded")
+	}
+}
+
+func TestReadMountsFile(t *testing.T) {
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fh.WriteString("# all mounts\ntrace = webdav\nuid=1000\n\n[/mnt/dav/home]\nurl = https://dav.example.com/home/\n\n[ /mnt/dav/proj/ ]\nurl=https://dav.example.com/proj/\nuid=1001\nro\n")
+	fh.Close()
+
+	defaults, _ := parseMountOptions("timeout=30", false)
+	ms, err := readMountsFile(fh.Name(), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].mountpoint != "/mnt/dav/home" || ms[1].mountpoint != "/mnt/dav/proj" {
+		t.Fatalf("mounts: %+v", ms)
+	}
+	if ms[0].url != "https://dav.example.com/home/" || ms[0].cmdline.Uid != 1000 || ms[0].cmdline.ReadOnly {
+		t.Errorf("home: %q %+v", ms[0].url, ms[0].cmdline)
+	}
+	if ms[1].cmdline.Uid != 1001 || !ms[1].cmdline.ReadOnly || ms[1].cmdline.Trace != "webdav" ||
+	    ms[1].cmdline.Timeout != 30 {
+		t.Errorf("proj: %+v", ms[1].cmdline)
+	}
+
+	for _, tc := range []struct { data, err string }{
+		{ "uid=1000\n", "no mounts" },
+		{ "[/a]\nuid=1000\n", "/a: no url" },
+		{ "[/a]\nurl=http://x/\n[/a]\nurl=http://y/\n", "line 3: /a: mounted twice" },
+		{ "[/a]\nurl=http://x/\nmetrics=:9100\n", "line 3: metrics: only allowed before" },
+		{ "url=http://x/\n", "line 1: url: not in a [mountpoint] section" },
+	} {
+		ioutil.WriteFile(fh.Name(), []byte(tc.data), 0600)
+		if _, err := readMountsFile(fh.Name(), MountOptions{}); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got %v, want %q", tc.data, err, tc.err)
+		}
+	}
+
+	// Nor in a config file that only one mount reads.
+	cf := fh.Name() + ".conf"
+	defer os.Remove(cf)
+	ioutil.WriteFile(cf, []byte("trace=webdav\n"), 0600)
+	ioutil.WriteFile(fh.Name(), []byte("config=" + cf + "\n[/a]\nurl=http://x/\n"), 0600)
+	ms, err = readMountsFile(fh.Name(), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms[0].loadConfig(); err != nil {
+		t.Errorf("config for all mounts: %v", err)
+	}
+	ioutil.WriteFile(fh.Name(), []byte("[/a]\nurl=http://x/\nconfig=" + cf + "\n"), 0600)
+	ms, err = readMountsFile(fh.Name(), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms[0].loadConfig(); err == nil || !strings.Contains(err.Error(), "line 1: trace: not allowed") {
+		t.Errorf("config for one mount: got %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	saved, savedFile := mounts, mountsFile
+	defer func() {
+		mounts, mountsFile = saved, savedFile
+	}()
+	mountsFile = ""
+	newMount := func(mp string, mo MountOptions) *mount {
+		return &mount{
+			mountpoint: mp,
+			cmdline: mo,
+			client: &davclient.Client{ Url: "http://dav.example.com" + mp },
+			fs: NewFS(newMemBackend(), WebdavFS{}),
+		}
+	}
+	a := newMount("/a", MountOptions{ Config: "/nonexistent/webdavfs.conf" })
+	b := newMount("/b", MountOptions{ StatCache: 7, StatCacheSet: true })
+	mounts = []*mount{ a, b }
+
+	// The first mount fails, the second one is reloaded anyway.
+	err := reloadConfig()
+	if err == nil || !strings.HasPrefix(err.Error(), "/a: ") {
+		t.Errorf("reload: %v", err)
+	}
+	if b.fs.statCacheTime != 7 * time.Second {
+		t.Errorf("/b: statcache %v, want 7s", b.fs.statCacheTime)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+// Every file in testdata/replay is a session with a server in the
+// format of record=. iis.jsonl is written by hand after what IIS
+// sends, not recorded; real recordings can be added next to it. Each
+// is played back through the davclient.Client and the FUSE handlers,
+// so a change that breaks support for that server shows up here.
+func replayClient(t *testing.T, file string) (*davclient.Client, *ReplayTransport) {
+	fh, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	rt, err := NewReplayTransport(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &davclient.Client{
+		Url: "http://files.example.com/share",
+		Transport: rt,
+	}
+	return d, rt
+}
+
+func TestReplayIIS(t *testing.T) {
+	d, rt := replayClient(t, filepath.Join("testdata", "replay", "iis.jsonl"))
+	if err := d.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d.IsApache || d.IsSabre || !d.DavSupport["2"] {
+		t.Errorf("server detection: apache=%v sabre=%v dav=%v", d.IsApache, d.IsSabre, d.DavSupport)
+	}
+
+	root := NewFS(newDavBackend(d), WebdavFS{}).root
+	ctx := context.Background()
+
+	dd, err := root.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]fuse.DirentType{}
+	for _, de := range dd {
+		names[de.Name] = de.Type
+	}
+	if len(dd) != 3 || names["Logs"] != fuse.DT_Dir || names["Read Me.txt"] != fuse.DT_File {
+		t.Errorf("ReadDirAll: %v", dd)
+	}
+
+	nn, err := root.Lookup(ctx, &fuse.LookupRequest{ Name: "Read Me.txt" }, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := nn.(*Node)
+	if _, err := nd.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.Attr
+	nd.Attr(ctx, &attr)
+	if attr.Size != 13 || attr.Mtime.Unix() != 1541167540 {
+		t.Errorf("attr: size %d mtime %v", attr.Size, attr.Mtime)
+	}
+	resp := &fuse.ReadResponse{}
+	if err := nd.Read(ctx, &fuse.ReadRequest{ Size: 4096 }, resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "hello, world\n" {
+		t.Errorf("Read: %q", resp.Data)
+	}
+
+	if len(rt.Missed) > 0 {
+		t.Errorf("requests not in the recording: %q", rt.Missed)
+	}
+}
+
+func TestReplayMissed(t *testing.T) {
+	d, rt := replayClient(t, filepath.Join("testdata", "replay", "iis.jsonl"))
+	if _, err := d.Stat(context.Background(), "/nothere"); err == nil {
+		t.Errorf("Stat of unrecorded path succeeded")
+	}
+	if len(rt.Missed) != 1 {
+		t.Errorf("missed: %q", rt.Missed)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte{ 0xff, 0xfe, 'x' })
+	}))
+	defer srv.Close()
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	if err := startRecording(fh.Name()); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	d := &davclient.Client{ Url: srv.URL + "/dav", Password: "pw", RoundTrip: roundTrip }
+	data, err := d.Get(ctx, "/bin")
+	stopRecording()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(fh.Name())
+	if strings.Contains(string(b), "secret") || strings.Contains(string(b), srv.URL) {
+		t.Errorf("recording has credentials or host: %s", b)
+	}
+	rt, err := NewReplayTransport(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = &davclient.Client{ Url: "http://other.example.com/dav", Transport: rt }
+	replayed, err := d.Get(ctx, "/bin")
+	if err != nil || string(replayed) != string(data) {
+		t.Errorf("replay: %q %v, recorded %q", replayed, err, data)
+	}
+}
+
+func TestRecordMaxBody(t *testing.T) {
+	big := strings.Repeat("x", recordMaxBody + 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(big))
+	}))
+	defer srv.Close()
+	fh, err := ioutil.TempFile("", "webdavfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	if err := startRecording(fh.Name()); err != nil {
+		t.Fatal(err)
+	}
+	d := &davclient.Client{ Url: srv.URL + "/dav", RoundTrip: roundTrip }
+	data, err := d.Get(context.Background(), "/big")
+	stopRecording()
+	if err != nil || len(data) != len(big) {
+		t.Fatalf("Get: %d bytes, %v", len(data), err)
+	}
+
+	b, _ := ioutil.ReadFile(fh.Name())
+	e := &recordEntry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.RespBody) != recordMaxBody || !e.RespTruncated {
+		t.Errorf("recorded %d bytes, truncated %v", len(e.RespBody), e.RespTruncated)
+	}
+
+	// A truncated body is not played back.
+	rt, err := NewReplayTransport(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = &davclient.Client{ Url: "http://other.example.com/dav", Transport: rt }
+	if _, err := d.Get(context.Background(), "/big"); err == nil || len(rt.Missed) != 1 {
+		t.Errorf("replay of truncated body: %v, missed %q", err, rt.Missed)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+const searchDir = ".search"
+
+// Short names for properties in .search/<query> directory names.
+var searchProps = map[string]string{
+	"name":	"displayname",
+	"type":	"getcontenttype",
+}
+
+// .search is a magic directory. Looking up "name=*.pdf" in it returns
+// a directory with symlinks to all matching files. Several conditions
+// can be combined with '&', for example "name=holiday*&type=image*".
+func setupSearchDir(f *WebdavFS, d *davclient.Client) {
+	if !d.CanSearch() {
+		return
+	}
+	f.virtual[searchDir] = &VirtNode{
+		Dnode: Dnode{ Name: searchDir, IsDir: true },
+		kind: vkSearch,
+		dav: newDavBackend(d),
+		files: newDavBackend(d),
+		path: "/",
+		inode: fs.GenerateDynamicInode(1, searchDir),
+		fs: f,
+	}
+}
+
+func parseQuery(s string) (where map[string]string, err error) {
+	where = map[string]string{}
+	for _, cond := range strings.Split(s, "&") {
+		kv := strings.SplitN(cond, "=", 2)
+		prop, ok := searchProps[kv[0]]
+		if len(kv) != 2 || kv[1] == "" || !ok {
+			err = fuse.ENOENT
+			return
+		}
+		where[prop] = kv[1]
+	}
+	return
+}
+
+func (vn *VirtNode) lookupQuery(name string) (rn fs.Node, err error) {
+	where, err := parseQuery(name)
+	if err != nil {
+		return
+	}
+	qn := vn.child(Dnode{ Name: name, IsDir: true }, vkQuery, vn.path,
+		fs.GenerateDynamicInode(vn.inode, name))
+	qn.query = where
+	rn = qn
+	return
+}
+
+// Run the query. Results are named after the file they point to;
+// if names clash, a ~N suffix is added.
+func (vn *VirtNode) search(ctx context.Context) (results []Dnode, err error) {
+	found, err := vn.dav.Search(ctx, vn.path, vn.query)
+	if err != nil {
+		return
+	}
+	seen := map[string]int{}
+	for _, f := range found {
+		name := path.Base(f.Name)
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			name += "~" + strconv.Itoa(n)
+		}
+		target := "../.." + f.Name
+		results = append(results, Dnode{
+			Name: name,
+			IsLink: true,
+			Target: target,
+			Mtime: f.Mtime,
+			Ctime: f.Ctime,
+			Size: uint64(len(target)),
+		})
+	}
+	vn.Lock()
+	vn.results = results
+	vn.Unlock()
+	return
+}
+
+func (vn *VirtNode) readResults(ctx context.Context) (dd []fuse.Dirent, err error) {
+	results, err := vn.search(ctx)
+	if err != nil {
+		return
+	}
+	for _, r := range results {
+		dd = append(dd, fuse.Dirent{
+			Name: r.Name,
+			Inode: fs.GenerateDynamicInode(vn.inode, r.Name),
+			Type: fuse.DT_Link,
+		})
+	}
+	return
+}
+
+func (vn *VirtNode) lookupResult(ctx context.Context, name string) (rn fs.Node, err error) {
+	vn.Lock()
+	results := vn.results
+	vn.Unlock()
+	if results == nil {
+		results, err = vn.search(ctx)
+		if err != nil {
+			return
+		}
+	}
+	for _, r := range results {
+		if r.Name == name {
+			rn = vn.child(r, vkLink, "", fs.GenerateDynamicInode(vn.inode, name))
+			return
+		}
+	}
+	err = fuse.ENOENT
+	return
+}
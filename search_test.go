@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Only implements Search, the rest panics.
+type searchBackend struct {
+	ncBackend
+	found		[]Dnode
+}
+
+func (b *searchBackend) Search(ctx context.Context, dir string, where map[string]string) ([]Dnode, error) {
+	return b.found, nil
+}
+
+func TestSearchResults(t *testing.T) {
+	vn := &VirtNode{ kind: vkQuery, path: "/" }
+	vn.dav = &searchBackend{ found: []Dnode{
+		{ Name: "/a/report.pdf", Size: 42 },
+		{ Name: "/b/report.pdf", Size: 7 },
+	}}
+	vn.query, _ = parseQuery("name=*.pdf")
+	if vn.query["displayname"] != "*.pdf" {
+		t.Errorf("query: %v", vn.query)
+	}
+	res, err := vn.search(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("got %d results, want 2", len(res))
+	}
+	if res[0].Name != "report.pdf" || res[0].Target != "../../a/report.pdf" {
+		t.Errorf("result 0: %s -> %s", res[0].Name, res[0].Target)
+	}
+	if res[1].Name != "report.pdf~2" || res[1].Target != "../../b/report.pdf" {
+		t.Errorf("result 1: %s -> %s", res[1].Name, res[1].Target)
+	}
+}
@@ -10,28 +10,51 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/miquels/webdavfs/davclient"
 )
 
+// The first three are the ones davclient knows about.
 const (
-	T_WEBDAV	= 1 << iota
-	T_HTTP_REQUEST
-	T_HTTP_HEADERS
-	T_FUSE
-	T_LOCK
+	T_WEBDAV	= davclient.T_WEBDAV
+	T_HTTP_REQUEST	= davclient.T_HTTP_REQUEST
+	T_HTTP_HEADERS	= davclient.T_HTTP_HEADERS
+	T_FUSE		= T_HTTP_HEADERS << 1
+	T_LOCK		= T_HTTP_HEADERS << 2
+	T_BACKEND	= T_HTTP_HEADERS << 3
 )
 
+// Changed at runtime by the control socket, so only use it atomically.
 var traceOptions = uint32(0)
 var timeFmt = "2006-01-02 15:04:05"
 var traceFile *os.File
+var traceFileName string
 
 var traceChan = make(chan string, 8)
 
+type logFile struct {
+	file		*os.File
+	name		string
+}
+var logFileChan = make(chan logFile)
+
 func startLogger (file *os.File, fileName string) {
 	go func() {
 		for {
-			line := <-traceChan
+			var line string
+			select {
+			case line = <-traceChan:
+			case lf := <-logFileChan:
+				if file != os.Stdout && file != os.Stderr {
+					file.Close()
+				}
+				file, fileName = lf.file, lf.name
+				traceFile = file
+				continue
+			}
 
 			if file == traceFile {
 				// first check if file was unlinked-
@@ -39,7 +62,7 @@ func startLogger (file *os.File, fileName string) {
 				var fi, fi2 syscall.Stat_t
 				err := syscall.Fstat(int(file.Fd()), &fi)
 				if fi.Nlink == 0 {
-					traceOptions = 0
+					atomic.StoreUint32(&traceOptions, 0)
 					syscall.Ftruncate(int(file.Fd()), 0)
 					file, _, _ = openDevNull()
 				} else {
@@ -64,7 +87,7 @@ func startLogger (file *os.File, fileName string) {
 }
 
 func trace(flags uint32) bool {
-	return (traceOptions & flags) > 0
+	return (atomic.LoadUint32(&traceOptions) & flags) > 0
 }
 
 func tPrintf(format string, args ...interface{}) {
@@ -136,34 +159,88 @@ func traceredirectStdoutErr() {
 	Dup2(int(traceFile.Fd()), 2)
 }
 
+var traceNames = []struct {
+	name		string
+	flag		uint32
+}{
+	{ "webdav", T_WEBDAV },
+	{ "httpreq", T_HTTP_REQUEST },
+	{ "httphdr", T_HTTP_HEADERS },
+	{ "fuse", T_FUSE },
+	{ "locking", T_LOCK },
+	{ "backend", T_BACKEND },
+}
+
+func parseTraceOpts(opt string) (flags uint32, err error) {
+	for _, o := range strings.Split(opt, ",") {
+		found := false
+		for _, t := range traceNames {
+			if o == t.name {
+				flags |= t.flag
+				found = true
+			}
+		}
+		if !found {
+			err = errors.New("unknown trace option: " + o)
+			return
+		}
+	}
+	return
+}
+
+func traceOptString(flags uint32) string {
+	a := []string{}
+	for _, t := range traceNames {
+		if flags & t.flag != 0 {
+			a = append(a, t.name)
+		}
+	}
+	if len(a) == 0 {
+		return "none"
+	}
+	return strings.Join(a, ",")
+}
+
+// Change the trace options of a running mount. If fn is set, trace
+// to that file from now on.
+func setTrace(opt string, fn string) (err error) {
+	flags := uint32(0)
+	if opt != "none" {
+		flags, err = parseTraceOpts(opt)
+		if err != nil {
+			return
+		}
+	}
+	if fn != "" {
+		var fh *os.File
+		fh, err = unprivOpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return
+		}
+		logFileChan <- logFile{ fh, fn }
+		traceFileName = fn
+	}
+	atomic.StoreUint32(&traceOptions, flags)
+	return
+}
+
 func traceOpts(opt string, fn string) (err error)  {
 	if opt == "" {
+		startLogger(os.Stdout, "stdout")
 		return
 	}
-	opts := strings.Split(opt, ",")
-	for _, o := range(opts) {
-		switch o {
-		case "webdav":
-			traceOptions |= T_WEBDAV
-		case "httpreq":
-			traceOptions |= T_HTTP_REQUEST
-		case "httphdr":
-			traceOptions |= T_HTTP_HEADERS
-		case "fuse":
-			traceOptions |= T_FUSE
-		case "locking":
-			traceOptions |= T_LOCK
-		default:
-			err = errors.New("unknown trace option: " + o)
-			return
-		}
+	flags, err := parseTraceOpts(opt)
+	if err != nil {
+		return
 	}
-	if traceOptions == 0 || fn == "" {
+	atomic.StoreUint32(&traceOptions, flags)
+	if flags == 0 || fn == "" {
 		startLogger(os.Stdout, "stdout")
 		return
 	}
 	traceFile, err = unprivOpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err == nil {
+		traceFileName = fn
 		startLogger(traceFile, fn)
 	} else {
 		startLogger(os.Stdout, "stdout")
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+)
+
+// Write through a sequential upload if we can. Returns false if the
+// caller should use a partial PUT instead. Caller must hold uploadMutex.
+func (nf *Node) uploadWrite(ctx context.Context, path string, data []byte, offset int64) (ok bool, err error) {
+	nf.Lock()
+	size := nf.Size
+	nf.Unlock()
+	if nf.upload == nil && offset == 0 && size == 0 {
+		nf.upload = nf.fs.dav.NewUpload(path)
+		nf.uploadOff = 0
+		nf.setUploadBusy(nf.upload != nil)
+	}
+	if nf.upload == nil {
+		return
+	}
+	if offset != nf.uploadOff {
+		// not sequential anymore. Put what we have in place,
+		// then continue with partial updates.
+		if trace(T_FUSE) {
+			tPrintf("uploadWrite(%s): write at %d, expected %d, stop upload",
+				path, offset, nf.uploadOff)
+		}
+		err = nf.uploadFinish(ctx)
+		return
+	}
+	err = nf.upload.Write(ctx, data)
+	if err != nil {
+		nf.uploadAbort()
+		return
+	}
+	nf.uploadOff += int64(len(data))
+	ok = true
+	return
+}
+
+// Finish a sequential upload, if one is in progress.
+func (nf *Node) uploadFinish(ctx context.Context) (err error) {
+	if nf.upload == nil {
+		return
+	}
+	err = nf.upload.Close(ctx)
+	nf.upload = nil
+	nf.setUploadBusy(false)
+	return
+}
+
+func (nf *Node) uploadAbort() {
+	if nf.upload != nil {
+		nf.upload.Abort()
+		nf.upload = nil
+		nf.setUploadBusy(false)
+	}
+}
+
+// Called with uploadMutex held, which comes before the node lock.
+func (nf *Node) setUploadBusy(busy bool) {
+	nf.Lock()
+	nf.uploadBusy = busy
+	nf.Unlock()
+}
+
+// Finish up any upload before doing something else with the file.
+func (nf *Node) uploadSync(ctx context.Context) (err error) {
+	nf.uploadMutex.Lock()
+	err = nf.uploadFinish(ctx)
+	nf.uploadMutex.Unlock()
+	return
+}
+
+func (nf *Node) uploading() bool {
+	nf.uploadMutex.Lock()
+	defer nf.uploadMutex.Unlock()
+	return nf.upload != nil
+}
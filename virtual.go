@@ -0,0 +1,289 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/miquels/webdavfs/davclient"
+)
+
+const (
+	trashDir = ".trash"
+	versionsDir = ".versions"
+	virtAttrValidTime = 1 * time.Second
+)
+
+const (
+	vkDav = iota		// read-only view on another dav endpoint
+	vkMirror		// mirror of the real tree, for .versions
+	vkSearch		// .search, see search.go
+	vkQuery			// .search/<query>
+	vkLink			// .search/<query>/<result>
+)
+
+// Read-only virtual directories at the root of the mount, backed
+// by the Nextcloud trashbin and versions endpoints:
+//
+//	.trash/			remote.php/dav/trashbin/<user>/trash/
+//	.versions/path/file/	remote.php/dav/versions/<user>/versions/<fileid>/
+//
+// Moving something out of .trash restores it.
+type VirtNode struct {
+	Dnode
+	kind		int
+	dav		ncBackend
+	files		*davBackend	// the mounted tree itself
+	path		string
+	inode		uint64
+	query		map[string]string
+	results		[]Dnode
+	fs		*WebdavFS
+	sync.Mutex
+}
+
+// The Nextcloud endpoints need a bit more than a Backend has.
+type ncBackend interface {
+	Backend
+	PropFind(ctx context.Context, path string, depth int, props []string) ([]*Props, error)
+	Search(ctx context.Context, dir string, where map[string]string) ([]Dnode, error)
+}
+
+func setupTrashDirs(f *WebdavFS, d *davclient.Client) {
+	if !d.IsNextcloud {
+		return
+	}
+	f.virtual[trashDir] = &VirtNode{
+		Dnode: Dnode{ Name: trashDir, IsDir: true },
+		kind: vkDav,
+		dav: newDavBackend(d.Trashbin()),
+		files: newDavBackend(d),
+		path: "/trash/",
+		inode: fs.GenerateDynamicInode(1, trashDir),
+		fs: f,
+	}
+	f.virtual[versionsDir] = &VirtNode{
+		Dnode: Dnode{ Name: versionsDir, IsDir: true },
+		kind: vkMirror,
+		dav: newDavBackend(d.Versions()),
+		files: newDavBackend(d),
+		path: "/",
+		inode: fs.GenerateDynamicInode(1, versionsDir),
+		fs: f,
+	}
+}
+
+// A node below vn.
+func (vn *VirtNode) child(dnode Dnode, kind int, path string, inode uint64) *VirtNode {
+	return &VirtNode{
+		Dnode: dnode,
+		kind: kind,
+		dav: vn.dav,
+		files: vn.files,
+		path: path,
+		inode: inode,
+		fs: vn.fs,
+	}
+}
+
+func (vn *VirtNode) isTrashRoot() bool {
+	return vn.kind == vkDav && vn.path == "/trash/"
+}
+
+func (vn *VirtNode) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
+	mode := vn.fs.fileMode &^ 0222
+	if vn.IsDir {
+		mode = vn.fs.dirMode &^ 0222
+	}
+	if vn.IsLink {
+		mode = os.ModeSymlink | 0777
+	}
+	ctime, mtime := getCMtime(vn.Ctime, vn.Mtime)
+	*attr = fuse.Attr{
+		Valid: virtAttrValidTime,
+		Inode: vn.inode,
+		Size: vn.Size,
+		Blocks: (vn.Size + 511) / 512,
+		Atime: mtime,
+		Mtime: mtime,
+		Ctime: ctime,
+		Crtime: ctime,
+		Mode: mode,
+		Nlink: 1,
+		Uid: vn.fs.Uid,
+		Gid: vn.fs.Gid,
+		BlockSize: vn.fs.blockSize,
+	}
+	return
+}
+
+func (vn *VirtNode) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (rn fs.Node, err error) {
+	if trace(T_FUSE) {
+		tPrintf("%d Lookup(%s, %s)", req.Header.ID, vn.path, req.Name)
+		defer func() {
+			if err != nil {
+				tPrintf("%d Lookup(%s, %s): %v", req.Header.ID, vn.path, req.Name, err)
+			}
+		}()
+	}
+	switch vn.kind {
+	case vkSearch:
+		return vn.lookupQuery(req.Name)
+	case vkQuery:
+		return vn.lookupResult(ctx, req.Name)
+	case vkLink:
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	path := joinPath(vn.path, req.Name)
+	inode := fs.GenerateDynamicInode(vn.inode, req.Name)
+
+	if vn.kind == vkDav {
+		var dnode Dnode
+		dnode, err = vn.dav.Stat(ctx, path)
+		if err != nil {
+			return
+		}
+		if dnode.IsDir {
+			path = addSlash(path)
+		}
+		dnode.Name = req.Name
+		rn = vn.child(dnode, vkDav, path, inode)
+		return
+	}
+
+	// .versions mirrors the real tree. Directories stay directories,
+	// files become a directory with their versions.
+	dnode, err := vn.files.Stat(ctx, path)
+	if err != nil {
+		return
+	}
+	if dnode.IsDir {
+		rn = vn.child(dnode, vkMirror, path, inode)
+		return
+	}
+	props, err := vn.files.PropFind(ctx, path, 0, []string{ "resourcetype", "oc:fileid" })
+	if err != nil {
+		return
+	}
+	if len(props) != 1 || props[0].FileId == "" {
+		err = fuse.ENOENT
+		return
+	}
+	dnode.IsDir = true
+	dnode.Size = 0
+	rn = vn.child(dnode, vkDav, "/versions/" + props[0].FileId + "/", inode)
+	return
+}
+
+func (vn *VirtNode) ReadDirAll(ctx context.Context) (dd []fuse.Dirent, err error) {
+	if trace(T_FUSE) {
+		tPrintf("- ReadDirAll(%s)", vn.path)
+		defer func() {
+			if err != nil {
+				tPrintf("- ReadDirAll(%s): %v", vn.path, err)
+			}
+		}()
+	}
+	switch vn.kind {
+	case vkSearch:
+		return
+	case vkQuery:
+		return vn.readResults(ctx)
+	}
+	b := Backend(vn.dav)
+	if vn.kind == vkMirror {
+		b = vn.files
+	}
+	err = b.Readdir(ctx, vn.path, func(d Dnode) {
+		if d.Name == "" || d.Name == "." {
+			return
+		}
+		tp := fuse.DT_File
+		if d.IsDir || vn.kind == vkMirror {
+			tp = fuse.DT_Dir
+		}
+		dd = append(dd, fuse.Dirent{
+			Name: d.Name,
+			Inode: fs.GenerateDynamicInode(vn.inode, d.Name),
+			Type: tp,
+		})
+	})
+	if err != nil {
+		dd = nil
+	}
+	return
+}
+
+func (vn *VirtNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	if trace(T_FUSE) {
+		tPrintf("%d Read(%s, %d, %d)", req.Header.ID, vn.path, req.Offset, req.Size)
+	}
+	toRead := int64(vn.Size) - req.Offset
+	if vn.IsDir || vn.IsLink || toRead <= 0 {
+		resp.Data = []byte{}
+		return
+	}
+	if toRead > int64(req.Size) {
+		toRead = int64(req.Size)
+	}
+	resp.Data, err = vn.dav.GetRange(ctx, vn.path, req.Offset, int(toRead))
+	return
+}
+
+func (vn *VirtNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if !vn.IsLink {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return vn.Target, nil
+}
+
+// Moving something out of the trash restores it. The server puts it
+// back in its original location, so if it was moved somewhere else,
+// move it there afterwards.
+func (vn *VirtNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	if trace(T_FUSE) {
+		tPrintf("%d Rename(%s%s, %s)", req.Header.ID, vn.path, req.OldName, req.NewName)
+		defer func() {
+			if err != nil {
+				tPrintf("%d Rename(%s%s): %v", req.Header.ID, vn.path, req.OldName, err)
+			}
+		}()
+	}
+	dest, ok := newDir.(*Node)
+	if !vn.isTrashRoot() || !ok {
+		return fuse.EPERM
+	}
+	item := vn.path + req.OldName
+	props, err := vn.dav.PropFind(ctx, item, 0, []string{ "resourcetype", "nc:trashbin-original-location" })
+	if err != nil {
+		return
+	}
+	if len(props) != 1 || props[0].TrashLocation == "" {
+		return fuse.EIO
+	}
+	orig := "/" + strings.TrimPrefix(props[0].TrashLocation, "/")
+
+	err = vn.dav.Move(ctx, item, "/restore/" + req.OldName)
+	if err != nil {
+		return
+	}
+
+	dest.Lock()
+	destPath := joinPath(dest.getPath(), req.NewName)
+	dest.invalidateNode(req.NewName)
+	dest.Unlock()
+
+	// orig is relative to the files root of the user, which might
+	// not be the root of the mount.
+	files, rel := vn.files.c.FilesRoot()
+	want := rel + destPath
+	if want != orig {
+		err = newDavBackend(files).Move(ctx, orig, want)
+	}
+	return
+}
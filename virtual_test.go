@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/miquels/webdavfs/davclient"
+	"golang.org/x/net/webdav"
+)
+
+// Just enough of a Nextcloud server for .trash and .versions: the
+// files, trashbin and versions endpoints of user alice, and restore.
+type ncServer struct {
+	*httptest.Server
+	fs		webdav.FileSystem
+	dav		*webdav.Handler
+	mu		sync.Mutex
+	fail		map[string]int
+}
+
+const ncPrefix = "/remote.php/dav"
+
+func newNcServer(t *testing.T) (s *ncServer) {
+	s = &ncServer{
+		fs: webdav.NewMemFS(),
+		fail: map[string]int{},
+	}
+	s.dav = &webdav.Handler{
+		Prefix: ncPrefix,
+		FileSystem: s.fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	for _, dir := range []string{ "/files", "/files/alice", "/files/alice/mnt",
+	    "/trashbin", "/trashbin/alice", "/trashbin/alice/trash", "/trashbin/alice/restore",
+	    "/versions", "/versions/alice", "/versions/alice/versions",
+	    "/versions/alice/versions/42" } {
+		if err := s.fs.Mkdir(context.Background(), dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return
+}
+
+func (s *ncServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, ncPrefix)
+	s.mu.Lock()
+	status := s.fail[r.Method + " " + path]
+	s.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if r.Method == "MOVE" && strings.Contains(r.Header.Get("Destination"), "/trashbin/alice/restore/") {
+		s.restore(w, r, path)
+		return
+	}
+	s.dav.ServeHTTP(w, r)
+}
+
+// Put a trashed item back where it came from.
+func (s *ncServer) restore(w http.ResponseWriter, r *http.Request, path string) {
+	ctx := r.Context()
+	orig := s.prop(path, "http://nextcloud.org/ns", "trashbin-original-location")
+	if orig == "" {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	if err := s.fs.Rename(ctx, path, "/files/alice/" + orig); err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+func (s *ncServer) writeFile(path, data string) {
+	f, err := s.fs.OpenFile(context.Background(), path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		panic(err)
+	}
+	f.Write([]byte(data))
+	f.Close()
+}
+
+func (s *ncServer) exists(path string) bool {
+	_, err := s.fs.Stat(context.Background(), path)
+	return err == nil
+}
+
+func (s *ncServer) setProp(path, space, name, value string) {
+	f, err := s.fs.OpenFile(context.Background(), path, os.O_RDONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	prop := webdav.Property{ XMLName: xml.Name{ Space: space, Local: name }, InnerXML: []byte(value) }
+	f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{ { Props: []webdav.Property{ prop } } })
+}
+
+func (s *ncServer) prop(path, space, name string) string {
+	f, err := s.fs.OpenFile(context.Background(), path, os.O_RDONLY, 0)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	props, _ := f.(webdav.DeadPropsHolder).DeadProps()
+	return string(props[xml.Name{ Space: space, Local: name }].InnerXML)
+}
+
+// A mount of alice/mnt with the trash bin and versions set up. In
+// the trash is a.txt, which came from mnt/a.txt. mnt/v.txt has two
+// old versions.
+func testNcMount(t *testing.T) (s *ncServer, root *Node) {
+	s = newNcServer(t)
+	s.writeFile("/trashbin/alice/trash/a.txt.d100", "deleted")
+	s.setProp("/trashbin/alice/trash/a.txt.d100", "http://nextcloud.org/ns",
+		"trashbin-original-location", "mnt/a.txt")
+	s.writeFile("/files/alice/mnt/v.txt", "v3")
+	s.setProp("/files/alice/mnt/v.txt", "http://owncloud.org/ns", "fileid", "42")
+	s.writeFile("/versions/alice/versions/42/1700000000", "v1")
+	s.writeFile("/versions/alice/versions/42/1700000100", "v2")
+
+	d := &davclient.Client{
+		Url: s.URL + ncPrefix + "/files/alice/mnt",
+		Transport: s.Client().Transport,
+	}
+	if err := d.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if !d.IsNextcloud {
+		t.Fatal("Nextcloud not detected")
+	}
+	f := NewFS(newDavBackend(d), WebdavFS{ Mode: 0755 })
+	setupTrashDirs(f, d)
+	root = f.root
+	return
+}
+
+func vlookup(t *testing.T, dir interface{}, name string) (*VirtNode, error) {
+	t.Helper()
+	req := &fuse.LookupRequest{ Name: name }
+	var err error
+	var n interface{}
+	switch d := dir.(type) {
+	case *Node:
+		n, err = d.Lookup(context.Background(), req, &fuse.LookupResponse{})
+	case *VirtNode:
+		n, err = d.Lookup(context.Background(), req, &fuse.LookupResponse{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n.(*VirtNode), nil
+}
+
+func vreaddir(t *testing.T, vn *VirtNode) (names []string) {
+	t.Helper()
+	dd, err := vn.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatalf("ReadDirAll(%s): %v", vn.path, err)
+	}
+	for _, d := range dd {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestVirtTrash(t *testing.T) {
+	_, root := testNcMount(t)
+	trash, err := vlookup(t, root, trashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := vreaddir(t, trash); strings.Join(names, " ") != "a.txt.d100" {
+		t.Errorf(".trash: %v", names)
+	}
+	item, err := vlookup(t, trash, "a.txt.d100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.IsDir || item.Size != 7 || item.path != "/trash/a.txt.d100" {
+		t.Errorf("a.txt.d100: dir %v size %d path %s", item.IsDir, item.Size, item.path)
+	}
+	resp := &fuse.ReadResponse{}
+	err = item.Read(context.Background(), &fuse.ReadRequest{ Size: 100 }, resp)
+	if err != nil || string(resp.Data) != "deleted" {
+		t.Errorf("read: %q, %v", resp.Data, err)
+	}
+	if _, err = vlookup(t, trash, "nothere"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("lookup nothere: %v, want ENOENT", err)
+	}
+}
+
+func TestVirtVersions(t *testing.T) {
+	_, root := testNcMount(t)
+	versions, err := vlookup(t, root, versionsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files show up as directories.
+	names := vreaddir(t, versions)
+	if strings.Join(names, " ") != "v.txt" {
+		t.Errorf(".versions: %v", names)
+	}
+	dd, _ := versions.ReadDirAll(context.Background())
+	if len(dd) != 1 || dd[0].Type != fuse.DT_Dir {
+		t.Errorf(".versions: %v", dd)
+	}
+	vdir, err := vlookup(t, versions, "v.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vdir.IsDir || vdir.path != "/versions/42/" {
+		t.Errorf("v.txt: dir %v path %s", vdir.IsDir, vdir.path)
+	}
+	names = vreaddir(t, vdir)
+	if strings.Join(names, " ") != "1700000000 1700000100" {
+		t.Errorf(".versions/v.txt: %v", names)
+	}
+	if _, err = vlookup(t, versions, "nothere"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("lookup nothere: %v, want ENOENT", err)
+	}
+}
+
+func restore(t *testing.T, root *Node, item, newName string) error {
+	t.Helper()
+	trash, err := vlookup(t, root, trashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &fuse.RenameRequest{ OldName: item, NewName: newName }
+	return trash.Rename(context.Background(), req, root)
+}
+
+func TestVirtRestore(t *testing.T) {
+	s, root := testNcMount(t)
+	if err := restore(t, root, "a.txt.d100", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.exists("/files/alice/mnt/a.txt") || s.exists("/trashbin/alice/trash/a.txt.d100") {
+		t.Error("a.txt was not restored")
+	}
+}
+
+func TestVirtRestoreMove(t *testing.T) {
+	s, root := testNcMount(t)
+	if err := restore(t, root, "a.txt.d100", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.exists("/files/alice/mnt/b.txt") || s.exists("/files/alice/mnt/a.txt") {
+		t.Error("a.txt was not restored as b.txt")
+	}
+}
+
+func TestVirtRestoreMoveFails(t *testing.T) {
+	s, root := testNcMount(t)
+	s.fail["MOVE /files/alice/mnt/a.txt"] = 403
+	err := restore(t, root, "a.txt.d100", "b.txt")
+	if errnoOf(err) != syscall.EACCES {
+		t.Errorf("got %v, want EACCES", err)
+	}
+	// it is restored, just not moved.
+	if !s.exists("/files/alice/mnt/a.txt") || s.exists("/files/alice/mnt/b.txt") {
+		t.Error("a.txt should be restored in its original location")
+	}
+}
+
+func TestVirtNotInTrash(t *testing.T) {
+	s, root := testNcMount(t)
+	err := restore(t, root, "nothere", "b.txt")
+	if errnoOf(err) != syscall.ENOENT {
+		t.Errorf("got %v, want ENOENT", err)
+	}
+	if s.exists("/files/alice/mnt/b.txt") {
+		t.Error("b.txt should not exist")
+	}
+}